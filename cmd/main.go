@@ -1,11 +1,50 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
 	"github.com/zackradisic/downloadsound.cloud-api-go/server"
 )
 
 func main() {
-	s := server.New()
+	cfg, err := server.LoadConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	if cfg.DumpConfig {
+		fmt.Print(cfg.String())
+	}
+
+	s, err := server.New(cfg)
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	go s.WatchConfig()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	grpcStopped := make(chan struct{})
+	if cfg.GRPCAddr != "" {
+		go func() {
+			if err := s.RunGRPC(ctx); err != nil {
+				log.Fatal(err.Error())
+			}
+			close(grpcStopped)
+		}()
+	} else {
+		close(grpcStopped)
+	}
 
-	s.Run(":8080")
+	if err := s.Run(ctx); err != nil {
+		log.Fatal(err.Error())
+	}
+	<-grpcStopped
 }
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zackradisic/downloadsound.cloud-api-go/server"
+)
+
+// retryBackoff is how long to wait before the first retry, it doubles every retry
+var retryBackoff = 2 * time.Second
+
+// refreshReuse is how long a link resolved again for a retry is reused by other retries
+const refreshReuse = time.Minute
+
+// Media can take a long time to download, so only the wait for a response is limited
+var client = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+// refresher resolves a link again when the URLs of its tracks may have expired. Tracks
+// retried around the same time share a resolution, rather than each resolving the whole
+// collection again.
+type refresher struct {
+	resolve func() (*server.Resolution, error)
+
+	mu         sync.Mutex
+	resolution *server.Resolution
+	resolvedAt time.Time
+}
+
+// track returns track with a freshly resolved URL. Tracks are matched by their permalink,
+// titles aren't unique within a collection.
+func (r *refresher) track(track server.ResolvedTrack) (server.ResolvedTrack, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.resolution == nil || time.Since(r.resolvedAt) > refreshReuse {
+		resolution, err := r.resolve()
+		if err != nil {
+			return track, err
+		}
+		r.resolution, r.resolvedAt = resolution, time.Now()
+	}
+
+	for _, t := range r.resolution.Tracks {
+		if t.Permalink == track.Permalink {
+			return t, nil
+		}
+	}
+
+	return track, fmt.Errorf("%s can't be downloaded anymore", track.Permalink)
+}
+
+// downloadAll downloads every track of a resolution, opts.concurrency at a time. Tracks are
+// resolved again with refresh before they are retried, their URLs may have expired.
+func downloadAll(resolution *server.Resolution, refresh *refresher, opts options, sum *summary) {
+	sem := make(chan struct{}, opts.concurrency)
+	wg := &sync.WaitGroup{}
+
+	for i, track := range resolution.Tracks {
+		path := filepath.Join(opts.dir, filepath.FromSlash(filename(opts.template, resolution, i, track)))
+
+		if opts.skipExisting {
+			if _, err := os.Stat(path); err == nil {
+				sum.add(func(s *summary) { s.existing++ })
+				continue
+			}
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(track server.ResolvedTrack, path string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			attempts := 0
+			err := withRetries(opts.retries, func() error {
+				if attempts++; attempts > 1 {
+					refreshed, err := refresh.track(track)
+					if err != nil {
+						return err
+					}
+					track = refreshed
+				}
+				return download(track, path)
+			})
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to download %s: %s\n", track.Title, err.Error())
+				sum.add(func(s *summary) { s.failed = append(s.failed, track.Permalink) })
+				return
+			}
+
+			fmt.Println(path)
+			sum.add(func(s *summary) { s.downloaded++ })
+		}(track, path)
+	}
+
+	wg.Wait()
+}
+
+// withRetries calls f until it succeeds or has been retried retries times
+func withRetries(retries int, f func() error) error {
+	backoff := retryBackoff
+	err := f()
+	for attempt := 0; err != nil && attempt < retries; attempt++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = f()
+	}
+
+	return err
+}
+
+// download saves a track to path. It is written to a temporary file first so that an
+// interrupted download isn't mistaken for an existing one.
+func download(track server.ResolvedTrack, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if track.HLS {
+		err = downloadHLS(track.URL, f)
+	} else {
+		err = downloadFile(track.URL, f)
+	}
+
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func get(u string) (io.ReadCloser, error) {
+	res, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		return nil, fmt.Errorf("%s returned status %d", strings.Split(u, "?")[0], res.StatusCode)
+	}
+
+	return res.Body, nil
+}
+
+func downloadFile(u string, w io.Writer) error {
+	body, err := get(u)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// downloadHLS concatenates the segments of an HLS playlist into w
+func downloadHLS(playlistURL string, w io.Writer) error {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return err
+	}
+
+	body, err := get(playlistURL)
+	if err != nil {
+		return err
+	}
+
+	segments := []string{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		segment, err := base.Parse(line)
+		if err != nil {
+			body.Close()
+			return err
+		}
+		segments = append(segments, segment.String())
+	}
+	body.Close()
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		if err := downloadFile(segment, w); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/zackradisic/downloadsound.cloud-api-go/server"
+)
+
+func TestDownloadAllResolvesExpiredURLsAgain(t *testing.T) {
+	retryBackoff = 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/expired.mp3" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("audio"))
+	}))
+	defer srv.Close()
+
+	track := server.ResolvedTrack{Title: "Title", Author: "Author", URL: srv.URL + "/expired.mp3", Format: "mp3_progressive", Permalink: "https://soundcloud.com/author/title"}
+	resolutions := 0
+	refresh := &refresher{resolve: func() (*server.Resolution, error) {
+		resolutions++
+		fresh := track
+		fresh.URL = srv.URL + "/fresh.mp3"
+		return &server.Resolution{Type: "track", Title: "Title", Tracks: []server.ResolvedTrack{fresh}}, nil
+	}}
+
+	dir := t.TempDir()
+	opts := options{dir: dir, template: defaultTemplate, concurrency: 1, retries: 2}
+	sum := &summary{}
+	downloadAll(&server.Resolution{Type: "track", Title: "Title", Tracks: []server.ResolvedTrack{track}}, refresh, opts, sum)
+
+	if sum.downloaded != 1 || len(sum.failed) != 0 {
+		t.Fatalf("downloaded %d, failed %v", sum.downloaded, sum.failed)
+	}
+	if resolutions != 1 {
+		t.Errorf("resolved %d times, want 1", resolutions)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "Author - Title.mp3"))
+	if err != nil || string(data) != "audio" {
+		t.Errorf("got %q, %v", data, err)
+	}
+}
+
+func TestRefresherMatchesPermalinks(t *testing.T) {
+	// Both tracks have the same title and author, only their permalinks tell them apart
+	tracks := []server.ResolvedTrack{
+		{Title: "Intro", Author: "Author", URL: "https://cf-media.sndcdn.com/1.mp3", Permalink: "https://soundcloud.com/author/intro"},
+		{Title: "Intro", Author: "Author", URL: "https://cf-media.sndcdn.com/2.mp3", Permalink: "https://soundcloud.com/author/intro-1"},
+	}
+	refresh := &refresher{resolve: func() (*server.Resolution, error) {
+		return &server.Resolution{Type: "playlist", Title: "Album", Tracks: tracks}, nil
+	}}
+
+	refreshed, err := refresh.track(server.ResolvedTrack{Title: "Intro", Author: "Author", Permalink: "https://soundcloud.com/author/intro-1"})
+	if err != nil || refreshed.URL != "https://cf-media.sndcdn.com/2.mp3" {
+		t.Errorf("got %+v, %v, want the second track", refreshed, err)
+	}
+
+	if _, err := refresh.track(server.ResolvedTrack{Title: "Intro", Author: "Author", Permalink: "https://soundcloud.com/author/removed"}); err == nil {
+		t.Error("a track missing from the collection was refreshed")
+	}
+}
+
+func TestDownloadAllListsPermalinksOfFailedTracks(t *testing.T) {
+	retryBackoff = 0
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	track := server.ResolvedTrack{Title: "Title", Author: "Author", URL: srv.URL + "/gone.mp3", Format: "mp3_progressive", Permalink: "https://soundcloud.com/author/title"}
+	refresh := &refresher{resolve: func() (*server.Resolution, error) {
+		return &server.Resolution{Type: "playlist", Title: "Album", Tracks: []server.ResolvedTrack{track}}, nil
+	}}
+
+	sum := &summary{}
+	opts := options{dir: t.TempDir(), template: defaultTemplate, concurrency: 1, retries: 1}
+	downloadAll(&server.Resolution{Type: "playlist", Title: "Album", Tracks: []server.ResolvedTrack{track}}, refresh, opts, sum)
+
+	if sum.downloaded != 0 || len(sum.failed) != 1 || sum.failed[0] != track.Permalink {
+		t.Errorf("downloaded %d, failed %v, want %s to fail", sum.downloaded, sum.failed, track.Permalink)
+	}
+}
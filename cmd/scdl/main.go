@@ -0,0 +1,160 @@
+// Command scdl downloads SoundCloud tracks, playlists and likes to a directory.
+//
+//	scdl [flags] URL...
+//
+// Links are resolved with the same code as the API server, or by a running instance of the
+// API when -remote is set.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/zackradisic/downloadsound.cloud-api-go/server"
+)
+
+// resolver resolves a link into the tracks to download
+type resolver interface {
+	Resolve(ctx context.Context, rawURL string, formats []string) (*server.Resolution, error)
+}
+
+type options struct {
+	dir          string
+	template     string
+	concurrency  int
+	retries      int
+	skipExisting bool
+	formats      []string
+}
+
+// summary counts what happened to every track
+type summary struct {
+	mu         sync.Mutex
+	downloaded int
+	existing   int
+	// failed are the links that couldn't be downloaded, those given on the command line or
+	// the permalinks of tracks
+	failed      []string
+	copyrighted []string
+	geoBlocked  []string
+}
+
+func (s *summary) add(f func(s *summary)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func main() {
+	opts := options{}
+	var formats, remote, clientID string
+	flag.StringVar(&opts.dir, "dir", ".", "directory to download to")
+	flag.StringVar(&opts.template, "template", defaultTemplate, "filename template, see -help-template")
+	flag.IntVar(&opts.concurrency, "concurrency", 4, "how many tracks to download at once")
+	flag.IntVar(&opts.retries, "retries", 3, "how many times to retry a failed download")
+	flag.BoolVar(&opts.skipExisting, "skip-existing", true, "skip tracks whose file already exists")
+	flag.StringVar(&formats, "formats", "mp3_progressive,progressive", "comma separated preferred formats")
+	flag.StringVar(&remote, "remote", "", "URL of an API instance to resolve links with, e.g. http://localhost:8080")
+	flag.StringVar(&clientID, "client-id", "", "SoundCloud client ID, fetched automatically if empty")
+	helpTemplate := flag.Bool("help-template", false, "show the filename template placeholders")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] URL...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if *helpTemplate {
+		fmt.Println(templateHelp)
+		return
+	}
+
+	if flag.NArg() == 0 || opts.concurrency < 1 || opts.retries < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := validateTemplate(opts.template); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+
+	for _, f := range strings.Split(formats, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			opts.formats = append(opts.formats, f)
+		}
+	}
+
+	var r resolver
+	if remote != "" {
+		r = newRemoteResolver(remote)
+	} else {
+		res, err := server.NewResolver(clientID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to set up SoundCloud client: "+err.Error())
+			os.Exit(1)
+		}
+		r = res
+	}
+
+	if err := os.MkdirAll(opts.dir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	sum := &summary{}
+	for _, u := range flag.Args() {
+		resolution, err := r.Resolve(context.Background(), u, opts.formats)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", u, err.Error())
+			sum.add(func(s *summary) { s.failed = append(s.failed, u) })
+			continue
+		}
+
+		fmt.Printf("%s: %d tracks\n", resolution.Title, len(resolution.Tracks))
+		for _, skipped := range resolution.Skipped {
+			if skipped.Reason == server.SkipReasonGeoBlocked {
+				sum.add(func(s *summary) { s.geoBlocked = append(s.geoBlocked, skipped.Title) })
+				continue
+			}
+			sum.add(func(s *summary) { s.copyrighted = append(s.copyrighted, skipped.Title) })
+		}
+		refresh := &refresher{resolve: func() (*server.Resolution, error) {
+			return r.Resolve(context.Background(), u, opts.formats)
+		}}
+		downloadAll(resolution, refresh, opts, sum)
+	}
+
+	sum.print()
+	if len(sum.failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+func (s *summary) print() {
+	fmt.Printf("\nDownloaded %d, already existed %d, failed %d, copyrighted %d, geo-blocked %d\n", s.downloaded, s.existing, len(s.failed), len(s.copyrighted), len(s.geoBlocked))
+
+	if len(s.copyrighted) > 0 {
+		fmt.Println("\nSkipped because of copyright:")
+		for _, title := range s.copyrighted {
+			fmt.Println("  " + title)
+		}
+	}
+
+	if len(s.geoBlocked) > 0 {
+		fmt.Println("\nSkipped because they are blocked in this region:")
+		for _, title := range s.geoBlocked {
+			fmt.Println("  " + title)
+		}
+	}
+
+	if len(s.failed) > 0 {
+		fmt.Println("\nFailed:")
+		for _, link := range s.failed {
+			fmt.Println("  " + link)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zackradisic/downloadsound.cloud-api-go/server"
+)
+
+// proxiedPathRegex matches the download routes of the API, which serve the whole file even
+// for HLS formats
+var proxiedPathRegex = regexp.MustCompile(`/download/(link/[^/]+|[0-9]+)$`)
+
+// proxied returns true if a track URL is one of the API's download links rather than a
+// SoundCloud one, e.g. a signed link
+func proxied(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && proxiedPathRegex.MatchString(u.Path)
+}
+
+// remoteResolver resolves links with the batch endpoint of a running instance of the API
+type remoteResolver struct {
+	baseURL string
+	client  *http.Client
+}
+
+func newRemoteResolver(baseURL string) *remoteResolver {
+	return &remoteResolver{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		client:  &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (r *remoteResolver) Resolve(ctx context.Context, rawURL string, formats []string) (*server.Resolution, error) {
+	type requestBody struct {
+		URLs         []string `json:"urls"`
+		Formats      []string `json:"formats"`
+		WaveformBars int      `json:"waveformBars"`
+	}
+
+	// result holds the fields of both a track and a v2 collection
+	type result struct {
+		Title     string          `json:"title"`
+		URL       string          `json:"url"`
+		Format    string          `json:"format"`
+		Permalink string          `json:"permalink"`
+		Author    json.RawMessage `json:"author"`
+		Tracks    []struct {
+			Title     string `json:"title"`
+			URL       string `json:"url"`
+			HLS       bool   `json:"hls"`
+			Author    string `json:"author"`
+			Format    string `json:"format"`
+			Permalink string `json:"permalink"`
+		} `json:"tracks"`
+		Skipped []server.SkippedTrack `json:"skipped"`
+	}
+
+	type responseBody struct {
+		Results []struct {
+			Type   string `json:"type"`
+			Result result `json:"result"`
+			Err    string `json:"err"`
+			Code   string `json:"code"`
+		} `json:"results"`
+		Err  string `json:"err"`
+		Code string `json:"code"`
+	}
+
+	payload, err := json.Marshal(&requestBody{URLs: []string{rawURL}, Formats: formats})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", r.baseURL+"/v2/batch", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body := &responseBody{}
+	if err := json.NewDecoder(res.Body).Decode(body); err != nil {
+		return nil, fmt.Errorf("unexpected response with status %d: %s", res.StatusCode, err.Error())
+	}
+
+	if body.Err != "" {
+		return nil, fmt.Errorf("%s: %s", body.Code, body.Err)
+	}
+
+	if len(body.Results) != 1 {
+		return nil, fmt.Errorf("expected 1 result, got %d", len(body.Results))
+	}
+
+	item := body.Results[0]
+	if item.Err != "" {
+		return nil, fmt.Errorf("%s: %s", item.Code, item.Err)
+	}
+
+	resolution := &server.Resolution{Type: item.Type, Title: item.Result.Title, Skipped: item.Result.Skipped}
+	if item.Type == "track" {
+		author := struct {
+			Username string `json:"username"`
+		}{}
+		json.Unmarshal(item.Result.Author, &author)
+
+		resolution.Tracks = []server.ResolvedTrack{{
+			Title:     item.Result.Title,
+			Author:    author.Username,
+			URL:       item.Result.URL,
+			HLS:       !strings.HasSuffix(item.Result.Format, "_progressive") && !proxied(item.Result.URL),
+			Format:    item.Result.Format,
+			Permalink: item.Result.Permalink,
+		}}
+		return resolution, nil
+	}
+
+	for _, track := range item.Result.Tracks {
+		resolution.Tracks = append(resolution.Tracks, server.ResolvedTrack{
+			Title:     track.Title,
+			Author:    track.Author,
+			URL:       track.URL,
+			HLS:       track.HLS && !proxied(track.URL),
+			Format:    track.Format,
+			Permalink: track.Permalink,
+		})
+	}
+
+	return resolution, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteResolverTreatsProxiedLinksAsProgressive(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		hls  bool
+	}{
+		{"signed track", `{"results":[{"type":"track","result":{"title":"a","url":"https://api.example.com/v1/download/link/abc.def","format":"opus_hls"}}]}`, false},
+		{"cdn track", `{"results":[{"type":"track","result":{"title":"a","url":"https://cf-hls-media.sndcdn.com/playlist/a.m3u8","format":"opus_hls"}}]}`, true},
+		{"signed collection track", `{"results":[{"type":"playlist","result":{"title":"p","tracks":[{"title":"a","url":"https://api.example.com/v2/download/link/abc.def","hls":true,"format":"opus_hls"}]}}]}`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(test.body))
+			}))
+			defer srv.Close()
+
+			resolution, err := newRemoteResolver(srv.URL).Resolve(context.Background(), "https://soundcloud.com/a/b", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(resolution.Tracks) != 1 || resolution.Tracks[0].HLS != test.hls {
+				t.Errorf("got %+v, want HLS %v", resolution.Tracks, test.hls)
+			}
+		})
+	}
+}
+
+func TestRemoteResolverKeepsPermalinks(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"track", `{"results":[{"type":"track","result":{"title":"a","url":"https://cf-media.sndcdn.com/a.mp3","format":"mp3_progressive","permalink":"https://soundcloud.com/a/b"}}]}`},
+		{"collection track", `{"results":[{"type":"playlist","result":{"title":"p","tracks":[{"title":"a","url":"https://cf-media.sndcdn.com/a.mp3","format":"mp3_progressive","permalink":"https://soundcloud.com/a/b"}]}}]}`},
+	}
+
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(test.body))
+		}))
+
+		resolution, err := newRemoteResolver(srv.URL).Resolve(context.Background(), "https://soundcloud.com/a/b", nil)
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resolution.Tracks) != 1 || resolution.Tracks[0].Permalink != "https://soundcloud.com/a/b" {
+			t.Errorf("%s: got %+v, want the permalink", test.name, resolution.Tracks)
+		}
+	}
+}
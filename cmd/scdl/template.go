@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/zackradisic/downloadsound.cloud-api-go/server"
+)
+
+const defaultTemplate = "{author} - {title}"
+
+const templateHelp = `Filename templates may contain these placeholders, the extension is added automatically:
+
+  {title}       title of the track
+  {author}      username of the track's author
+  {collection}  title of the playlist or likes the track belongs to
+  {index}       position of the track in the collection, starting at 1
+  {format}      format the track is downloaded in, e.g. mp3_progressive
+
+A template may contain "/" to download into subdirectories, e.g. "{collection}/{index} {title}".`
+
+var placeholderRegex = regexp.MustCompile(`\{([a-z]+)\}`)
+
+var placeholders = map[string]bool{"title": true, "author": true, "collection": true, "index": true, "format": true}
+
+// extensions maps the codec of a format onto the extension of its file
+var extensions = map[string]string{
+	"mp3":  ".mp3",
+	"opus": ".ogg",
+	"aac":  ".m4a",
+}
+
+func validateTemplate(template string) error {
+	for _, match := range placeholderRegex.FindAllStringSubmatch(template, -1) {
+		if !placeholders[match[1]] {
+			return fmt.Errorf("unknown placeholder %s in template, see -help-template", match[0])
+		}
+	}
+
+	return nil
+}
+
+// sanitize removes characters that can't be used in filenames
+func sanitize(name string) string {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return -1
+		}
+		return r
+	}, name))
+
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+
+	return name
+}
+
+// filename returns the path of a track relative to the download directory
+func filename(template string, resolution *server.Resolution, index int, track server.ResolvedTrack) string {
+	values := map[string]string{
+		"title":      track.Title,
+		"author":     track.Author,
+		"collection": resolution.Title,
+		"index":      fmt.Sprintf("%0*d", len(strconv.Itoa(len(resolution.Tracks))), index+1),
+		"format":     track.Format,
+	}
+
+	parts := strings.Split(template, "/")
+	for i, part := range parts {
+		parts[i] = sanitize(placeholderRegex.ReplaceAllStringFunc(part, func(p string) string {
+			return values[strings.Trim(p, "{}")]
+		}))
+	}
+
+	ext, ok := extensions[strings.Split(track.Format, "_")[0]]
+	if !ok {
+		ext = ".mp3"
+	}
+
+	return strings.Join(parts, "/") + ext
+}
@@ -1,9 +1,12 @@
 module github.com/zackradisic/downloadsound.cloud-api-go
 
-go 1.15
+go 1.16
 
 require (
 	github.com/gorilla/mux v1.8.0
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/zackradisic/soundcloud-api v0.1.6-0.20210205185947-79cc70bb1bb9
-	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	google.golang.org/grpc v1.40.0
+	google.golang.org/protobuf v1.27.1
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,241 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// DownloaderClient is the client API for Downloader service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DownloaderClient interface {
+	ResolveTrack(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (*Track, error)
+	ResolvePlaylist(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (*Collection, error)
+	ResolveLikes(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (*Collection, error)
+	// StreamCollection resolves a playlist or likes URL, sending every track as soon as it is
+	// resolved and finishing with the collection itself, without its tracks.
+	StreamCollection(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (Downloader_StreamCollectionClient, error)
+}
+
+type downloaderClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDownloaderClient(cc grpc.ClientConnInterface) DownloaderClient {
+	return &downloaderClient{cc}
+}
+
+func (c *downloaderClient) ResolveTrack(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (*Track, error) {
+	out := new(Track)
+	err := c.cc.Invoke(ctx, "/downloadsound.v1.Downloader/ResolveTrack", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *downloaderClient) ResolvePlaylist(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (*Collection, error) {
+	out := new(Collection)
+	err := c.cc.Invoke(ctx, "/downloadsound.v1.Downloader/ResolvePlaylist", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *downloaderClient) ResolveLikes(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (*Collection, error) {
+	out := new(Collection)
+	err := c.cc.Invoke(ctx, "/downloadsound.v1.Downloader/ResolveLikes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *downloaderClient) StreamCollection(ctx context.Context, in *ResolveRequest, opts ...grpc.CallOption) (Downloader_StreamCollectionClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Downloader_ServiceDesc.Streams[0], "/downloadsound.v1.Downloader/StreamCollection", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &downloaderStreamCollectionClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Downloader_StreamCollectionClient interface {
+	Recv() (*CollectionEvent, error)
+	grpc.ClientStream
+}
+
+type downloaderStreamCollectionClient struct {
+	grpc.ClientStream
+}
+
+func (x *downloaderStreamCollectionClient) Recv() (*CollectionEvent, error) {
+	m := new(CollectionEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DownloaderServer is the server API for Downloader service.
+// All implementations must embed UnimplementedDownloaderServer
+// for forward compatibility
+type DownloaderServer interface {
+	ResolveTrack(context.Context, *ResolveRequest) (*Track, error)
+	ResolvePlaylist(context.Context, *ResolveRequest) (*Collection, error)
+	ResolveLikes(context.Context, *ResolveRequest) (*Collection, error)
+	// StreamCollection resolves a playlist or likes URL, sending every track as soon as it is
+	// resolved and finishing with the collection itself, without its tracks.
+	StreamCollection(*ResolveRequest, Downloader_StreamCollectionServer) error
+	mustEmbedUnimplementedDownloaderServer()
+}
+
+// UnimplementedDownloaderServer must be embedded to have forward compatible implementations.
+type UnimplementedDownloaderServer struct {
+}
+
+func (UnimplementedDownloaderServer) ResolveTrack(context.Context, *ResolveRequest) (*Track, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResolveTrack not implemented")
+}
+func (UnimplementedDownloaderServer) ResolvePlaylist(context.Context, *ResolveRequest) (*Collection, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResolvePlaylist not implemented")
+}
+func (UnimplementedDownloaderServer) ResolveLikes(context.Context, *ResolveRequest) (*Collection, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ResolveLikes not implemented")
+}
+func (UnimplementedDownloaderServer) StreamCollection(*ResolveRequest, Downloader_StreamCollectionServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamCollection not implemented")
+}
+func (UnimplementedDownloaderServer) mustEmbedUnimplementedDownloaderServer() {}
+
+// UnsafeDownloaderServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DownloaderServer will
+// result in compilation errors.
+type UnsafeDownloaderServer interface {
+	mustEmbedUnimplementedDownloaderServer()
+}
+
+func RegisterDownloaderServer(s grpc.ServiceRegistrar, srv DownloaderServer) {
+	s.RegisterService(&Downloader_ServiceDesc, srv)
+}
+
+func _Downloader_ResolveTrack_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResolveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DownloaderServer).ResolveTrack(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/downloadsound.v1.Downloader/ResolveTrack",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DownloaderServer).ResolveTrack(ctx, req.(*ResolveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Downloader_ResolvePlaylist_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResolveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DownloaderServer).ResolvePlaylist(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/downloadsound.v1.Downloader/ResolvePlaylist",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DownloaderServer).ResolvePlaylist(ctx, req.(*ResolveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Downloader_ResolveLikes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ResolveRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DownloaderServer).ResolveLikes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/downloadsound.v1.Downloader/ResolveLikes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DownloaderServer).ResolveLikes(ctx, req.(*ResolveRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Downloader_StreamCollection_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ResolveRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DownloaderServer).StreamCollection(m, &downloaderStreamCollectionServer{stream})
+}
+
+type Downloader_StreamCollectionServer interface {
+	Send(*CollectionEvent) error
+	grpc.ServerStream
+}
+
+type downloaderStreamCollectionServer struct {
+	grpc.ServerStream
+}
+
+func (x *downloaderStreamCollectionServer) Send(m *CollectionEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Downloader_ServiceDesc is the grpc.ServiceDesc for Downloader service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Downloader_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "downloadsound.v1.Downloader",
+	HandlerType: (*DownloaderServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ResolveTrack",
+			Handler:    _Downloader_ResolveTrack_Handler,
+		},
+		{
+			MethodName: "ResolvePlaylist",
+			Handler:    _Downloader_ResolvePlaylist_Handler,
+		},
+		{
+			MethodName: "ResolveLikes",
+			Handler:    _Downloader_ResolveLikes_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamCollection",
+			Handler:       _Downloader_StreamCollection_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "downloader.proto",
+}
@@ -0,0 +1,4 @@
+// Package pb contains the gRPC service of the API, generated from downloader.proto
+package pb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative downloader.proto
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// reportFilterFromQuery reads a reportFilter from the query parameters of a request
+func reportFilterFromQuery(r *http.Request) (reportFilter, error) {
+	q := r.URL.Query()
+	filter := reportFilter{
+		DownloadType: q.Get("downloadType"),
+		URL:          q.Get("url"),
+	}
+
+	if reason := q.Get("reason"); reason != "" {
+		filter.Reason = normalizeReason(reason)
+	}
+
+	if status := q.Get("status"); status != "" {
+		resolved := status == "resolved"
+		if !resolved && status != "open" {
+			return filter, newAPIError(codeInvalidRequest).variant("report_status").withDetail("status")
+		}
+		filter.Resolved = &resolved
+	}
+
+	for param, dst := range map[string]*int{"limit": &filter.Limit, "offset": &filter.Offset} {
+		if value := q.Get(param); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return filter, newAPIError(codeInvalidRequest).variant("positive_number").with("param", param).withDetail(param)
+			}
+			*dst = n
+		}
+	}
+
+	return filter, nil
+}
+
+func (s *Server) handleListReports() apiHandler {
+	type responseBody struct {
+		Reports []report `json:"reports"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		filter, err := reportFilterFromQuery(r)
+		if err != nil {
+			return err
+		}
+
+		reports, err := s.reports.List(filter)
+		if err != nil {
+			return err
+		}
+
+		s.respondJSON(w, &responseBody{Reports: reports}, http.StatusOK)
+		return nil
+	}
+}
+
+func (s *Server) handleResolveReport() apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err != nil {
+			return newAPIError(codeInvalidRequest).variant("report_id")
+		}
+
+		rep, err := s.reports.Resolve(id)
+		if err == errReportNotFound {
+			return newAPIError(codeReportNotFound)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		s.respondJSON(w, &rep, http.StatusOK)
+		return nil
+	}
+}
+
+func (s *Server) handleExportReports() apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		filter, err := reportFilterFromQuery(r)
+		if err != nil {
+			return err
+		}
+
+		reports, err := s.reports.List(filter)
+		if err != nil {
+			return err
+		}
+
+		filename := "reports-" + time.Now().UTC().Format("2006-01-02")
+
+		switch r.URL.Query().Get("format") {
+		case "", "csv":
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, filename))
+
+			writer := csv.NewWriter(w)
+			writer.Write([]string{"id", "url", "downloadType", "reason", "comment", "count", "resolved", "createdAt", "updatedAt"})
+			for _, rep := range reports {
+				writer.Write([]string{
+					strconv.FormatInt(rep.ID, 10),
+					rep.URL,
+					rep.DownloadType,
+					rep.Reason,
+					rep.Comment,
+					strconv.Itoa(rep.Count),
+					strconv.FormatBool(rep.Resolved),
+					rep.CreatedAt.Format(time.RFC3339),
+					rep.UpdatedAt.Format(time.RFC3339),
+				})
+			}
+			writer.Flush()
+		case "json":
+			w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, filename))
+			s.respondJSON(w, reports, http.StatusOK)
+		default:
+			return newAPIError(codeInvalidRequest).variant("export_format").withDetail("format")
+		}
+
+		return nil
+	}
+}
+
+func (s *Server) handleWebhookDeliveries() apiHandler {
+	type responseBody struct {
+		Deliveries []webhookDelivery `json:"deliveries"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		s.respondJSON(w, &responseBody{Deliveries: s.webhooks.deliveries()}, http.StatusOK)
+		return nil
+	}
+}
+
+// handleTestWebhooks sends a ping event to every webhook and waits for the deliveries. The
+// ping is only tried once so that the response comes before the request times out.
+func (s *Server) handleTestWebhooks() apiHandler {
+	type responseBody struct {
+		Deliveries []webhookDelivery `json:"deliveries"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if urls, _ := s.webhooks.targets(); len(urls) == 0 {
+			return newAPIError(codeWebhooksNotConfigured)
+		}
+
+		deliveries := s.webhooks.send(r.Context(), eventPing, map[string]string{"message": "Test event"}, 1)
+		s.respondJSON(w, &responseBody{Deliveries: deliveries}, http.StatusOK)
+		return nil
+	}
+}
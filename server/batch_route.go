@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+const (
+	// maxBatchURLs is the most URLs that can be resolved in a single batch request
+	maxBatchURLs = 50
+	// batchWorkers is how many URLs of a batch are resolved concurrently
+	batchWorkers = 4
+)
+
+type batchResult struct {
+	URL    string      `json:"url"`
+	Type   string      `json:"type,omitempty"`
+	Status int         `json:"status"`
+	Result interface{} `json:"result,omitempty"`
+	Err    string      `json:"err,omitempty"`
+	Code   errorCode   `json:"code,omitempty"`
+}
+
+func (s *Server) handleBatch() apiHandler {
+	type requestBody struct {
+		URLs         []string `json:"urls"`
+		Formats      []string `json:"formats"`
+		WaveformBars *int     `json:"waveformBars"`
+		Lang         string   `json:"lang"`
+	}
+
+	type responseBody struct {
+		Results []batchResult `json:"results"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		body := &requestBody{}
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil || len(body.URLs) == 0 {
+			return newAPIError(codeInvalidRequest)
+		}
+
+		lang := language(r, body.Lang)
+		if len(body.URLs) > maxBatchURLs {
+			return inLanguage(newAPIError(codeBatchTooLarge).with("max", maxBatchURLs), lang)
+		}
+
+		// Repeated URLs are only resolved (and charged) once
+		unique := []string{}
+		indexes := map[string][]int{}
+		for i, u := range body.URLs {
+			key := canonicalURL(u)
+			if _, ok := indexes[key]; !ok {
+				unique = append(unique, u)
+			}
+			indexes[key] = append(indexes[key], i)
+		}
+
+		if err := s.chargeRequest(w, r, len(unique)); err != nil {
+			return inLanguage(err, lang)
+		}
+
+		// Batches don't sync, they are resolved like a body of a single URL without a manifest
+		request := &urlRequestBody{Formats: body.Formats, WaveformBars: body.WaveformBars, Lang: lang}
+		opts := request.options(requestVersion(r))
+		resolved := make([]batchResult, len(unique))
+		sem := make(chan struct{}, batchWorkers)
+		wg := &sync.WaitGroup{}
+		for i, u := range unique {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, u string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				resolved[i] = s.resolveBatchURL(r, u, opts)
+			}(i, u)
+		}
+		wg.Wait()
+
+		results := make([]batchResult, len(body.URLs))
+		for _, res := range resolved {
+			for _, i := range indexes[canonicalURL(res.URL)] {
+				results[i] = res
+				results[i].URL = body.URLs[i]
+			}
+		}
+
+		s.respondJSON(w, &responseBody{Results: results}, http.StatusOK)
+		return nil
+	}
+}
+
+// resolveBatchURL resolves a single URL of a batch
+func (s *Server) resolveBatchURL(r *http.Request, rawURL string, opts resolveOptions) batchResult {
+	res := batchResult{URL: rawURL}
+
+	link, result, err := s.resolveLink(r.Context(), rawURL, opts)
+	if err == nil {
+		res.Type = link.String()
+		switch result := result.(type) {
+		case *trackResponse:
+			res.Result = result.forVersion(requestVersion(r))
+		case *collectionResponse:
+			res.Result = result.forVersion(requestVersion(r))
+		}
+	}
+
+	if err != nil {
+		apiErr := tokenError(r.Context(), toAPIError(err))
+		if apiErr.Err != nil {
+			fmt.Println(apiErr.Error())
+		}
+
+		res.Result = nil
+		res.Err, res.Code, res.Status = apiErr.Message(opts.lang), apiErr.Code, apiErr.Status()
+		return res
+	}
+
+	res.Status = http.StatusOK
+	return res
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveBatch serves a batch of urls and returns the status and results
+func serveBatch(t *testing.T, handler http.Handler, urls ...string) (int, []batchResult) {
+	t.Helper()
+
+	body, err := json.Marshal(map[string][]string{"urls": urls})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/v2/batch", strings.NewReader(string(body))))
+
+	res := struct {
+		Results []batchResult `json:"results"`
+	}{}
+	if w.Code == http.StatusOK {
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return w.Code, res.Results
+}
+
+func TestBatchResolvesRepeatedURLsOnce(t *testing.T) {
+	s, upstream := newSoundCloudStandIn(t, nil)
+
+	urls := []string{
+		standInTrackURL,
+		standInPlaylistURL,
+		"https://www.soundcloud.com/artist/one/",
+		standInMissingURL,
+		"https://m.soundcloud.com/artist/one",
+	}
+	code, results := serveBatch(t, s.handler(), urls...)
+	if code != http.StatusOK {
+		t.Fatalf("got %d, want 200", code)
+	}
+
+	// Every URL gets a result in the order it was sent, under the URL it was sent as
+	if len(results) != len(urls) {
+		t.Fatalf("got %d results, want %d", len(results), len(urls))
+	}
+	types := []string{"track", "playlist", "track", "", "track"}
+	for i, res := range results {
+		if res.URL != urls[i] || res.Type != types[i] {
+			t.Errorf("result %d = %s %q, want %s %q", i, res.URL, res.Type, urls[i], types[i])
+		}
+	}
+	if results[3].Code != codeTrackNotFound {
+		t.Errorf("result of the missing track = %+v, want %s", results[3], codeTrackNotFound)
+	}
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+	resolved := map[string]int{}
+	for _, req := range upstream.requests {
+		if req.URL.Host+req.URL.Path == "api-v2.soundcloud.com/resolve" {
+			resolved[canonicalURL(req.URL.Query().Get("url"))]++
+		}
+	}
+	if resolved[standInTrackURL] != 1 || len(resolved) != 3 {
+		t.Errorf("resolved %v, want every distinct URL once", resolved)
+	}
+}
+
+func TestBatchChargesDistinctURLs(t *testing.T) {
+	s, _ := newSoundCloudStandIn(t, func(cfg *Config) {
+		cfg.RateLimitPerMinute = 1
+		cfg.RateLimitBurst = 2
+	})
+	handler := s.handler()
+
+	// A batch costs more than the whole burst only if its distinct URLs do
+	if code, _ := serveBatch(t, handler, standInTrackURL, standInPlaylistURL, standInMissingURL); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("batch of 3 distinct URLs got %d, want 413", code)
+	}
+
+	if code, _ := serveBatch(t, handler, standInTrackURL, standInTrackURL+"/", standInPlaylistURL, standInPlaylistURL); code != http.StatusOK {
+		t.Errorf("batch of 2 distinct URLs got %d, want 200", code)
+	}
+
+	// The batch used up both tokens
+	if code, _ := serveBatch(t, handler, standInTrackURL); code != http.StatusTooManyRequests {
+		t.Errorf("batch after the burst got %d, want 429", code)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+// clientIDRefreshInterval is the least time between attempts to fetch a new client ID
+const clientIDRefreshInterval = time.Minute
+
+// refreshClientID fetches a new client ID after SoundCloud rejected the current one
+func (s *Server) refreshClientID() {
+	s.clientIDMu.Lock()
+	defer s.clientIDMu.Unlock()
+
+	if time.Since(s.clientIDRefreshedAt) < clientIDRefreshInterval {
+		return
+	}
+	s.clientIDRefreshedAt = time.Now()
+
+	clientID, err := soundcloudapi.FetchClientID()
+	if err != nil {
+		fmt.Println(Entry{
+			Severity:  "ERROR",
+			Message:   "Failed to refresh client ID: " + err.Error(),
+			Component: "clientid",
+		})
+		s.webhooks.dispatch(eventClientIDRefreshFailed, map[string]string{"err": err.Error()})
+		return
+	}
+
+	s.scdl.SetClientID(clientID)
+}
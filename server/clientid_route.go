@@ -7,7 +7,7 @@ import (
 
 func (s *Server) handleClientID() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", s.frontendURL)
+		w.Header().Set("Access-Control-Allow-Origin", s.cfg().FrontendURL)
 
 		_, err := w.Write([]byte(s.scdl.ClientID()))
 		if err != nil {
@@ -0,0 +1,642 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+	"gopkg.in/yaml.v2"
+)
+
+// Config configures the server. LoadConfig reads it from, in increasing order of precedence,
+// the defaults, a YAML or JSON file, environment variables and command line flags.
+//
+// Settings tagged reload:"restart" only take effect on restart, the others are applied
+// when the config is reloaded (see WatchConfig).
+type Config struct {
+	// FrontendURL is the origin allowed to make cross-origin requests, it is required
+	FrontendURL string `yaml:"frontendURL" json:"frontendURL"`
+	// Addr is the address of the HTTP server
+	Addr string `yaml:"addr" json:"addr" reload:"restart"`
+	// GRPCAddr is the address of the gRPC server, it is disabled if empty
+	GRPCAddr string `yaml:"grpcAddr" json:"grpcAddr" reload:"restart"`
+
+	// ClientID is the SoundCloud client ID, one is fetched from SoundCloud if empty
+	ClientID string `yaml:"clientID" json:"clientID" reload:"restart"`
+	// UpstreamTimeout limits every request made to the SoundCloud API with its retries, from
+	// the moment the outbound limiter lets it through
+	UpstreamTimeout Duration `yaml:"upstreamTimeout" json:"upstreamTimeout"`
+	// MediaHeaderTimeout limits the wait for the response headers of proxied media
+	MediaHeaderTimeout Duration `yaml:"mediaHeaderTimeout" json:"mediaHeaderTimeout" reload:"restart"`
+	// UpstreamAttemptTimeout limits the wait for the response headers of a single attempt of
+	// a request to SoundCloud, timed out attempts are retried
+	UpstreamAttemptTimeout Duration `yaml:"upstreamAttemptTimeout" json:"upstreamAttemptTimeout"`
+	// UpstreamRetries is how many times a failed idempotent request to SoundCloud is retried
+	UpstreamRetries int `yaml:"upstreamRetries" json:"upstreamRetries"`
+	// UpstreamBreakerThreshold is how many consecutive failures open the circuit breaker of a host
+	UpstreamBreakerThreshold int `yaml:"upstreamBreakerThreshold" json:"upstreamBreakerThreshold"`
+	// UpstreamBreakerCooldown is how long an open circuit breaker fails requests before trying again
+	UpstreamBreakerCooldown Duration `yaml:"upstreamBreakerCooldown" json:"upstreamBreakerCooldown"`
+	// UpstreamRequestsPerSecond paces the requests made to SoundCloud by the whole server, 0
+	// disables pacing
+	UpstreamRequestsPerSecond int `yaml:"upstreamRequestsPerSecond" json:"upstreamRequestsPerSecond"`
+	// UpstreamBurst is how many requests can be made to SoundCloud at once before pacing starts
+	UpstreamBurst int `yaml:"upstreamBurst" json:"upstreamBurst"`
+	// Proxies are the HTTP(S) or SOCKS5 proxies upstream requests are spread over, requests
+	// are made directly if there are none
+	Proxies []string `yaml:"proxies" json:"proxies" reload:"restart"`
+	// ProxySelection is how the proxy of a request is picked, "round-robin" or "least-errors"
+	ProxySelection string `yaml:"proxySelection" json:"proxySelection"`
+	// ProxyEvictAfter is how many 403 or 429 responses in a row evict a proxy
+	ProxyEvictAfter int `yaml:"proxyEvictAfter" json:"proxyEvictAfter"`
+	// ProxyEvictFor is how long an evicted proxy isn't used
+	ProxyEvictFor Duration `yaml:"proxyEvictFor" json:"proxyEvictFor"`
+	// RegionalProxy is an HTTP(S) or SOCKS5 proxy in another region that geo-blocked tracks
+	// are resolved through, geo-blocked tracks are skipped if it is empty
+	RegionalProxy string `yaml:"regionalProxy" json:"regionalProxy" reload:"restart"`
+	// RequestTimeout limits every request except downloads, exports, collections and batches.
+	// Every track of a collection takes an upstream request, at UpstreamRequestsPerSecond a
+	// playlist of 200 tracks alone takes 10s, so they aren't limited.
+	RequestTimeout Duration `yaml:"requestTimeout" json:"requestTimeout" reload:"restart"`
+	// LikesBulkThreshold is how many likes a user can have before they are paginated
+	LikesBulkThreshold int `yaml:"likesBulkThreshold" json:"likesBulkThreshold"`
+	// LikesPageSize is how many likes are fetched per page when paginating
+	LikesPageSize int `yaml:"likesPageSize" json:"likesPageSize"`
+	// PlaylistCacheTTL is how long the metadata of a playlist is reused, 0 disables caching
+	PlaylistCacheTTL Duration `yaml:"playlistCacheTTL" json:"playlistCacheTTL"`
+
+	// PrewarmURLs are playlists whose metadata is fetched into the cache ahead of time.
+	// Chart pages such as https://soundcloud.com/charts/top aren't playlists, charts are
+	// prewarmed through their system playlists, e.g.
+	// https://soundcloud.com/discover/sets/charts-top:all-music
+	PrewarmURLs []string `yaml:"prewarmURLs" json:"prewarmURLs"`
+	// PrewarmTopRequested is how many of the most requested playlists are prewarmed too
+	PrewarmTopRequested int `yaml:"prewarmTopRequested" json:"prewarmTopRequested"`
+	// PrewarmInterval is how often the cache is prewarmed, 0 disables it
+	PrewarmInterval Duration `yaml:"prewarmInterval" json:"prewarmInterval"`
+
+	// RateLimitPerMinute is how many resources a single client may resolve per minute
+	RateLimitPerMinute int `yaml:"rateLimitPerMinute" json:"rateLimitPerMinute"`
+	// RateLimitBurst is how many resources a single client may resolve at once
+	RateLimitBurst int `yaml:"rateLimitBurst" json:"rateLimitBurst"`
+	// TrustedProxies are the IPs or CIDR ranges of the reverse proxies in front of the server.
+	// X-Forwarded-For is only honoured for requests from them, clients could pick their own
+	// IP otherwise.
+	TrustedProxies []string `yaml:"trustedProxies" json:"trustedProxies"`
+
+	// ReportStore is where reports are kept, "sqlite" or "memory"
+	ReportStore string `yaml:"reportStore" json:"reportStore" reload:"restart"`
+	// ReportDB is the path of the SQLite report database
+	ReportDB string `yaml:"reportDB" json:"reportDB" reload:"restart"`
+	// ReportWebhookThreshold is how many times a URL has to be reported to notify webhooks
+	ReportWebhookThreshold int `yaml:"reportWebhookThreshold" json:"reportWebhookThreshold"`
+	// WebhookURLs are notified of events
+	WebhookURLs []string `yaml:"webhookURLs" json:"webhookURLs"`
+	// WebhookSecret signs webhook payloads
+	WebhookSecret string `yaml:"webhookSecret" json:"webhookSecret"`
+	// AdminToken authenticates the admin routes, which are disabled if it is empty
+	AdminToken string `yaml:"adminToken" json:"adminToken"`
+
+	// DownloadLinkSecret signs the download links issued instead of SoundCloud's, which are
+	// returned as is if it is empty
+	DownloadLinkSecret string `yaml:"downloadLinkSecret" json:"downloadLinkSecret"`
+	// PublicURL is the URL clients reach the API at, e.g. https://api.example.com. Download
+	// links point at it, so it is required along with DownloadLinkSecret.
+	PublicURL string `yaml:"publicURL" json:"publicURL"`
+	// DownloadLinkTTL is how long a download link is valid for
+	DownloadLinkTTL Duration `yaml:"downloadLinkTTL" json:"downloadLinkTTL"`
+	// DownloadLinkGrace is how long after expiring a download link is still served if its
+	// track can be resolved again, 0 rejects expired links
+	DownloadLinkGrace Duration `yaml:"downloadLinkGrace" json:"downloadLinkGrace"`
+	// DownloadLinkBindIP only lets the client a download link was issued to use it
+	DownloadLinkBindIP bool `yaml:"downloadLinkBindIP" json:"downloadLinkBindIP"`
+
+	// LegacyRoutesSunset is when the unprefixed routes will be removed, as YYYY-MM-DD
+	LegacyRoutesSunset string `yaml:"legacyRoutesSunset" json:"legacyRoutesSunset" reload:"restart"`
+
+	// Features turns optional parts of the API on and off
+	Features Features `yaml:"features" json:"features"`
+
+	// ReloadInterval is how often the config file is checked for changes, 0 only reloads
+	// on SIGHUP
+	ReloadInterval Duration `yaml:"reloadInterval" json:"reloadInterval"`
+	// ShutdownTimeout is how long requests in flight are waited for when shutting down
+	ShutdownTimeout Duration `yaml:"shutdownTimeout" json:"shutdownTimeout"`
+	// DumpConfig prints the effective config (with secrets redacted) at startup
+	DumpConfig bool `yaml:"dumpConfig" json:"dumpConfig"`
+
+	// args are the command line flags the config was loaded with, to reload it with the same
+	args []string
+	// file is the path of the config file, if any
+	file string
+	// trustedProxies are the parsed TrustedProxies, see withParsed
+	trustedProxies []*net.IPNet
+}
+
+// Features are the optional parts of the API. Disabled routes respond with FEATURE_DISABLED.
+type Features struct {
+	// Batch enables the batch route
+	Batch bool `yaml:"batch" json:"batch"`
+	// Export enables the export route
+	Export bool `yaml:"export" json:"export"`
+	// Reports enables reporting broken links
+	Reports bool `yaml:"reports" json:"reports"`
+	// Sync enables incremental sync of v2 collections with manifests, see syncManifest
+	Sync bool `yaml:"sync" json:"sync"`
+}
+
+func batchEnabled(f Features) bool   { return f.Batch }
+func exportEnabled(f Features) bool  { return f.Export }
+func reportsEnabled(f Features) bool { return f.Reports }
+
+// Duration is a time.Duration written like "15s" in config files
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) set(value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	return d.set(value)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+
+	return d.set(value)
+}
+
+// DefaultConfig returns the config used for everything that isn't configured
+func DefaultConfig() Config {
+	return Config{
+		Addr:                      ":8080",
+		UpstreamTimeout:           Duration{15 * time.Second},
+		MediaHeaderTimeout:        Duration{15 * time.Second},
+		UpstreamAttemptTimeout:    Duration{5 * time.Second},
+		UpstreamRetries:           2,
+		UpstreamBreakerThreshold:  5,
+		UpstreamBreakerCooldown:   Duration{30 * time.Second},
+		UpstreamRequestsPerSecond: 20,
+		UpstreamBurst:             40,
+		ProxySelection:            proxyRoundRobin,
+		ProxyEvictAfter:           3,
+		ProxyEvictFor:             Duration{5 * time.Minute},
+		RequestTimeout:            Duration{20 * time.Second},
+		LikesBulkThreshold:        200,
+		LikesPageSize:             1000,
+		PlaylistCacheTTL:          Duration{20 * time.Minute},
+		PrewarmTopRequested:       10,
+		PrewarmInterval:           Duration{15 * time.Minute},
+		RateLimitPerMinute:        60,
+		RateLimitBurst:            60,
+		ReportStore:               "sqlite",
+		ReportDB:                  "reports.db",
+		ReportWebhookThreshold:    10,
+		Features:                  Features{Batch: true, Export: true, Reports: true, Sync: true},
+		ReloadInterval:            Duration{10 * time.Second},
+		DownloadLinkTTL:           Duration{time.Hour},
+		DownloadLinkGrace:         Duration{24 * time.Hour},
+		ShutdownTimeout:           Duration{15 * time.Second},
+	}
+}
+
+// configVar is a setting that can be set from the environment and the command line
+type configVar struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+	// isBool allows the flag to be given without a value
+	isBool bool
+}
+
+func stringVar(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func intVar(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+
+		*field(c) = n
+		return nil
+	}
+}
+
+func boolVar(field func(c *Config) *bool) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+
+		*field(c) = b
+		return nil
+	}
+}
+
+func durationVar(field func(c *Config) *Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		if err := field(c).set(value); err != nil {
+			return errors.New("must be a duration such as 15s")
+		}
+		return nil
+	}
+}
+
+// listVar sets a list from comma separated values
+func listVar(field func(c *Config) *[]string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		list := []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+
+		*field(c) = list
+		return nil
+	}
+}
+
+var configVars = []configVar{
+	{"frontend-url", "FRONTEND_URL", "origin allowed to make cross-origin requests", stringVar(func(c *Config) *string { return &c.FrontendURL }), false},
+	{"addr", "ADDR", "address of the HTTP server", stringVar(func(c *Config) *string { return &c.Addr }), false},
+	{"grpc-addr", "GRPC_ADDR", "address of the gRPC server, empty disables it", stringVar(func(c *Config) *string { return &c.GRPCAddr }), false},
+	{"client-id", "SOUNDCLOUD_CLIENT_ID", "SoundCloud client ID, fetched if empty", stringVar(func(c *Config) *string { return &c.ClientID }), false},
+	{"upstream-timeout", "UPSTREAM_TIMEOUT", "time limit of requests to SoundCloud", durationVar(func(c *Config) *Duration { return &c.UpstreamTimeout }), false},
+	{"media-header-timeout", "MEDIA_HEADER_TIMEOUT", "time limit for the headers of proxied media", durationVar(func(c *Config) *Duration { return &c.MediaHeaderTimeout }), false},
+	{"upstream-attempt-timeout", "UPSTREAM_ATTEMPT_TIMEOUT", "time limit for the headers of a single attempt of a request to SoundCloud", durationVar(func(c *Config) *Duration { return &c.UpstreamAttemptTimeout }), false},
+	{"upstream-retries", "UPSTREAM_RETRIES", "retries of failed idempotent requests to SoundCloud", intVar(func(c *Config) *int { return &c.UpstreamRetries }), false},
+	{"upstream-breaker-threshold", "UPSTREAM_BREAKER_THRESHOLD", "consecutive failures that open the circuit breaker of a host", intVar(func(c *Config) *int { return &c.UpstreamBreakerThreshold }), false},
+	{"upstream-breaker-cooldown", "UPSTREAM_BREAKER_COOLDOWN", "how long an open circuit breaker fails requests", durationVar(func(c *Config) *Duration { return &c.UpstreamBreakerCooldown }), false},
+	{"upstream-requests-per-second", "UPSTREAM_REQUESTS_PER_SECOND", "requests per second made to SoundCloud, 0 disables pacing", intVar(func(c *Config) *int { return &c.UpstreamRequestsPerSecond }), false},
+	{"upstream-burst", "UPSTREAM_BURST", "requests made to SoundCloud at once before pacing starts", intVar(func(c *Config) *int { return &c.UpstreamBurst }), false},
+	{"proxies", "PROXIES", "comma separated http(s):// or socks5:// proxies for upstream requests", listVar(func(c *Config) *[]string { return &c.Proxies }), false},
+	{"regional-proxy", "REGIONAL_PROXY", "http(s):// or socks5:// proxy geo-blocked tracks are resolved through", stringVar(func(c *Config) *string { return &c.RegionalProxy }), false},
+	{"proxy-selection", "PROXY_SELECTION", "how proxies are picked, round-robin or least-errors", stringVar(func(c *Config) *string { return &c.ProxySelection }), false},
+	{"proxy-evict-after", "PROXY_EVICT_AFTER", "403 or 429 responses in a row that evict a proxy", intVar(func(c *Config) *int { return &c.ProxyEvictAfter }), false},
+	{"proxy-evict-for", "PROXY_EVICT_FOR", "how long an evicted proxy isn't used", durationVar(func(c *Config) *Duration { return &c.ProxyEvictFor }), false},
+	{"request-timeout", "REQUEST_TIMEOUT", "time limit of requests except downloads, exports, collections and batches", durationVar(func(c *Config) *Duration { return &c.RequestTimeout }), false},
+	{"likes-bulk-threshold", "LIKES_BULK_THRESHOLD", "likes a user can have before they are paginated", intVar(func(c *Config) *int { return &c.LikesBulkThreshold }), false},
+	{"likes-page-size", "LIKES_PAGE_SIZE", "likes fetched per page when paginating", intVar(func(c *Config) *int { return &c.LikesPageSize }), false},
+	{"playlist-cache-ttl", "PLAYLIST_CACHE_TTL", "how long playlist metadata is reused, 0 disables caching", durationVar(func(c *Config) *Duration { return &c.PlaylistCacheTTL }), false},
+	{"prewarm-urls", "PREWARM_URLS", "comma separated playlists, such as the system playlists of charts, to prewarm the cache with", listVar(func(c *Config) *[]string { return &c.PrewarmURLs }), false},
+	{"prewarm-top-requested", "PREWARM_TOP_REQUESTED", "how many of the most requested playlists to prewarm", intVar(func(c *Config) *int { return &c.PrewarmTopRequested }), false},
+	{"prewarm-interval", "PREWARM_INTERVAL", "how often the cache is prewarmed, 0 disables it", durationVar(func(c *Config) *Duration { return &c.PrewarmInterval }), false},
+	{"rate-limit-per-minute", "RATE_LIMIT_PER_MINUTE", "resources a client may resolve per minute", intVar(func(c *Config) *int { return &c.RateLimitPerMinute }), false},
+	{"rate-limit-burst", "RATE_LIMIT_BURST", "resources a client may resolve at once", intVar(func(c *Config) *int { return &c.RateLimitBurst }), false},
+	{"trusted-proxies", "TRUSTED_PROXIES", "comma separated IPs or CIDR ranges of reverse proxies whose X-Forwarded-For is honoured", listVar(func(c *Config) *[]string { return &c.TrustedProxies }), false},
+	{"report-store", "REPORT_STORE", "where reports are kept, sqlite or memory", stringVar(func(c *Config) *string { return &c.ReportStore }), false},
+	{"report-db", "REPORT_DB", "path of the SQLite report database", stringVar(func(c *Config) *string { return &c.ReportDB }), false},
+	{"report-webhook-threshold", "REPORT_WEBHOOK_THRESHOLD", "reports of a URL that notify webhooks", intVar(func(c *Config) *int { return &c.ReportWebhookThreshold }), false},
+	{"webhook-urls", "WEBHOOK_URLS", "comma separated webhook URLs", listVar(func(c *Config) *[]string { return &c.WebhookURLs }), false},
+	{"webhook-secret", "WEBHOOK_SECRET", "secret that signs webhook payloads", stringVar(func(c *Config) *string { return &c.WebhookSecret }), false},
+	{"admin-token", "ADMIN_TOKEN", "token of the admin routes", stringVar(func(c *Config) *string { return &c.AdminToken }), false},
+	{"download-link-secret", "DOWNLOAD_LINK_SECRET", "secret that signs download links, SoundCloud's are returned if empty", stringVar(func(c *Config) *string { return &c.DownloadLinkSecret }), false},
+	{"public-url", "PUBLIC_URL", "URL clients reach the API at, which download links point at", stringVar(func(c *Config) *string { return &c.PublicURL }), false},
+	{"download-link-ttl", "DOWNLOAD_LINK_TTL", "how long download links are valid for", durationVar(func(c *Config) *Duration { return &c.DownloadLinkTTL }), false},
+	{"download-link-grace", "DOWNLOAD_LINK_GRACE", "how long expired download links are still served, 0 rejects them", durationVar(func(c *Config) *Duration { return &c.DownloadLinkGrace }), false},
+	{"download-link-bind-ip", "DOWNLOAD_LINK_BIND_IP", "only let the client a download link was issued to use it", boolVar(func(c *Config) *bool { return &c.DownloadLinkBindIP }), true},
+	{"legacy-routes-sunset", "LEGACY_ROUTES_SUNSET", "removal date of the unprefixed routes, YYYY-MM-DD", stringVar(func(c *Config) *string { return &c.LegacyRoutesSunset }), false},
+	{"feature-batch", "FEATURE_BATCH", "enable the batch route", boolVar(func(c *Config) *bool { return &c.Features.Batch }), true},
+	{"feature-export", "FEATURE_EXPORT", "enable the export route", boolVar(func(c *Config) *bool { return &c.Features.Export }), true},
+	{"feature-reports", "FEATURE_REPORTS", "enable reporting broken links", boolVar(func(c *Config) *bool { return &c.Features.Reports }), true},
+	{"feature-sync", "FEATURE_SYNC", "enable incremental sync of v2 collections", boolVar(func(c *Config) *bool { return &c.Features.Sync }), true},
+	{"reload-interval", "CONFIG_RELOAD_INTERVAL", "how often the config file is checked for changes, 0 disables it", durationVar(func(c *Config) *Duration { return &c.ReloadInterval }), false},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "how long requests in flight are waited for when shutting down", durationVar(func(c *Config) *Duration { return &c.ShutdownTimeout }), false},
+	{"dump-config", "DUMP_CONFIG", "print the effective config at startup", boolVar(func(c *Config) *bool { return &c.DumpConfig }), true},
+}
+
+// configFlag records the value of a flag so it can be applied after the file and environment
+type configFlag struct {
+	name   string
+	flags  map[string]string
+	isBool bool
+}
+
+func (f *configFlag) String() string { return "" }
+
+func (f *configFlag) Set(value string) error {
+	f.flags[f.name] = value
+	return nil
+}
+
+// IsBoolFlag allows boolean settings to be given as -name instead of -name=true
+func (f *configFlag) IsBoolFlag() bool { return f.isBool }
+
+// LoadConfig loads the config from the file given with -config (or CONFIG_FILE), the
+// environment and the command line flags in args, and validates it
+func LoadConfig(args []string) (Config, error) {
+	c := DefaultConfig()
+	c.args = args
+
+	fs := flag.NewFlagSet("downloadsound", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv("CONFIG_FILE"), "path of a YAML or JSON config file")
+	flags := map[string]string{}
+	for _, v := range configVars {
+		fs.Var(&configFlag{name: v.flag, flags: flags, isBool: v.isBool}, v.flag, v.usage+" ($"+v.env+")")
+	}
+	if err := fs.Parse(args); err != nil {
+		return c, err
+	}
+
+	if *path != "" {
+		c.file = *path
+		if err := c.loadFile(*path); err != nil {
+			return c, err
+		}
+	}
+
+	for _, v := range configVars {
+		if value, ok := os.LookupEnv(v.env); ok && value != "" {
+			if err := v.set(&c, value); err != nil {
+				return c, fmt.Errorf("invalid config: %s %s", v.env, err.Error())
+			}
+		}
+	}
+
+	for _, v := range configVars {
+		if value, ok := flags[v.flag]; ok {
+			if err := v.set(&c, value); err != nil {
+				return c, fmt.Errorf("invalid config: -%s %s", v.flag, err.Error())
+			}
+		}
+	}
+
+	return c, c.Validate()
+}
+
+// loadFile overrides the config with a YAML or JSON file, depending on its extension
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("invalid config: %s", err.Error())
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(c)
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	default:
+		return fmt.Errorf("invalid config: %s must be a .yaml, .yml or .json file", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid config: %s: %s", path, err.Error())
+	}
+
+	return nil
+}
+
+// withParsed returns c along with the parsed form of the settings requests use parsed, such
+// as the trusted proxies, so that they are parsed once per load rather than per request. c
+// must be valid.
+func (c Config) withParsed() Config {
+	c.trustedProxies, _ = parseTrustedProxies(c.TrustedProxies)
+	return c
+}
+
+// Validate returns an error listing every invalid setting
+func (c Config) Validate() error {
+	problems := []string{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if c.FrontendURL == "" {
+		problem("frontendURL is required")
+	} else if u, err := url.Parse(c.FrontendURL); err != nil || u.Scheme == "" || u.Host == "" {
+		problem("frontendURL must be an origin such as https://downloadsound.cloud")
+	}
+
+	if c.Addr == "" {
+		problem("addr is required")
+	}
+
+	for name, d := range map[string]Duration{
+		"upstreamTimeout":         c.UpstreamTimeout,
+		"mediaHeaderTimeout":      c.MediaHeaderTimeout,
+		"upstreamAttemptTimeout":  c.UpstreamAttemptTimeout,
+		"upstreamBreakerCooldown": c.UpstreamBreakerCooldown,
+		"proxyEvictFor":           c.ProxyEvictFor,
+		"requestTimeout":          c.RequestTimeout,
+		"shutdownTimeout":         c.ShutdownTimeout,
+		"downloadLinkTTL":         c.DownloadLinkTTL,
+	} {
+		if d.Duration <= 0 {
+			problem("%s must be positive", name)
+		}
+	}
+
+	for name, n := range map[string]int{
+		"upstreamBreakerThreshold": c.UpstreamBreakerThreshold,
+		"upstreamBurst":            c.UpstreamBurst,
+		"proxyEvictAfter":          c.ProxyEvictAfter,
+		"likesBulkThreshold":       c.LikesBulkThreshold,
+		"likesPageSize":            c.LikesPageSize,
+		"rateLimitPerMinute":       c.RateLimitPerMinute,
+		"rateLimitBurst":           c.RateLimitBurst,
+		"reportWebhookThreshold":   c.ReportWebhookThreshold,
+	} {
+		if n <= 0 {
+			problem("%s must be a positive number", name)
+		}
+	}
+
+	if c.UpstreamRetries < 0 {
+		problem("upstreamRetries must not be negative")
+	}
+
+	if c.UpstreamRequestsPerSecond < 0 {
+		problem("upstreamRequestsPerSecond must not be negative")
+	}
+
+	if c.PublicURL != "" {
+		if u, err := url.Parse(c.PublicURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("publicURL must be an http(s):// URL, got %q", c.PublicURL)
+		}
+	} else if c.DownloadLinkSecret != "" {
+		problem("publicURL is required to issue download links")
+	}
+
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		problem("trustedProxies must be IPs or CIDR ranges, %s", err.Error())
+	}
+
+	for _, proxy := range c.Proxies {
+		if u, err := url.Parse(proxy); err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			problem("proxies must be http(s):// or socks5:// URLs, got %q", redactURL(proxy))
+		}
+	}
+
+	if c.RegionalProxy != "" {
+		if u, err := url.Parse(c.RegionalProxy); err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") || u.Host == "" {
+			problem("regionalProxy must be an http(s):// or socks5:// URL, got %q", redactURL(c.RegionalProxy))
+		}
+	}
+
+	if c.ProxySelection != proxyRoundRobin && c.ProxySelection != proxyLeastErrors {
+		problem("proxySelection must be one of '%s' or '%s'", proxyRoundRobin, proxyLeastErrors)
+	}
+
+	for _, prewarm := range c.PrewarmURLs {
+		switch {
+		case isChartPage(prewarm):
+			problem("prewarmURLs can't be chart pages, use the system playlist of the chart such as https://soundcloud.com/discover/sets/charts-top:all-music, got %q", prewarm)
+		case !soundcloudapi.IsPlaylistURL(prewarm):
+			problem("prewarmURLs must be SoundCloud playlist URLs, got %q", prewarm)
+		}
+	}
+
+	if c.PrewarmTopRequested < 0 {
+		problem("prewarmTopRequested must not be negative")
+	}
+
+	for name, d := range map[string]Duration{
+		"playlistCacheTTL":  c.PlaylistCacheTTL,
+		"prewarmInterval":   c.PrewarmInterval,
+		"downloadLinkGrace": c.DownloadLinkGrace,
+	} {
+		if d.Duration < 0 {
+			problem("%s must not be negative", name)
+		}
+	}
+
+	if c.ReloadInterval.Duration < 0 {
+		problem("reloadInterval must not be negative")
+	}
+
+	if c.ReportStore != "sqlite" && c.ReportStore != "memory" {
+		problem("reportStore must be one of 'sqlite' or 'memory'")
+	}
+
+	if c.ReportStore == "sqlite" && c.ReportDB == "" {
+		problem("reportDB is required when reportStore is sqlite")
+	}
+
+	for _, webhook := range c.WebhookURLs {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("webhookURLs must be http(s) URLs, got %q", redactWebhookURL(webhook))
+		}
+	}
+
+	if _, err := parseSunset(c.LegacyRoutesSunset); err != nil {
+		problem("legacyRoutesSunset must be a date formatted as YYYY-MM-DD")
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+
+	// Map iteration order is random, keep the errors stable
+	sort.Strings(problems)
+	return errors.New("invalid config: " + strings.Join(problems, "; "))
+}
+
+// Redacted returns a copy of the config with secrets replaced, for logging
+func (c Config) Redacted() Config {
+	for _, secret := range []*string{&c.WebhookSecret, &c.AdminToken, &c.DownloadLinkSecret} {
+		if *secret != "" {
+			*secret = "REDACTED"
+		}
+	}
+
+	proxies := make([]string, len(c.Proxies))
+	for i, proxy := range c.Proxies {
+		proxies[i] = redactURL(proxy)
+	}
+	c.Proxies = proxies
+	if c.RegionalProxy != "" {
+		c.RegionalProxy = redactURL(c.RegionalProxy)
+	}
+
+	webhooks := make([]string, len(c.WebhookURLs))
+	for i, webhook := range c.WebhookURLs {
+		webhooks[i] = redactWebhookURL(webhook)
+	}
+	c.WebhookURLs = webhooks
+
+	return c
+}
+
+// redactURL hides the password of a URL
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "REDACTED"
+	}
+
+	return u.Redacted()
+}
+
+// redactWebhookURL only keeps the origin of a webhook URL, the token of webhooks such as
+// Slack's is in their path or query
+func redactWebhookURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return "REDACTED"
+	}
+
+	redacted := u.Scheme + "://" + u.Host
+	if u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		redacted += "/REDACTED"
+	}
+
+	return redacted
+}
+
+// String returns the config as YAML with secrets redacted
+func (c Config) String() string {
+	data, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+
+	return string(data)
+}
@@ -5,4 +5,18 @@ type contextKey int
 const (
 	// ContextBody is the context key to access body that has been validated through middleware
 	ContextBody contextKey = iota
+	// ContextVersion is the context key to access the API version of the matched route
+	ContextVersion
+	// ContextLane is the context key of the outbound limiter lane of upstream requests
+	ContextLane
+	// ContextProxyPin is the context key of the proxyPin that upstream requests have to use
+	ContextProxyPin
+	// ContextProxy is the context key of the proxy an upstream request is sent through
+	ContextProxy
+	// ContextOAuthToken is the context key of the SoundCloud OAuth token upstream requests
+	// are made with
+	ContextOAuthToken
+	// ContextLinkIssuer is the context key of the linkIssuer that signs the download links of
+	// resolved tracks
+	ContextLinkIssuer
 )
@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// update rewrites the golden files with the current responses, e.g.
+// go test ./server -run TestContract -update
+var update = flag.Bool("update", false, "rewrite the golden files of the contract tests")
+
+const (
+	standInTrackURL    = "https://soundcloud.com/artist/one"
+	standInPlaylistURL = "https://soundcloud.com/artist/sets/mix"
+	standInUserURL     = "https://soundcloud.com/artist"
+	standInMissingURL  = "https://soundcloud.com/artist/missing"
+	// standInBlockedURL is a set whose only track can't be downloaded
+	standInBlockedURL = "https://soundcloud.com/artist/sets/blocked"
+)
+
+var standInUser = map[string]interface{}{
+	"id":            10,
+	"kind":          "user",
+	"username":      "Artist",
+	"permalink_url": standInUserURL,
+	"avatar_url":    "https://i1.sndcdn.com/avatars-artist-large.jpg",
+	"likes_count":   1,
+}
+
+// standInTrack returns the API form of a track. Tracks without a policy have a progressive
+// MP3 and an HLS Opus transcoding, the others have none.
+func standInTrack(id int, title string, policy string) map[string]interface{} {
+	transcodings := []map[string]interface{}{}
+	if policy == "" {
+		policy = "ALLOW"
+		transcodings = []map[string]interface{}{
+			{
+				"url":    fmt.Sprintf("https://api-v2.soundcloud.com/media/soundcloud:tracks:%d/mp3/stream/progressive", id),
+				"preset": "mp3_0_0",
+				"format": map[string]string{"protocol": "progressive", "mime_type": "audio/mpeg"},
+			},
+			{
+				"url":    fmt.Sprintf("https://api-v2.soundcloud.com/media/soundcloud:tracks:%d/opus/stream/hls", id),
+				"preset": "opus_0_0",
+				"format": map[string]string{"protocol": "hls", "mime_type": "audio/ogg; codecs=\"opus\""},
+			},
+		}
+	}
+
+	return map[string]interface{}{
+		"id":             id,
+		"kind":           "track",
+		"title":          title,
+		"policy":         policy,
+		"permalink_url":  fmt.Sprintf("https://soundcloud.com/artist/track-%d", id),
+		"artwork_url":    fmt.Sprintf("https://i1.sndcdn.com/artworks-%d-large.jpg", id),
+		"waveform_url":   fmt.Sprintf("https://wave.sndcdn.com/%d_m.json", id),
+		"full_duration":  180000 + id,
+		"genre":          "House",
+		"tag_list":       `deep "late night" 124bpm`,
+		"playback_count": 1000 * id,
+		"likes_count":    10 * id,
+		"created_at":     "2021-01-02T03:04:05Z",
+		"user":           standInUser,
+		"media":          map[string]interface{}{"transcodings": transcodings},
+	}
+}
+
+func respondWithJSON(payload interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(payload)
+	}
+}
+
+// newSoundCloudStandIn returns a server whose upstream is a small SoundCloud with a track, a
+// playlist of it along with another track and two that can't be downloaded, and a user who
+// liked the other track
+func newSoundCloudStandIn(t *testing.T, configure func(*Config)) (*Server, *fakeUpstream) {
+	t.Helper()
+
+	s, upstream := newUpstreamTestServer(t, configure)
+
+	tracks := map[string]map[string]interface{}{
+		"1": standInTrack(1, "Track One", ""),
+		"2": standInTrack(2, "Track Two", ""),
+		"3": standInTrack(3, "Copyrighted", "MONETIZE"),
+		"4": standInTrack(4, "Geo-blocked", "BLOCK"),
+	}
+	resources := map[string]interface{}{
+		standInTrackURL: tracks["1"],
+		standInPlaylistURL: map[string]interface{}{
+			"id":            20,
+			"kind":          "playlist",
+			"title":         "Mix",
+			"permalink_url": standInPlaylistURL,
+			"artwork_url":   "https://i1.sndcdn.com/artworks-mix-large.jpg",
+			"user":          standInUser,
+			"track_count":   4,
+			"tracks":        []interface{}{tracks["1"], tracks["2"], tracks["3"], tracks["4"]},
+		},
+		standInBlockedURL: map[string]interface{}{
+			"id":            21,
+			"kind":          "playlist",
+			"title":         "Blocked",
+			"permalink_url": standInBlockedURL,
+			"user":          standInUser,
+			"track_count":   1,
+			"tracks":        []interface{}{tracks["3"]},
+		},
+		standInUserURL: standInUser,
+	}
+
+	upstream.handle("api-v2.soundcloud.com/resolve", func(w http.ResponseWriter, r *http.Request) {
+		resource, ok := resources[r.URL.Query().Get("url")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		respondWithJSON(resource)(w, r)
+	})
+	upstream.handle("api-v2.soundcloud.com/tracks", func(w http.ResponseWriter, r *http.Request) {
+		found := []interface{}{}
+		for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+			if track, ok := tracks[id]; ok {
+				found = append(found, track)
+			}
+		}
+		respondWithJSON(found)(w, r)
+	})
+	upstream.handle("api-v2.soundcloud.com/users/10/track_likes", respondWithJSON(map[string]interface{}{
+		"collection": []interface{}{
+			map[string]interface{}{"created_at": "2021-02-03T04:05:06Z", "kind": "like", "track": tracks["2"]},
+		},
+	}))
+	for id := range tracks {
+		upstream.handle("api-v2.soundcloud.com/media/soundcloud:tracks:"+id+"/mp3/stream/progressive", respondWithJSON(map[string]string{
+			"url": "https://cf-media.sndcdn.com/" + id + ".mp3?Policy=signed",
+		}))
+		upstream.handle("api-v2.soundcloud.com/media/soundcloud:tracks:"+id+"/opus/stream/hls", respondWithJSON(map[string]string{
+			"url": "https://cf-hls-opus-media.sndcdn.com/playlist/" + id + ".opus/playlist.m3u8?Policy=signed",
+		}))
+		upstream.handle("wave.sndcdn.com/"+id+"_m.json", respondWithJSON(map[string]interface{}{
+			"width":   8,
+			"height":  10,
+			"samples": []int{0, 2, 4, 6, 8, 10, 5, 1},
+		}))
+	}
+
+	return s, upstream
+}
+
+// contractRequest is a request of the contract tests and the golden file of its response
+type contractRequest struct {
+	name   string
+	path   string
+	body   string
+	header map[string]string
+	status int
+	golden string
+}
+
+func (c contractRequest) serve(handler http.Handler) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", c.path, strings.NewReader(c.body))
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range c.header {
+		req.Header.Set(key, value)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func urlBody(u string) string {
+	return `{"url":"` + u + `"}`
+}
+
+var contractRequests = []contractRequest{
+	{"track", "/v1/track", urlBody(standInTrackURL), nil, http.StatusOK, "track"},
+	{"playlist", "/v1/playlist", urlBody(standInPlaylistURL), nil, http.StatusOK, "playlist"},
+	{"likes", "/v1/likes", urlBody(standInUserURL), nil, http.StatusOK, "likes"},
+	// Only newer versions have localized titles, waveforms or any other field added since v1
+	{"likes in german", "/v1/likes", urlBody(standInUserURL), map[string]string{"Accept-Language": "de"}, http.StatusOK, "likes"},
+	{"track with waveforms", "/v1/track", `{"url":"` + standInTrackURL + `","waveformBars":4}`, nil, http.StatusOK, "track"},
+	{"authenticated track", "/v1/track", urlBody(standInTrackURL), map[string]string{soundCloudTokenHeader: "OAuth user-token"}, http.StatusOK, "track"},
+	{"batch", "/v1/batch", `{"urls":["` + standInTrackURL + `","` + standInPlaylistURL + `","` + standInMissingURL + `"]}`, nil, http.StatusOK, "batch"},
+	{"invalid body", "/v1/track", `{"url":`, nil, http.StatusBadRequest, "error_invalid_request"},
+	{"not soundcloud", "/v1/track", urlBody("https://example.com/artist/one"), nil, http.StatusUnprocessableEntity, "error_invalid_url"},
+	{"track not found", "/v1/track", urlBody(standInMissingURL), nil, http.StatusNotFound, "error_track_not_found"},
+	{"track not found in spanish", "/v1/track", urlBody(standInMissingURL), map[string]string{"Accept-Language": "es"}, http.StatusNotFound, "error_track_not_found_es"},
+	{"user not found", "/v1/likes", urlBody("https://soundcloud.com/nobody"), nil, http.StatusNotFound, "error_user_not_found"},
+	{"all tracks copyrighted", "/v1/playlist", urlBody(standInBlockedURL), nil, http.StatusConflict, "error_all_tracks_copyrighted"},
+	{"batch too large", "/v1/batch", `{"urls":[` + strings.Repeat(`"`+standInTrackURL+`",`, maxBatchURLs) + `"` + standInTrackURL + `"]}`, nil, http.StatusRequestEntityTooLarge, "error_batch_too_large"},
+}
+
+// checkGolden compares a JSON response with its golden file in testdata/contract
+func checkGolden(t *testing.T, name string, body []byte) {
+	t.Helper()
+
+	got := &bytes.Buffer{}
+	if err := json.Indent(got, body, "", "  "); err != nil {
+		t.Fatalf("response is not JSON: %s", body)
+	}
+	got.WriteString("\n")
+
+	path := filepath.Join("testdata", "contract", name+".json")
+	if *update {
+		if err := ioutil.WriteFile(path, got.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("response doesn't match %s, got:\n%s", path, got.String())
+	}
+}
+
+func TestContractV1(t *testing.T) {
+	for _, c := range contractRequests {
+		t.Run(c.name, func(t *testing.T) {
+			s, _ := newSoundCloudStandIn(t, func(cfg *Config) {
+				cfg.Features.Batch = true
+			})
+
+			w := c.serve(s.handler())
+			if w.Code != c.status {
+				t.Errorf("status = %d, want %d", w.Code, c.status)
+			}
+			if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", contentType)
+			}
+			if deprecation := w.Header().Get("Deprecation"); deprecation != "" {
+				t.Errorf("Deprecation = %q, versioned routes aren't deprecated", deprecation)
+			}
+			checkGolden(t, c.golden, w.Body.Bytes())
+		})
+	}
+}
+
+// The unprefixed routes are v1 under another path, only the deprecation headers differ
+func TestContractLegacy(t *testing.T) {
+	for _, c := range contractRequests {
+		t.Run(c.name, func(t *testing.T) {
+			s, _ := newSoundCloudStandIn(t, func(cfg *Config) {
+				cfg.Features.Batch = true
+			})
+
+			legacy := c
+			legacy.path = strings.TrimPrefix(c.path, "/v1")
+			w := legacy.serve(s.handler())
+			if w.Code != c.status {
+				t.Errorf("status = %d, want %d", w.Code, c.status)
+			}
+			if deprecation := w.Header().Get("Deprecation"); deprecation != "true" {
+				t.Errorf("Deprecation = %q, want true", deprecation)
+			}
+			if link, want := w.Header().Get("Link"), `</v1`+legacy.path+`>; rel="successor-version"`; link != want {
+				t.Errorf("Link = %q, want %q", link, want)
+			}
+			if expose := w.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(expose, "Deprecation") {
+				t.Errorf("Access-Control-Expose-Headers = %q, want it to expose Deprecation", expose)
+			}
+			checkGolden(t, c.golden, w.Body.Bytes())
+		})
+	}
+}
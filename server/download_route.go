@@ -0,0 +1,403 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+// mediaURLLifetime is how long a resolved signed URL is reused before resolving it again.
+// SoundCloud doesn't say when they expire, so expired URLs are also detected when proxying.
+const mediaURLLifetime = 10 * time.Minute
+
+// proxiedHeaders are the upstream response headers passed on to the client
+var proxiedHeaders = []string{"Content-Length", "Content-Range", "Accept-Ranges", "Last-Modified", "ETag"}
+
+var extensions = map[string]string{
+	"audio/mpeg": ".mp3",
+	"audio/ogg":  ".ogg",
+	"audio/mp4":  ".m4a",
+}
+
+// mediaSource is a resolved, signed link to the audio of a track
+type mediaSource struct {
+	url         string
+	filename    string
+	contentType string
+	transcoding soundcloudapi.Transcoding
+	expires     time.Time
+	// pin is the proxy the URL was signed through, the media is fetched through it too
+	pin *proxyPin
+}
+
+func (m *mediaSource) hls() bool {
+	return m.transcoding.Format.Protocol != "progressive"
+}
+
+// mediaCache remembers signed URLs so that every Range request of a download doesn't have
+// to resolve the track again
+type mediaCache struct {
+	mu      sync.Mutex
+	sources map[string]*mediaSource
+}
+
+func newMediaCache() *mediaCache {
+	return &mediaCache{sources: map[string]*mediaSource{}}
+}
+
+func (c *mediaCache) get(key string) *mediaSource {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	source, ok := c.sources[key]
+	if !ok || time.Now().After(source.expires) {
+		delete(c.sources, key)
+		return nil
+	}
+
+	return source
+}
+
+func (c *mediaCache) set(key string, source *mediaSource) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range c.sources {
+		if now.After(v.expires) {
+			delete(c.sources, k)
+		}
+	}
+
+	c.sources[key] = source
+}
+
+// sanitizeFilename removes the characters that can't be used in filenames
+func sanitizeFilename(name string) string {
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return -1
+		}
+		return r
+	}, name))
+}
+
+// downloadFilename returns the filename a track is saved as, e.g. "Author - Title.mp3"
+func downloadFilename(author string, title string, mimeType string) string {
+	ext, ok := extensions[strings.Split(mimeType, ";")[0]]
+	if !ok {
+		ext = ".mp3"
+	}
+
+	return sanitizeFilename(fmt.Sprintf("%s - %s", author, title)) + ext
+}
+
+// contentDisposition returns a Content-Disposition header value that saves the download as filename
+func contentDisposition(filename string) string {
+	ascii := strings.Map(func(r rune) rune {
+		if r > 127 {
+			return '_'
+		}
+		return r
+	}, filename)
+
+	return fmt.Sprintf(`attachment; filename="%s"; filename*=UTF-8''%s`, ascii, url.PathEscape(filename))
+}
+
+// mediaCacheKey returns the key of a media source in the cache. The token is part of it, so
+// that private tracks are never served without it.
+func mediaCacheKey(trackID int64, formats []string, secretToken string) string {
+	return fmt.Sprintf("%d:%s:%s", trackID, strings.Join(formats, ","), secretToken)
+}
+
+// chargeDownload charges a download of the media cached under key. Resuming a download
+// shouldn't count as another download, so ranges past the start are free while their source
+// is cached. Anything that has to be resolved upstream is charged.
+func (s *Server) chargeDownload(w http.ResponseWriter, r *http.Request, key string) error {
+	rangeHeader := r.Header.Get("Range")
+	resuming := rangeHeader != "" && !strings.HasPrefix(rangeHeader, "bytes=0-")
+	if resuming && oauthToken(r.Context()) == "" && s.mediaCache.get(key) != nil {
+		return nil
+	}
+
+	return s.chargeRequest(w, r, 1)
+}
+
+// resolveMediaSource returns the signed URL for the preferred format of a track, reusing a
+// previously resolved one unless refresh is true. secretToken is required for private tracks.
+// Sources resolved on behalf of a user aren't cached, they may only be available to them.
+func (s *Server) resolveMediaSource(ctx context.Context, trackID int64, formats []string, secretToken string, refresh bool) (*mediaSource, error) {
+	key := mediaCacheKey(trackID, formats, secretToken)
+	authenticated := oauthToken(ctx) != ""
+	if !refresh && !authenticated {
+		if source := s.mediaCache.get(key); source != nil {
+			return source, nil
+		}
+	}
+
+	var tracks []soundcloudapi.Track
+	var err error
+	if secretToken == "" {
+		tracks, err = s.soundcloud(ctx).GetTrackInfo(soundcloudapi.GetTrackInfoOptions{ID: []int64{trackID}})
+	} else {
+		var track *soundcloudapi.Track
+		if track, err = s.getPrivateTrack(ctx, trackID, secretToken); err == nil {
+			tracks = []soundcloudapi.Track{*track}
+		}
+	}
+	if err != nil {
+		return nil, upstreamError(err, codeTrackNotFound)
+	}
+
+	if len(tracks) == 0 {
+		return nil, newAPIError(codeTrackNotFound)
+	}
+
+	pin := &proxyPin{}
+	transcoding, ok := selectTranscoding(tracks[0].Media.Transcodings, formats)
+	if !ok {
+		available, reasons := s.classifyUnavailable(ctx, tracks[:1], formats)
+		regional, found := available[trackID]
+		if !found {
+			if reasons[trackID] == skipReasonGeoBlocked {
+				return nil, newAPIError(codeTrackGeoBlocked).with("title", tracks[0].Title)
+			}
+			return nil, newAPIError(codeTrackCopyrighted).with("title", tracks[0].Title)
+		}
+
+		// The media is only available to the regional proxy, so it is fetched through it too
+		tracks[0] = regional
+		transcoding, _ = selectTranscoding(regional.Media.Transcodings, formats)
+		pin.proxy = s.regionalProxy
+	}
+
+	// The media URL of a private transcoding is only signed with the token
+	transcoding.URL = withSecretToken(transcoding.URL, secretToken)
+	mediaURL, err := s.getMediaURL(withProxyPin(ctx, pin), transcoding.URL, "")
+	if err != nil {
+		return nil, upstreamError(err, codeTrackNotFound)
+	}
+
+	source := &mediaSource{
+		url:         mediaURL,
+		filename:    downloadFilename(tracks[0].User.Username, tracks[0].Title, transcoding.Format.MimeType),
+		contentType: strings.Split(transcoding.Format.MimeType, ";")[0],
+		transcoding: transcoding,
+		expires:     time.Now().Add(mediaURLLifetime),
+		pin:         pin,
+	}
+	if !authenticated {
+		s.mediaCache.set(key, source)
+	}
+
+	return source, nil
+}
+
+// fetchMedia requests the media bytes, forwarding the client's range headers
+func (s *Server) fetchMedia(source *mediaSource, r *http.Request) (*http.Response, error) {
+	req, err := http.NewRequest("GET", source.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(withProxyPin(r.Context(), source.pin))
+
+	for _, header := range []string{"Range", "If-Range"} {
+		if value := r.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+
+	return s.mediaClient.Do(req)
+}
+
+// errMediaURLExpired is returned when the CDN rejects the signed URL of an HLS playlist
+var errMediaURLExpired = errors.New("The signed media URL expired")
+
+// getPinnedMedia requests a media URL through the proxy source is pinned to
+func (s *Server) getPinnedMedia(ctx context.Context, source *mediaSource, mediaURL string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", mediaURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.mediaClient.Do(req.WithContext(withProxyPin(ctx, source.pin)))
+}
+
+// fetchHLSSegments returns the segment URLs of the HLS playlist of source
+func (s *Server) fetchHLSSegments(ctx context.Context, source *mediaSource) ([]string, error) {
+	res, err := s.getPinnedMedia(ctx, source, source.url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if isExpiredMediaResponse(res) {
+		return nil, errMediaURLExpired
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, fmt.Errorf("CDN returned status %d for the HLS playlist", res.StatusCode)
+	}
+
+	base, err := url.Parse(source.url)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every line of a media playlist that isn't a tag or a comment is the URI of a segment
+	segments := []string{}
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF") {
+			return nil, errors.New("The HLS playlist is not a media playlist")
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		segment, err := base.Parse(line)
+		if err != nil {
+			return nil, err
+		}
+		segments = append(segments, segment.String())
+	}
+
+	return segments, scanner.Err()
+}
+
+// streamHLS writes the segments of an HLS source to w one after another. The library's
+// downloader fetches segments with the default client, so they are fetched here through the
+// proxy the playlist was signed through instead.
+func (s *Server) streamHLS(w http.ResponseWriter, r *http.Request, trackID int64, source *mediaSource, refresh func() (*mediaSource, error)) error {
+	segments, err := s.fetchHLSSegments(r.Context(), source)
+	if errors.Is(err, errMediaURLExpired) {
+		if source, err = refresh(); err != nil {
+			return err
+		}
+		segments, err = s.fetchHLSSegments(r.Context(), source)
+	}
+	if err != nil {
+		return newAPIError(codeDownloadFailed).wrap(fmt.Errorf("Couldn't get the HLS playlist of track %d: %w", trackID, err))
+	}
+
+	// HLS segments are concatenated on the fly so the size isn't known up front
+	w.Header().Set("Content-Type", source.contentType)
+	w.Header().Set("Accept-Ranges", "none")
+	w.WriteHeader(http.StatusOK)
+
+	for _, segment := range segments {
+		if err := s.copyHLSSegment(w, r.Context(), source, segment); err != nil {
+			// The status is already sent, so the error can only be logged
+			fmt.Println(newAPIError(codeDownloadFailed).wrap(fmt.Errorf("Couldn't stream an HLS segment of track %d: %w", trackID, err)).Error())
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// copyHLSSegment writes a segment of an HLS source to w
+func (s *Server) copyHLSSegment(w io.Writer, ctx context.Context, source *mediaSource, segment string) error {
+	res, err := s.getPinnedMedia(ctx, source, segment)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("CDN returned status %d", res.StatusCode)
+	}
+
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// isExpiredMediaResponse returns true if the CDN rejected a signed URL, usually because it expired
+func isExpiredMediaResponse(res *http.Response) bool {
+	return res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusGone || res.StatusCode == http.StatusNotFound
+}
+
+func (s *Server) handleDownload() apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		trackID, err := strconv.ParseInt(mux.Vars(r)["trackID"], 10, 64)
+		if err != nil {
+			return newAPIError(codeInvalidRequest).variant("track_id")
+		}
+
+		var formats []string
+		if format := r.URL.Query().Get("format"); format != "" {
+			formats = strings.Split(format, ",")
+		}
+
+		token := r.URL.Query().Get("secret_token")
+		if token != "" && !secretTokenRegex.MatchString(token) {
+			return newAPIError(codeInvalidRequest).variant("secret_token")
+		}
+
+		if err := s.chargeDownload(w, r, mediaCacheKey(trackID, formats, token)); err != nil {
+			return err
+		}
+
+		source, err := s.resolveMediaSource(r.Context(), trackID, formats, token, false)
+		if err != nil {
+			return err
+		}
+
+		return s.serveMedia(w, r, trackID, source, func() (*mediaSource, error) {
+			return s.resolveMediaSource(r.Context(), trackID, formats, token, true)
+		})
+	}
+}
+
+// serveMedia proxies the media of source to the client. If the CDN rejects its signed URL,
+// it is resolved again with refresh.
+func (s *Server) serveMedia(w http.ResponseWriter, r *http.Request, trackID int64, source *mediaSource, refresh func() (*mediaSource, error)) error {
+	w.Header().Set("Content-Disposition", contentDisposition(source.filename))
+
+	if source.hls() {
+		return s.streamHLS(w, r, trackID, source, refresh)
+	}
+
+	res, err := s.fetchMedia(source, r)
+	if err == nil && isExpiredMediaResponse(res) {
+		res.Body.Close()
+		source, err = refresh()
+		if err == nil {
+			res, err = s.fetchMedia(source, r)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 && res.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		return newAPIError(codeDownloadFailed).
+			wrap(fmt.Errorf("CDN returned status %d for track %d", res.StatusCode, trackID))
+	}
+
+	w.Header().Set("Content-Type", source.contentType)
+	for _, header := range proxiedHeaders {
+		if value := res.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+
+	if _, err := io.Copy(w, res.Body); err != nil {
+		fmt.Println(err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newDownloadTestServer is newSoundCloudStandIn with the media of track 1 on the CDN
+func newDownloadTestServer(t *testing.T, configure func(*Config)) (*Server, *fakeUpstream) {
+	t.Helper()
+
+	s, upstream := newSoundCloudStandIn(t, configure)
+	upstream.handle("cf-media.sndcdn.com/1.mp3", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte("audio"))
+	})
+
+	return s, upstream
+}
+
+func TestDownloadRangesAreChargedUnlessCached(t *testing.T) {
+	s, upstream := newDownloadTestServer(t, func(cfg *Config) {
+		cfg.RateLimitPerMinute = 1
+		cfg.RateLimitBurst = 2
+	})
+	handler := s.handler()
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+	}{
+		{"uncached range", "/v1/download/1", http.StatusOK},
+		{"cached range", "/v1/download/1", http.StatusOK},
+		{"range of another format", "/v1/download/1?format=flac", http.StatusOK},
+		{"range of yet another format", "/v1/download/1?format=wav", http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Header.Set("Range", "bytes=1-")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+
+	// The rate limited request never reached SoundCloud
+	if count := upstream.count("api-v2.soundcloud.com/tracks"); count != 2 {
+		t.Errorf("track info was requested %d times, want 2", count)
+	}
+}
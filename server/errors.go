@@ -0,0 +1,207 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+// errorCode is a stable, machine-readable identifier for an error. Clients can rely on these
+// never changing, unlike the messages.
+type errorCode string
+
+// Error codes returned by the API
+const (
+	codeInvalidRequest         errorCode = "INVALID_REQUEST"
+	codeInvalidURL             errorCode = "INVALID_URL"
+	codeWrongLinkType          errorCode = "WRONG_LINK_TYPE"
+	codeTrackNotFound          errorCode = "TRACK_NOT_FOUND"
+	codePlaylistNotFound       errorCode = "PLAYLIST_NOT_FOUND"
+	codeUserNotFound           errorCode = "USER_NOT_FOUND"
+	codeTrackCopyrighted       errorCode = "TRACK_COPYRIGHTED"
+	codeAllTracksCopyrighted   errorCode = "ALL_TRACKS_COPYRIGHTED"
+	codeTrackGeoBlocked        errorCode = "TRACK_GEO_BLOCKED"
+	codeAllTracksGeoBlocked    errorCode = "ALL_TRACKS_GEO_BLOCKED"
+	codeBatchTooLarge          errorCode = "BATCH_TOO_LARGE"
+	codeRateLimited            errorCode = "RATE_LIMITED"
+	codeUnauthorized           errorCode = "UNAUTHORIZED"
+	codeReportNotFound         errorCode = "REPORT_NOT_FOUND"
+	codeWebhooksNotConfigured  errorCode = "WEBHOOKS_NOT_CONFIGURED"
+	codeFeatureDisabled        errorCode = "FEATURE_DISABLED"
+	codeClientIDInvalid        errorCode = "CLIENT_ID_INVALID"
+	codeSoundCloudTokenInvalid errorCode = "SOUNDCLOUD_TOKEN_INVALID"
+	codeUpstreamUnavailable    errorCode = "UPSTREAM_UNAVAILABLE"
+	codeUpstreamError          errorCode = "UPSTREAM_ERROR"
+	codeDownloadFailed         errorCode = "DOWNLOAD_FAILED"
+	codeDownloadLinkInvalid    errorCode = "DOWNLOAD_LINK_INVALID"
+	codeDownloadLinkExpired    errorCode = "DOWNLOAD_LINK_EXPIRED"
+	codeInternal               errorCode = "INTERNAL_ERROR"
+)
+
+// errorStatuses maps every error code onto the HTTP status it is returned with
+var errorStatuses = map[errorCode]int{
+	codeInvalidRequest:         http.StatusBadRequest,
+	codeInvalidURL:             http.StatusUnprocessableEntity,
+	codeWrongLinkType:          http.StatusBadRequest,
+	codeTrackNotFound:          http.StatusNotFound,
+	codePlaylistNotFound:       http.StatusNotFound,
+	codeUserNotFound:           http.StatusNotFound,
+	codeTrackCopyrighted:       http.StatusBadRequest,
+	codeAllTracksCopyrighted:   http.StatusConflict,
+	codeTrackGeoBlocked:        http.StatusUnavailableForLegalReasons,
+	codeAllTracksGeoBlocked:    http.StatusUnavailableForLegalReasons,
+	codeBatchTooLarge:          http.StatusRequestEntityTooLarge,
+	codeRateLimited:            http.StatusTooManyRequests,
+	codeUnauthorized:           http.StatusUnauthorized,
+	codeReportNotFound:         http.StatusNotFound,
+	codeWebhooksNotConfigured:  http.StatusConflict,
+	codeFeatureDisabled:        http.StatusNotFound,
+	codeClientIDInvalid:        http.StatusServiceUnavailable,
+	codeSoundCloudTokenInvalid: http.StatusUnauthorized,
+	codeUpstreamUnavailable:    http.StatusServiceUnavailable,
+	codeUpstreamError:          http.StatusBadGateway,
+	codeDownloadFailed:         http.StatusBadGateway,
+	codeDownloadLinkInvalid:    http.StatusForbidden,
+	codeDownloadLinkExpired:    http.StatusGone,
+	codeInternal:               http.StatusInternalServerError,
+}
+
+// apiError is an error that is shown to the user. Its message is looked up in the message
+// catalog when the response is written, so that it is in the language of the client.
+type apiError struct {
+	Code errorCode
+	// Key is the catalog key of the message, the code itself unless a variant is used
+	Key    string
+	Params map[string]string
+	// Detail is optional extra information, such as which field of the request was invalid
+	Detail string
+	// Err is the underlying error, it is logged but never shown to the user
+	Err error
+	// Lang overrides the language negotiated from the request
+	Lang string
+}
+
+func newAPIError(code errorCode) *apiError {
+	return &apiError{Code: code, Key: string(code)}
+}
+
+// Message returns the message of the error in lang
+func (e *apiError) Message(lang string) string {
+	return messages.render(lang, e.Key, e.Params)
+}
+
+func (e *apiError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %s", e.Code, e.Message(defaultLanguage), e.Err.Error())
+	}
+
+	return fmt.Sprintf("%s: %s", e.Code, e.Message(defaultLanguage))
+}
+
+// Status returns the HTTP status of the error
+func (e *apiError) Status() int {
+	if status, ok := errorStatuses[e.Code]; ok {
+		return status
+	}
+
+	return http.StatusInternalServerError
+}
+
+// variant uses a more specific message than the default one for the code
+func (e *apiError) variant(name string) *apiError {
+	e.Key = string(e.Code) + "." + name
+	return e
+}
+
+// with sets the value of a placeholder in the message
+func (e *apiError) with(name string, value interface{}) *apiError {
+	if e.Params == nil {
+		e.Params = map[string]string{}
+	}
+	e.Params[name] = fmt.Sprint(value)
+	return e
+}
+
+func (e *apiError) withDetail(detail string) *apiError {
+	e.Detail = detail
+	return e
+}
+
+func (e *apiError) wrap(err error) *apiError {
+	e.Err = err
+	return e
+}
+
+// inLanguage makes err respond in lang, for handlers that read the language from their own body
+func inLanguage(err error, lang string) error {
+	if apiErr, ok := err.(*apiError); ok && lang != "" {
+		apiErr.Lang = lang
+	}
+
+	return err
+}
+
+// errResponse is the JSON body of an error response
+type errResponse struct {
+	Err    string    `json:"err"`
+	Code   errorCode `json:"code"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+// toAPIError converts any error into one that can be shown to the user. Unknown errors are
+// hidden behind a generic message.
+func toAPIError(err error) *apiError {
+	if apiErr, ok := err.(*apiError); ok {
+		return apiErr
+	}
+
+	if apiErr, ok := upstreamError(err, codeUpstreamError).(*apiError); ok {
+		return apiErr
+	}
+
+	return newAPIError(codeInternal).wrap(err)
+}
+
+// upstreamError converts an error returned by SoundCloud into an apiError, using notFound
+// as the code when the resource doesn't exist
+func upstreamError(err error, notFound errorCode) error {
+	if errors.Is(err, errCircuitOpen) {
+		return newAPIError(codeUpstreamUnavailable).wrap(err)
+	}
+
+	if isTimeout(err) {
+		return newAPIError(codeUpstreamUnavailable).wrap(err)
+	}
+
+	var failedRequest *soundcloudapi.FailedRequestError
+	if !errors.As(err, &failedRequest) {
+		return err
+	}
+
+	switch {
+	case failedRequest.Status == http.StatusNotFound:
+		return newAPIError(notFound).wrap(err)
+	case failedRequest.Status == http.StatusUnauthorized || failedRequest.Status == http.StatusForbidden:
+		return newAPIError(codeClientIDInvalid).wrap(err)
+	case failedRequest.Status == http.StatusTooManyRequests || failedRequest.Status >= 500:
+		return newAPIError(codeUpstreamUnavailable).wrap(err)
+	}
+
+	return newAPIError(codeUpstreamError).wrap(err)
+}
+
+// apiHandler is a handler that returns errors instead of responding with them
+type apiHandler func(w http.ResponseWriter, r *http.Request) error
+
+// handle converts an apiHandler into an http.HandlerFunc that responds with the returned error
+func (s *Server) handle(h apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", s.cfg().FrontendURL)
+
+		if err := h(w, r); err != nil {
+			s.respondError(w, r, err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+func TestUpstreamError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want errorCode
+	}{
+		{"not found", &soundcloudapi.FailedRequestError{Status: 404}, codeTrackNotFound},
+		{"wrapped not found", fmt.Errorf("resolving: %w", &soundcloudapi.FailedRequestError{Status: 404}), codeTrackNotFound},
+		{"rejected client ID", &soundcloudapi.FailedRequestError{Status: 401}, codeClientIDInvalid},
+		{"rate limited", &soundcloudapi.FailedRequestError{Status: 429}, codeUpstreamUnavailable},
+		{"server error", fmt.Errorf("resolving: %w", &soundcloudapi.FailedRequestError{Status: 503}), codeUpstreamUnavailable},
+		{"other status", &soundcloudapi.FailedRequestError{Status: 400}, codeUpstreamError},
+		{"circuit open", fmt.Errorf("resolving: %w", errCircuitOpen), codeUpstreamUnavailable},
+		{"wrapped timeout", fmt.Errorf("resolving: %w", context.DeadlineExceeded), codeUpstreamUnavailable},
+	}
+
+	for _, test := range tests {
+		apiErr, ok := upstreamError(test.err, codeTrackNotFound).(*apiError)
+		if !ok || apiErr.Code != test.want {
+			t.Errorf("%s: upstreamError() = %v, want %s", test.name, apiErr, test.want)
+		}
+	}
+
+	if err := errors.New("unrelated"); upstreamError(err, codeTrackNotFound) != err {
+		t.Error("an error that isn't from SoundCloud was converted")
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	cause := errors.New("connection reset")
+	err := newAPIError(codeWrongLinkType).with("tab", "PLAYLIST").withDetail("url").wrap(cause)
+
+	if err.Key != string(codeWrongLinkType) || err.Status() != http.StatusBadRequest {
+		t.Errorf("got key %s and status %d", err.Key, err.Status())
+	}
+	if message := err.Message(defaultLanguage); !strings.Contains(message, "'PLAYLIST' tab") {
+		t.Errorf("Message() = %q, want the tab filled in", message)
+	}
+	// The underlying error is logged but never shown to the user
+	if !strings.Contains(err.Error(), "connection reset") || strings.Contains(err.Message(defaultLanguage), "connection reset") {
+		t.Errorf("Error() = %q, Message() = %q", err.Error(), err.Message(defaultLanguage))
+	}
+
+	if variant := newAPIError(codeInvalidURL).variant("not_track"); variant.Key != "INVALID_URL.not_track" || variant.Code != codeInvalidURL {
+		t.Errorf("variant = %+v, want the code kept", variant)
+	}
+	if status := (&apiError{Code: "SOMETHING_NEW"}).Status(); status != http.StatusInternalServerError {
+		t.Errorf("status of an unknown code = %d, want 500", status)
+	}
+}
+
+func TestToAPIError(t *testing.T) {
+	apiErr := newAPIError(codeRateLimited)
+	if got := toAPIError(apiErr); got != apiErr {
+		t.Errorf("toAPIError() = %v, want the error itself", got)
+	}
+	if got := toAPIError(&soundcloudapi.FailedRequestError{Status: 503}); got.Code != codeUpstreamUnavailable {
+		t.Errorf("toAPIError() of an upstream error = %v, want %s", got, codeUpstreamUnavailable)
+	}
+
+	internal := toAPIError(errors.New("sql: database is locked"))
+	if internal.Code != codeInternal || strings.Contains(internal.Message(defaultLanguage), "sql") {
+		t.Errorf("toAPIError() of an unknown error = %v, want it hidden behind %s", internal, codeInternal)
+	}
+}
+
+func TestHandleRespondsWithErrors(t *testing.T) {
+	s := newTestServer(t, nil)
+	handler := s.handle(func(w http.ResponseWriter, r *http.Request) error {
+		return newAPIError(codeInvalidRequest).variant("track_id").withDetail("id").wrap(errors.New("strconv: invalid syntax"))
+	})
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/v1/download/x", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want 400", w.Code)
+	}
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "http://frontend.test" {
+		t.Errorf("Access-Control-Allow-Origin = %q", origin)
+	}
+
+	res := errResponse{}
+	if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Code != codeInvalidRequest || res.Err != "Invalid track ID" || res.Detail != "id" {
+		t.Errorf("got %+v", res)
+	}
+}
@@ -0,0 +1,267 @@
+package server
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// exportFlushEvery is how many tracks are written between flushes of an export
+const exportFlushEvery = 100
+
+// exportFormat renders the tracks of a collection as a file, one track at a time
+type exportFormat struct {
+	contentType string
+	ext         string
+	// mediaTypes are the Accept header values that select the format
+	mediaTypes []string
+	// downloadURLs is set for formats that are played rather than read, their tracks point
+	// at the audio instead of the permalink
+	downloadURLs bool
+	// header writes what comes before the tracks of the collection titled title
+	header func(w io.Writer, title string) error
+	track  func(w io.Writer, track trackInfo) error
+}
+
+var exportFormats = map[string]exportFormat{
+	"m3u8": {
+		contentType:  "application/vnd.apple.mpegurl",
+		ext:          ".m3u8",
+		mediaTypes:   []string{"application/vnd.apple.mpegurl", "application/x-mpegurl", "audio/mpegurl", "audio/x-mpegurl"},
+		downloadURLs: true,
+		header:       writeM3U8Header,
+		track:        writeM3U8Track,
+	},
+	"csv": {
+		contentType: "text/csv; charset=utf-8",
+		ext:         ".csv",
+		mediaTypes:  []string{"text/csv"},
+		header:      writeCSVHeader,
+		track:       writeCSVTrack,
+	},
+	"jsonl": {
+		contentType: "application/x-ndjson",
+		ext:         ".jsonl",
+		mediaTypes:  []string{"application/x-ndjson", "application/jsonl", "application/json-lines"},
+		header:      func(w io.Writer, title string) error { return nil },
+		track:       writeJSONLine,
+	},
+}
+
+// negotiateExportFormat picks the export format from the format query parameter, or the
+// Accept header if there is none. M3U8 is the default.
+func negotiateExportFormat(r *http.Request) (exportFormat, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		format, ok := exportFormats[strings.ToLower(name)]
+		if !ok {
+			return exportFormat{}, newAPIError(codeInvalidRequest).variant("collection_export_format").withDetail("format")
+		}
+		return format, nil
+	}
+
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+
+		for _, format := range exportFormats {
+			for _, t := range format.mediaTypes {
+				if t == mediaType {
+					return format, nil
+				}
+			}
+		}
+	}
+
+	return exportFormats["m3u8"], nil
+}
+
+// exportTrackURL returns where the audio of an exported track is downloaded from: a signed
+// link if the request gets them, or else the download route of the API, which resolves the
+// track when it is played
+func (s *Server) exportTrackURL(r *http.Request, track trackInfo) string {
+	if link := s.signedLink(r.Context(), downloadLink{TrackID: track.id, Format: track.Format, SecretToken: track.secretToken}); link != "" {
+		return link
+	}
+
+	origin := strings.TrimRight(s.cfg().PublicURL, "/")
+	if origin == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		origin = scheme + "://" + r.Host
+	}
+
+	query := url.Values{}
+	if track.Format != "" {
+		query.Set("format", track.Format)
+	}
+	if track.secretToken != "" {
+		query.Set("secret_token", track.secretToken)
+	}
+
+	u := fmt.Sprintf("%s/v%d/download/%d", origin, requestVersion(r), track.id)
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// handleExport renders a playlist or likes as a file. Download URLs aren't resolved, the
+// tracks are listed with their permalinks, or with download links of the API in formats
+// that are played. The file is streamed: it starts as soon as the collection is found and
+// every track is written once it is listed, so errors after that truncate the file.
+func (s *Server) handleExport() apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		body, ok := requestBody(r)
+		if !ok {
+			return newAPIError(codeInvalidRequest)
+		}
+
+		format, err := negotiateExportFormat(r)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(body.URL)
+
+		buffered := bufio.NewWriter(w)
+		flush := func() {
+			buffered.Flush()
+			if flusher, ok := w.(http.Flusher); ok {
+				flusher.Flush()
+			}
+		}
+
+		// Exports always list the whole collection
+		opts := body.options(requestVersion(r))
+		opts.manifest = nil
+		opts.metadataOnly = true
+		noWaveform := 0
+		opts.waveformBars = &noWaveform
+
+		started := false
+		var writeErr error
+		opts.onCollection = func(title string) {
+			filename := sanitizeFilename(title)
+			if filename == "" {
+				filename = "export"
+			}
+
+			w.Header().Set("Content-Type", format.contentType)
+			w.Header().Set("Content-Disposition", contentDisposition(filename+format.ext))
+			w.WriteHeader(http.StatusOK)
+			started = true
+
+			writeErr = format.header(buffered, title)
+			flush()
+		}
+
+		written := 0
+		opts.onTrack = func(track trackInfo) {
+			if writeErr != nil {
+				return
+			}
+
+			if format.downloadURLs {
+				track.URL = s.exportTrackURL(r, track)
+			}
+			writeErr = format.track(buffered, track)
+
+			written++
+			if written%exportFlushEvery == 0 {
+				flush()
+			}
+		}
+
+		switch detectLinkType(body.URL) {
+		case linkTypePlaylist:
+			_, err = s.resolvePlaylist(r.Context(), body.URL, opts)
+		case linkTypeLikes:
+			_, err = s.resolveLikes(r.Context(), body.URL, opts)
+		default:
+			err = newAPIError(codeInvalidURL).variant("not_collection")
+		}
+		if err != nil && !started {
+			return err
+		}
+
+		// The status has already been sent, so the client just gets a truncated file
+		for _, err := range []error{err, writeErr} {
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+		}
+		flush()
+
+		return nil
+	}
+}
+
+// writeM3U8Header starts an extended M3U playlist
+func writeM3U8Header(w io.Writer, title string) error {
+	_, err := fmt.Fprintf(w, "#EXTM3U\n#PLAYLIST:%s\n", m3u8Escape(title))
+	return err
+}
+
+func writeM3U8Track(w io.Writer, track trackInfo) error {
+	seconds := track.DurationMS / 1000
+	if track.DurationMS == 0 {
+		seconds = -1
+	}
+
+	_, err := fmt.Fprintf(w, "#EXTINF:%d,%s - %s\n%s\n", seconds, m3u8Escape(track.Author), m3u8Escape(track.Title), track.URL)
+	return err
+}
+
+// m3u8Escape keeps a value on a single line
+func m3u8Escape(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+func writeCSVHeader(w io.Writer, title string) error {
+	return writeCSVRecord(w, []string{"title", "author", "url", "durationMS", "genre", "tags", "label", "bpm", "playbackCount", "likesCount", "createdAt"})
+}
+
+func writeCSVTrack(w io.Writer, track trackInfo) error {
+	bpm := ""
+	if track.BPM != 0 {
+		bpm = strconv.Itoa(track.BPM)
+	}
+
+	return writeCSVRecord(w, []string{
+		track.Title,
+		track.Author,
+		track.URL,
+		strconv.FormatInt(track.DurationMS, 10),
+		track.Genre,
+		strings.Join(track.Tags, ";"),
+		track.Label,
+		bpm,
+		strconv.FormatInt(track.PlaybackCount, 10),
+		strconv.FormatInt(track.LikesCount, 10),
+		track.CreatedAt,
+	})
+}
+
+func writeCSVRecord(w io.Writer, record []string) error {
+	writer := csv.NewWriter(w)
+	writer.Write(record)
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeJSONLine(w io.Writer, track trackInfo) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(&track)
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// exportTracks are tracks as exports get them, with their permalinks
+var exportTracks = []trackInfo{
+	{
+		Title:         "One, Two",
+		URL:           "https://soundcloud.com/artist/one",
+		Author:        "Artist",
+		Format:        "mp3_progressive",
+		trackMetadata: trackMetadata{DurationMS: 215500, Genre: "House", Tags: []string{"deep", "late night"}, BPM: 124, PlaybackCount: 1000, LikesCount: 10, CreatedAt: "2021-01-02T03:04:05Z"},
+		id:            1,
+	},
+	{
+		Title:  "Line\nbreak",
+		URL:    "https://soundcloud.com/artist/two",
+		Author: "Someone \"else\"",
+		id:     2,
+	},
+}
+
+// export writes the tracks in format
+func export(t *testing.T, format exportFormat, title string) string {
+	t.Helper()
+
+	buffer := &bytes.Buffer{}
+	if err := format.header(buffer, title); err != nil {
+		t.Fatal(err)
+	}
+	for _, track := range exportTracks {
+		if err := format.track(buffer, track); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return buffer.String()
+}
+
+func TestExportM3U8(t *testing.T) {
+	want := "#EXTM3U\n#PLAYLIST:Mix of the week\n" +
+		"#EXTINF:215,Artist - One, Two\nhttps://soundcloud.com/artist/one\n" +
+		"#EXTINF:-1,Someone \"else\" - Line break\nhttps://soundcloud.com/artist/two\n"
+
+	if got := export(t, exportFormats["m3u8"], "Mix of\nthe week"); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	want := "title,author,url,durationMS,genre,tags,label,bpm,playbackCount,likesCount,createdAt\n" +
+		"\"One, Two\",Artist,https://soundcloud.com/artist/one,215500,House,deep;late night,,124,1000,10,2021-01-02T03:04:05Z\n" +
+		"\"Line\nbreak\",\"Someone \"\"else\"\"\",https://soundcloud.com/artist/two,0,,,,,0,0,\n"
+
+	if got := export(t, exportFormats["csv"], "Mix"); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExportJSONLines(t *testing.T) {
+	lines := strings.Split(strings.TrimSuffix(export(t, exportFormats["jsonl"], "Mix"), "\n"), "\n")
+	if len(lines) != len(exportTracks) {
+		t.Fatalf("got %d lines, want one per track", len(lines))
+	}
+
+	for i, line := range lines {
+		track := trackInfo{}
+		if err := json.Unmarshal([]byte(line), &track); err != nil {
+			t.Fatal(err)
+		}
+		if track.Title != exportTracks[i].Title || track.URL != exportTracks[i].URL || track.DurationMS != exportTracks[i].DurationMS {
+			t.Errorf("line %d = %s, want track %q", i, line, exportTracks[i].Title)
+		}
+	}
+}
+
+// exportLines exports the stand-in playlist and returns the lines of the file
+func exportLines(t *testing.T, s *Server, path string) []string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	s.handler().ServeHTTP(w, httptest.NewRequest("POST", path, strings.NewReader(urlBody(standInPlaylistURL))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: got %d %s, want 200", path, w.Code, w.Body.String())
+	}
+	if disposition := w.Header().Get("Content-Disposition"); !strings.Contains(disposition, "Mix.") {
+		t.Errorf("%s: Content-Disposition = %q, want the file named after the playlist", path, disposition)
+	}
+
+	return strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+}
+
+func TestExportM3U8PointsAtDownloads(t *testing.T) {
+	tests := []struct {
+		name      string
+		configure func(*Config)
+		path      string
+		prefix    string
+	}{
+		{"download route", func(cfg *Config) { cfg.PublicURL = "https://api.example.com/" }, "/v2/export", "https://api.example.com/v2/download/"},
+		{"request host", nil, "/v1/export", "http://example.com/v1/download/"},
+		{"signed links", func(cfg *Config) {
+			cfg.PublicURL = "https://api.example.com"
+			cfg.DownloadLinkSecret = "secret"
+		}, "/v2/export", "https://api.example.com/v2/download/link/"},
+	}
+
+	for _, test := range tests {
+		s, upstream := newSoundCloudStandIn(t, test.configure)
+		lines := exportLines(t, s, test.path)
+
+		// The header and a line of info and one of URL for both downloadable tracks
+		if len(lines) != 6 {
+			t.Fatalf("%s: got %q, want 2 tracks", test.name, lines)
+		}
+		for _, line := range []string{lines[3], lines[5]} {
+			if !strings.HasPrefix(line, test.prefix) {
+				t.Errorf("%s: track URL = %q, want one starting with %s", test.name, line, test.prefix)
+			}
+		}
+		if test.name == "download route" && lines[3] != "https://api.example.com/v2/download/1?format=mp3_progressive" {
+			t.Errorf("%s: track URL = %q", test.name, lines[3])
+		}
+
+		// Download URLs are resolved when they are played, not when they are exported
+		if count := upstream.count("api-v2.soundcloud.com/media/soundcloud:tracks:1/mp3/stream/progressive"); count != 0 {
+			t.Errorf("%s: resolved %d media URLs", test.name, count)
+		}
+	}
+}
+
+func TestExportCSVListsPermalinks(t *testing.T) {
+	s, _ := newSoundCloudStandIn(t, func(cfg *Config) {
+		cfg.PublicURL = "https://api.example.com"
+		cfg.DownloadLinkSecret = "secret"
+	})
+
+	lines := exportLines(t, s, "/v2/export?format=csv")
+	if len(lines) != 3 || !strings.Contains(lines[1], ",https://soundcloud.com/artist/track-1,") {
+		t.Errorf("got %q, want the permalinks of 2 tracks", lines)
+	}
+}
+
+func TestExportStartsBeforeTracksAreListed(t *testing.T) {
+	s, upstream := newSoundCloudStandIn(t, nil)
+	// The policies of the tracks that can't be downloaded are looked up after the playlist
+	listed := make(chan struct{})
+	upstream.handle("api-v2.soundcloud.com/tracks", func(w http.ResponseWriter, r *http.Request) {
+		<-listed
+		respondWithJSON([]interface{}{})(w, r)
+	})
+	server := httptest.NewServer(s.handler())
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/v2/export", "application/json", strings.NewReader(urlBody(standInPlaylistURL)))
+	if err != nil {
+		close(listed)
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	reader := bufio.NewReader(res.Body)
+	first, err := reader.ReadString('\n')
+	close(listed)
+	if err != nil || first != "#EXTM3U\n" {
+		t.Fatalf("first line = %q, %v, want the M3U8 header before the tracks are listed", first, err)
+	}
+
+	rest := &bytes.Buffer{}
+	rest.ReadFrom(reader)
+	if !strings.Contains(rest.String(), "Track Two") {
+		t.Errorf("rest of the export = %q, want the tracks", rest.String())
+	}
+}
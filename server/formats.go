@@ -0,0 +1,113 @@
+package server
+
+import (
+	"regexp"
+	"strings"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+// defaultBitrates are the bitrates SoundCloud encodes each codec at when the preset
+// doesn't say otherwise
+var defaultBitrates = map[string]string{
+	"mp3":  "128kbps",
+	"opus": "64kbps",
+	"aac":  "160kbps",
+}
+
+var presetBitrateRegex = regexp.MustCompile(`(\d+)k`)
+
+// transcodingInfo describes one of the formats a track is available in
+type transcodingInfo struct {
+	Format   string `json:"format"`
+	Preset   string `json:"preset"`
+	Protocol string `json:"protocol"`
+	MimeType string `json:"mimeType"`
+	Quality  string `json:"quality"`
+	Snipped  bool   `json:"snipped"`
+}
+
+// codec returns the codec of a transcoding from its preset (e.g. "mp3_0_0" -> "mp3")
+func codec(t soundcloudapi.Transcoding) string {
+	return strings.ToLower(strings.Split(t.Preset, "_")[0])
+}
+
+// quality returns the bitrate of a transcoding, or an empty string if it is unknown
+func quality(t soundcloudapi.Transcoding) string {
+	if match := presetBitrateRegex.FindStringSubmatch(t.Preset); match != nil {
+		return match[1] + "kbps"
+	}
+
+	return defaultBitrates[codec(t)]
+}
+
+// formatName returns the name clients use to ask for a transcoding (e.g. "mp3_progressive")
+func formatName(t soundcloudapi.Transcoding) string {
+	return codec(t) + "_" + strings.ToLower(t.Format.Protocol)
+}
+
+// isPreview returns true if the transcoding is only a snippet of the track
+func isPreview(t soundcloudapi.Transcoding) bool {
+	return t.Snipped || strings.Contains(t.URL, "/preview/")
+}
+
+// matchesFormat returns true if the preference refers to the transcoding. A preference can be
+// a format name, codec, protocol, preset, mime type or quality. Empty preferences, e.g. from
+// a stray comma, match nothing.
+func matchesFormat(t soundcloudapi.Transcoding, preference string) bool {
+	preference = strings.ToLower(strings.TrimSpace(preference))
+	if preference == "" {
+		return false
+	}
+
+	switch preference {
+	case formatName(t), codec(t), strings.ToLower(t.Format.Protocol), strings.ToLower(t.Preset), quality(t):
+		return true
+	}
+
+	return strings.HasPrefix(strings.ToLower(t.Format.MimeType), preference)
+}
+
+// describeTranscodings lists the formats a track is available in
+func describeTranscodings(transcodings []soundcloudapi.Transcoding) []transcodingInfo {
+	info := make([]transcodingInfo, len(transcodings))
+	for i, t := range transcodings {
+		info[i] = transcodingInfo{
+			Format:   formatName(t),
+			Preset:   t.Preset,
+			Protocol: t.Format.Protocol,
+			MimeType: t.Format.MimeType,
+			Quality:  quality(t),
+			Snipped:  isPreview(t),
+		}
+	}
+
+	return info
+}
+
+// selectTranscoding picks the first full-length transcoding matching the preferences in order,
+// falling back to progressive and then to any other full-length transcoding. It returns false
+// if the track has no full-length transcoding.
+func selectTranscoding(transcodings []soundcloudapi.Transcoding, preferences []string) (soundcloudapi.Transcoding, bool) {
+	for _, preference := range preferences {
+		for _, t := range transcodings {
+			if !isPreview(t) && matchesFormat(t, preference) {
+				return t, true
+			}
+		}
+	}
+
+	for _, t := range transcodings {
+		if !isPreview(t) && t.Format.Protocol == "progressive" {
+			return t, true
+		}
+	}
+
+	for _, t := range transcodings {
+		if !isPreview(t) {
+			return t, true
+		}
+	}
+
+	return soundcloudapi.Transcoding{}, false
+}
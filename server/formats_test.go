@@ -0,0 +1,21 @@
+package server
+
+import (
+	"testing"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+func TestSelectTranscodingSkipsEmptyPreferences(t *testing.T) {
+	transcodings := []soundcloudapi.Transcoding{
+		{Preset: "mp3_0_0", Format: soundcloudapi.TranscodingFormat{Protocol: "hls", MimeType: "audio/mpeg"}},
+		{Preset: "opus_0_0", Format: soundcloudapi.TranscodingFormat{Protocol: "hls", MimeType: "audio/ogg; codecs=\"opus\""}},
+	}
+
+	for _, preferences := range [][]string{{"", "opus"}, {" ", "opus"}, {"", "", "opus_hls"}} {
+		got, ok := selectTranscoding(transcodings, preferences)
+		if !ok || codec(got) != "opus" {
+			t.Errorf("selectTranscoding(%q) = %s, want opus", preferences, got.Preset)
+		}
+	}
+}
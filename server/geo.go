@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+const trackPoliciesURL = "https://api-v2.soundcloud.com/tracks"
+
+// trackPoliciesBatch is the most tracks SoundCloud returns per request
+const trackPoliciesBatch = 50
+
+// trackPolicy says where and how a track can be played. The SoundCloud client doesn't
+// decode it, the tag of its Policy field is misspelt.
+type trackPolicy struct {
+	Policy            string `json:"policy"`
+	MonetizationModel string `json:"monetization_model"`
+}
+
+// geoBlocked reports whether the track can't be played because of where the request came
+// from. Go+ tracks are previews everywhere, so they are left to count as copyrighted.
+func (p trackPolicy) geoBlocked() bool {
+	switch p.Policy {
+	case "BLOCK":
+		return true
+	case "SNIP":
+		return p.MonetizationModel != "SUB_HIGH_TIER"
+	}
+
+	return false
+}
+
+// policyTrack is a track along with its policy
+type policyTrack struct {
+	soundcloudapi.Track
+	policy trackPolicy
+}
+
+// getTrackPolicies fetches tracks by ID along with their policy. The tracks are as seen from
+// the proxy of ctx, if it is pinned to one.
+func (s *Server) getTrackPolicies(ctx context.Context, ids []int64) (map[int64]policyTrack, error) {
+	tracks := map[int64]policyTrack{}
+	for start := 0; start < len(ids); start += trackPoliciesBatch {
+		end := start + trackPoliciesBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		batch := make([]string, 0, end-start)
+		for _, id := range ids[start:end] {
+			batch = append(batch, strconv.FormatInt(id, 10))
+		}
+
+		u, err := url.Parse(trackPoliciesURL)
+		if err != nil {
+			return nil, err
+		}
+		u.RawQuery = url.Values{"ids": {strings.Join(batch, ",")}, "client_id": {s.scdl.ClientID()}}.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := s.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		raw := []json.RawMessage{}
+		err = json.NewDecoder(res.Body).Decode(&raw)
+		res.Body.Close()
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return nil, &soundcloudapi.FailedRequestError{Status: res.StatusCode}
+		}
+		if err != nil {
+			return nil, errors.New("Invalid tracks response")
+		}
+
+		for _, data := range raw {
+			track := policyTrack{}
+			if json.Unmarshal(data, &track.Track) != nil || json.Unmarshal(data, &track.policy) != nil {
+				return nil, errors.New("Invalid tracks response")
+			}
+			tracks[track.ID] = track
+		}
+	}
+
+	return tracks, nil
+}
+
+// regionalContext returns a context whose upstream requests go through the regional proxy
+func (s *Server) regionalContext(ctx context.Context) context.Context {
+	return withProxyPin(ctx, &proxyPin{proxy: s.regionalProxy})
+}
+
+// classifyUnavailable works out why tracks without a usable transcoding can't be downloaded.
+// Geo-blocked tracks are fetched again through the regional proxy if there is one, those
+// that can be downloaded from there are returned, along with the skip reason of the others.
+func (s *Server) classifyUnavailable(ctx context.Context, tracks []soundcloudapi.Track, formats []string) (map[int64]soundcloudapi.Track, map[int64]string) {
+	available := map[int64]soundcloudapi.Track{}
+	reasons := map[int64]string{}
+	if len(tracks) == 0 {
+		return available, reasons
+	}
+
+	ids := make([]int64, 0, len(tracks))
+	for _, track := range tracks {
+		reasons[track.ID] = skipReasonCopyrighted
+		ids = append(ids, track.ID)
+	}
+
+	// Telling geo-blocked tracks apart is best effort, they count as copyrighted otherwise
+	policies, err := s.getTrackPolicies(ctx, ids)
+	if err != nil {
+		fmt.Println(err.Error())
+		return available, reasons
+	}
+
+	blocked := []int64{}
+	for _, id := range ids {
+		if track, ok := policies[id]; ok && track.policy.geoBlocked() {
+			reasons[id] = skipReasonGeoBlocked
+			blocked = append(blocked, id)
+		}
+	}
+
+	if s.regionalProxy == nil || len(blocked) == 0 {
+		return available, reasons
+	}
+
+	regional, err := s.getTrackPolicies(s.regionalContext(ctx), blocked)
+	if err != nil {
+		fmt.Println(err.Error())
+		return available, reasons
+	}
+
+	for id, track := range regional {
+		if _, ok := selectTranscoding(track.Media.Transcodings, formats); ok {
+			available[id] = track.Track
+			delete(reasons, id)
+		}
+	}
+
+	return available, reasons
+}
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zackradisic/downloadsound.cloud-api-go/pb"
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcCodes maps the HTTP status of an error onto the closest gRPC code
+var grpcCodes = map[int]codes.Code{
+	http.StatusBadRequest:                 codes.InvalidArgument,
+	http.StatusUnprocessableEntity:        codes.InvalidArgument,
+	http.StatusNotFound:                   codes.NotFound,
+	http.StatusConflict:                   codes.FailedPrecondition,
+	http.StatusRequestEntityTooLarge:      codes.ResourceExhausted,
+	http.StatusTooManyRequests:            codes.ResourceExhausted,
+	http.StatusUnauthorized:               codes.Unauthenticated,
+	http.StatusUnavailableForLegalReasons: codes.FailedPrecondition,
+	http.StatusBadGateway:                 codes.Unavailable,
+	http.StatusServiceUnavailable:         codes.Unavailable,
+}
+
+// grpcServer implements the Downloader gRPC service on top of the same resolvers as the
+// HTTP handlers
+type grpcServer struct {
+	pb.UnimplementedDownloaderServer
+	s *Server
+}
+
+// RunGRPC runs the gRPC server on the configured address. Once ctx is done it stops
+// accepting calls and waits for those in flight, up to the shutdown timeout.
+func (s *Server) RunGRPC(ctx context.Context) error {
+	addr := s.cfg().GRPCAddr
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(s.grpcRateLimit),
+		grpc.StreamInterceptor(s.grpcStreamRateLimit),
+	)
+	pb.RegisterDownloaderServer(srv, &grpcServer{s: s})
+
+	fmt.Println("Running gRPC server on " + addr)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(lis)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down gRPC server")
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(s.cfg().ShutdownTimeout.Duration):
+		// Calls still running are cut off, like requests are by http.Server.Shutdown
+		srv.Stop()
+	}
+
+	return <-served
+}
+
+// grpcClientKey identifies the client that made a call, like clientKey does for HTTP
+func (s *Server) grpcClientKey(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	var forwarded []string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		forwarded = md.Get("x-forwarded-for")
+	}
+
+	return s.clientIP(p.Addr.String(), forwarded)
+}
+
+// chargeCall charges a single token to the client making a call
+func (s *Server) chargeCall(ctx context.Context) error {
+	cfg := s.cfg()
+	ok, wait := s.limiter.take(s.grpcClientKey(ctx), 1, cfg.RateLimitPerMinute, cfg.RateLimitBurst)
+	if ok {
+		return nil
+	}
+
+	grpc.SetTrailer(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(wait.Seconds())+1)))
+	return grpcError(ctx, newAPIError(codeRateLimited), grpcLanguage(ctx, ""))
+}
+
+func (s *Server) grpcRateLimit(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.chargeCall(ctx); err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (s *Server) grpcStreamRateLimit(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.chargeCall(ss.Context()); err != nil {
+		return err
+	}
+
+	return handler(srv, ss)
+}
+
+// grpcLanguage returns the language to respond to a call in, from the lang field of the
+// request or the accept-language metadata
+func grpcLanguage(ctx context.Context, requested string) string {
+	if lang, ok := messages.supports(requested); ok {
+		return lang
+	}
+
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		return messages.negotiate(strings.Join(md.Get("accept-language"), ","))
+	}
+
+	return defaultLanguage
+}
+
+// grpcError converts err into a gRPC status, sending the error code in the error-code trailer
+func grpcError(ctx context.Context, err error, lang string) error {
+	apiErr := tokenError(ctx, toAPIError(err))
+	if apiErr.Err != nil {
+		fmt.Println(apiErr.Error())
+	}
+
+	code, ok := grpcCodes[apiErr.Status()]
+	if !ok {
+		code = codes.Internal
+	}
+
+	grpc.SetTrailer(ctx, metadata.Pairs("error-code", string(apiErr.Code)))
+	return status.Error(code, apiErr.Message(lang))
+}
+
+// resolveOptions returns the options to resolve the requested resource with
+func (g *grpcServer) resolveOptions(ctx context.Context, req *pb.ResolveRequest) resolveOptions {
+	var waveformBars *int
+	if req.WaveformBars != nil {
+		bars := int(req.WaveformBars.Value)
+		waveformBars = &bars
+	}
+
+	return newResolveOptions(req.Formats, waveformBars, grpcLanguage(ctx, req.Lang))
+}
+
+func (g *grpcServer) ResolveTrack(ctx context.Context, req *pb.ResolveRequest) (*pb.Track, error) {
+	ctx = g.s.grpcIssueLinks(grpcAuthenticate(ctx))
+	opts := g.resolveOptions(ctx, req)
+	u, err := g.s.checkLink(linkTypeTrack, req.Url)
+	if err != nil {
+		return nil, grpcError(ctx, err, opts.lang)
+	}
+
+	track, err := g.s.resolveTrack(ctx, u, opts)
+	if err != nil {
+		return nil, grpcError(ctx, err, opts.lang)
+	}
+
+	return &pb.Track{
+		Title:        track.Title,
+		Url:          track.URL,
+		Hls:          track.hls,
+		Author:       track.Author.Username,
+		ImageUrl:     track.ImageURL,
+		Format:       track.Format,
+		Transcodings: pbTranscodings(track.Transcodings),
+		Original:     pbOriginalFile(track.Original),
+		Metadata:     pbMetadata(track.trackMetadata),
+		Private:      track.Private,
+		Unlocked:     track.Unlocked,
+	}, nil
+}
+
+func (g *grpcServer) ResolvePlaylist(ctx context.Context, req *pb.ResolveRequest) (*pb.Collection, error) {
+	return g.resolveCollection(ctx, req, linkTypePlaylist, req.Url, nil)
+}
+
+func (g *grpcServer) ResolveLikes(ctx context.Context, req *pb.ResolveRequest) (*pb.Collection, error) {
+	return g.resolveCollection(ctx, req, linkTypeLikes, req.Url, nil)
+}
+
+func (g *grpcServer) StreamCollection(req *pb.ResolveRequest, stream pb.Downloader_StreamCollectionServer) error {
+	ctx := stream.Context()
+
+	u, err := g.s.expandURL(req.Url)
+	if err != nil {
+		return grpcError(ctx, err, grpcLanguage(ctx, req.Lang))
+	}
+
+	// Anything but a playlist is checked like a likes URL, which rejects tracks
+	link := linkTypeLikes
+	if detectLinkType(u) == linkTypePlaylist {
+		link = linkTypePlaylist
+	}
+
+	// Tracks are sent from a single goroutine, so only the first failed send is kept
+	var sendErr error
+	onTrack := func(track trackInfo) {
+		if sendErr == nil {
+			sendErr = stream.Send(&pb.CollectionEvent{Event: &pb.CollectionEvent_Track{Track: pbTrack(track)}})
+		}
+	}
+
+	// The URL is already expanded, so expanding it again makes no upstream requests
+	collection, err := g.resolveCollection(ctx, req, link, u, onTrack)
+	if err != nil {
+		return err
+	}
+
+	if sendErr != nil {
+		return sendErr
+	}
+
+	// The tracks were already sent
+	collection.Tracks = nil
+	return stream.Send(&pb.CollectionEvent{Event: &pb.CollectionEvent_Collection{Collection: collection}})
+}
+
+// resolveCollection resolves rawURL as a playlist or likes URL, calling onTrack (if set) with
+// every track as soon as it is resolved
+func (g *grpcServer) resolveCollection(ctx context.Context, req *pb.ResolveRequest, link linkType, rawURL string, onTrack func(trackInfo)) (*pb.Collection, error) {
+	ctx = g.s.grpcIssueLinks(grpcAuthenticate(ctx))
+	opts := g.resolveOptions(ctx, req)
+	opts.onTrack = onTrack
+
+	u, err := g.s.checkLink(link, rawURL)
+	if err != nil {
+		return nil, grpcError(ctx, err, opts.lang)
+	}
+
+	var collection *collectionResponse
+	if link == linkTypePlaylist {
+		collection, err = g.s.resolvePlaylist(ctx, u, opts)
+	} else {
+		collection, err = g.s.resolveLikes(ctx, u, opts)
+	}
+	if err != nil {
+		return nil, grpcError(ctx, err, opts.lang)
+	}
+
+	res := &pb.Collection{
+		Url:      collection.URL,
+		Title:    collection.Title,
+		Author:   pbUser(collection.Author),
+		ImageUrl: collection.ImageURL,
+		Private:  collection.Private,
+	}
+	for _, track := range collection.Tracks {
+		res.Tracks = append(res.Tracks, pbTrack(track))
+	}
+	for _, track := range collection.skipped {
+		res.Skipped = append(res.Skipped, &pb.SkippedTrack{Title: track.Title, Url: track.URL, Reason: track.Reason})
+	}
+
+	return res, nil
+}
+
+func pbTrack(track trackInfo) *pb.Track {
+	return &pb.Track{
+		Title:        track.Title,
+		Url:          track.URL,
+		Hls:          track.HLS,
+		Author:       track.Author,
+		ImageUrl:     track.ImageURL,
+		Format:       track.Format,
+		Transcodings: pbTranscodings(track.Transcodings),
+		Original:     pbOriginalFile(track.Original),
+		Metadata:     pbMetadata(track.trackMetadata),
+		Private:      track.Private,
+		Unlocked:     track.Unlocked,
+	}
+}
+
+func pbUser(user soundcloudapi.User) *pb.User {
+	return &pb.User{
+		Id:           user.ID,
+		Username:     user.Username,
+		PermalinkUrl: user.PermalinkURL,
+		AvatarUrl:    user.AvatarURL,
+		Verified:     user.Verified,
+	}
+}
+
+func pbTranscodings(transcodings []transcodingInfo) []*pb.Transcoding {
+	res := make([]*pb.Transcoding, 0, len(transcodings))
+	for _, t := range transcodings {
+		res = append(res, &pb.Transcoding{
+			Format:   t.Format,
+			Preset:   t.Preset,
+			Protocol: t.Protocol,
+			MimeType: t.MimeType,
+			Quality:  t.Quality,
+			Snipped:  t.Snipped,
+		})
+	}
+
+	return res
+}
+
+func pbOriginalFile(original *originalFile) *pb.OriginalFile {
+	if original == nil {
+		return nil
+	}
+
+	return &pb.OriginalFile{Url: original.URL, Filename: original.Filename, Size: original.Size}
+}
+
+func pbMetadata(m trackMetadata) *pb.Metadata {
+	return &pb.Metadata{
+		DurationMs:    m.DurationMS,
+		Waveform:      m.Waveform,
+		Genre:         m.Genre,
+		Tags:          m.Tags,
+		Label:         m.Label,
+		Bpm:           int32(m.BPM),
+		PlaybackCount: m.PlaybackCount,
+		LikesCount:    m.LikesCount,
+		CreatedAt:     m.CreatedAt,
+	}
+}
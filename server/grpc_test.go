@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zackradisic/downloadsound.cloud-api-go/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// collectionStream is a Downloader_StreamCollectionServer that keeps what is sent
+type collectionStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events []*pb.CollectionEvent
+}
+
+func (s *collectionStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *collectionStream) Send(event *pb.CollectionEvent) error {
+	s.events = append(s.events, event)
+	return nil
+}
+
+func TestStreamCollectionExpandsOnce(t *testing.T) {
+	s, upstream := newUpstreamTestServer(t, nil)
+	upstream.handle("api-v2.soundcloud.com/search/tracks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"collection":[{"id":1,"kind":"track","permalink_url":"https://soundcloud.com/user/track"}]}`))
+	})
+
+	// Searches find tracks, which aren't collections
+	stream := &collectionStream{ctx: context.Background()}
+	err := (&grpcServer{s: s}).StreamCollection(&pb.ResolveRequest{Url: "https://soundcloud.com/search?q=track"}, stream)
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("err = %v, want InvalidArgument", err)
+	}
+
+	if count := upstream.count("api-v2.soundcloud.com/search/tracks"); count != 1 {
+		t.Errorf("searched %d times, want 1", count)
+	}
+}
+
+func TestStreamCollectionValidatesLinks(t *testing.T) {
+	tests := []struct {
+		url  string
+		code codes.Code
+	}{
+		{standInTrackURL, codes.InvalidArgument},
+		{"https://example.com/artist", codes.InvalidArgument},
+		{standInPlaylistURL, codes.OK},
+		{standInUserURL, codes.OK},
+		{standInUserURL + "/likes", codes.OK},
+	}
+
+	for _, test := range tests {
+		s, upstream := newSoundCloudStandIn(t, nil)
+		stream := &collectionStream{ctx: context.Background()}
+
+		err := (&grpcServer{s: s}).StreamCollection(&pb.ResolveRequest{Url: test.url}, stream)
+		if status.Code(err) != test.code {
+			t.Errorf("%s: err = %v, want %s", test.url, err, test.code)
+		}
+		if count := upstream.count("api-v2.soundcloud.com/resolve"); test.code != codes.OK && count != 0 {
+			t.Errorf("%s: resolved an invalid link %d times", test.url, count)
+		}
+	}
+
+	// The REST routes reject tracks sent as likes the same way
+	s, _ := newSoundCloudStandIn(t, nil)
+	w := httptest.NewRecorder()
+	s.handler().ServeHTTP(w, httptest.NewRequest("POST", "/v1/likes", strings.NewReader(urlBody(standInTrackURL))))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), string(codeWrongLinkType)) {
+		t.Errorf("/v1/likes with a track: got %d %s, want %s", w.Code, w.Body.String(), codeWrongLinkType)
+	}
+}
+
+func TestGRPCIssuesSignedLinks(t *testing.T) {
+	s, _ := newSoundCloudStandIn(t, func(cfg *Config) {
+		cfg.DownloadLinkSecret = "secret"
+		cfg.PublicURL = "https://api.example.com/"
+		cfg.DownloadLinkBindIP = true
+	})
+	g := &grpcServer{s: s}
+	ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 4000}})
+
+	// opus is an HLS transcoding, the link serves the whole file regardless
+	track, err := g.ResolveTrack(ctx, &pb.ResolveRequest{Url: standInTrackURL, Formats: []string{"opus"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := &collectionStream{ctx: ctx}
+	if err := g.StreamCollection(&pb.ResolveRequest{Url: standInPlaylistURL}, stream); err != nil {
+		t.Fatal(err)
+	}
+
+	tracks := []*pb.Track{track}
+	for _, event := range stream.events {
+		if track := event.GetTrack(); track != nil {
+			tracks = append(tracks, track)
+		}
+	}
+	if len(tracks) != 3 {
+		t.Fatalf("got %d tracks, want 3", len(tracks))
+	}
+
+	const base = "https://api.example.com/v1/download/link/"
+	for _, track := range tracks {
+		if !strings.HasPrefix(track.Url, base) || track.Hls {
+			t.Errorf("%s: url = %q, hls = %t, want a signed link", track.Title, track.Url, track.Hls)
+			continue
+		}
+		link, err := verifyLink("secret", strings.TrimPrefix(track.Url, base))
+		if err != nil || link.IP != "203.0.113.7" {
+			t.Errorf("%s: link = %+v, %v, want it bound to the caller", track.Title, link, err)
+		}
+	}
+}
+
+// freeAddr returns a local address nothing listens on
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	return lis.Addr().String()
+}
+
+func TestRunGRPCStopsGracefully(t *testing.T) {
+	addr := freeAddr(t)
+	s, upstream := newUpstreamTestServer(t, func(cfg *Config) {
+		cfg.GRPCAddr = addr
+		cfg.ShutdownTimeout = Duration{5 * time.Second}
+	})
+	called := make(chan struct{})
+	upstream.handle("api-v2.soundcloud.com/resolve", func(w http.ResponseWriter, r *http.Request) {
+		close(called)
+		time.Sleep(200 * time.Millisecond)
+		http.NotFound(w, r)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.RunGRPC(ctx)
+	}()
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resolved := make(chan error, 1)
+	go func() {
+		_, err := pb.NewDownloaderClient(conn).ResolveTrack(context.Background(), &pb.ResolveRequest{Url: "https://soundcloud.com/user/track"}, grpc.WaitForReady(true))
+		resolved <- err
+	}()
+
+	<-called
+	cancel()
+
+	// The call in flight is finished rather than cut off
+	if err := <-resolved; status.Code(err) != codes.NotFound {
+		t.Errorf("ResolveTrack() = %v, want NotFound", err)
+	}
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("RunGRPC() = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("RunGRPC() didn't return once the call was done")
+	}
+}
+
+func TestRunGRPCCutsOffCallsAfterShutdownTimeout(t *testing.T) {
+	addr := freeAddr(t)
+	s, upstream := newUpstreamTestServer(t, func(cfg *Config) {
+		cfg.GRPCAddr = addr
+		cfg.ShutdownTimeout = Duration{50 * time.Millisecond}
+	})
+	called := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	upstream.handle("api-v2.soundcloud.com/resolve", func(w http.ResponseWriter, r *http.Request) {
+		close(called)
+		<-release
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.RunGRPC(ctx)
+	}()
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	go pb.NewDownloaderClient(conn).ResolveTrack(context.Background(), &pb.ResolveRequest{Url: "https://soundcloud.com/user/track"}, grpc.WaitForReady(true))
+
+	<-called
+	cancel()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("RunGRPC() = %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("RunGRPC() didn't return after the shutdown timeout")
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// handleHealth reports the state of the upstream circuit breakers and proxies. It responds
+// with 200 even when SoundCloud is down, as restarting the server wouldn't help.
+func (s *Server) handleHealth() apiHandler {
+	type responseBody struct {
+		// Status is "ok", or "degraded" if a circuit breaker isn't closed or a proxy is evicted
+		Status   string          `json:"status"`
+		Upstream []hostSnapshot  `json:"upstream"`
+		Proxies  []proxySnapshot `json:"proxies"`
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		res := &responseBody{Status: "ok", Upstream: s.hosts.snapshot(), Proxies: s.proxies.snapshot()}
+		for _, host := range res.Upstream {
+			if host.state != breakerClosed {
+				res.Status = "degraded"
+			}
+		}
+		for _, proxy := range res.Proxies {
+			if proxy.Evicted {
+				res.Status = "degraded"
+			}
+		}
+
+		s.respondJSON(w, res, http.StatusOK)
+		return nil
+	}
+}
+
+// handleMetrics exposes the upstream stats, the outbound limiter queues and the proxies in
+// the Prometheus text format
+func (s *Server) handleMetrics() apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		hosts := s.hosts.snapshot()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		out := bufio.NewWriter(w)
+		defer out.Flush()
+
+		fmt.Fprintln(out, "# HELP downloadsound_upstream_requests_total Requests made to upstream hosts, by outcome.")
+		fmt.Fprintln(out, "# TYPE downloadsound_upstream_requests_total counter")
+		for _, host := range hosts {
+			outcomes := make([]string, 0, len(host.Outcomes))
+			for outcome := range host.Outcomes {
+				outcomes = append(outcomes, outcome)
+			}
+			sort.Strings(outcomes)
+
+			for _, outcome := range outcomes {
+				fmt.Fprintf(out, "downloadsound_upstream_requests_total{host=%s,outcome=%s} %d\n", strconv.Quote(host.Host), strconv.Quote(outcome), host.Outcomes[outcome])
+			}
+		}
+
+		fmt.Fprintln(out, "# HELP downloadsound_upstream_retries_total Retried requests to upstream hosts.")
+		fmt.Fprintln(out, "# TYPE downloadsound_upstream_retries_total counter")
+		for _, host := range hosts {
+			fmt.Fprintf(out, "downloadsound_upstream_retries_total{host=%s} %d\n", strconv.Quote(host.Host), host.Retries)
+		}
+
+		fmt.Fprintln(out, "# HELP downloadsound_upstream_circuit_state Circuit breaker state of upstream hosts, 0 is closed, 1 half-open and 2 open.")
+		fmt.Fprintln(out, "# TYPE downloadsound_upstream_circuit_state gauge")
+		for _, host := range hosts {
+			fmt.Fprintf(out, "downloadsound_upstream_circuit_state{host=%s} %d\n", strconv.Quote(host.Host), host.state)
+		}
+
+		fmt.Fprintln(out, "# HELP downloadsound_upstream_circuit_opens_total Times the circuit breaker of upstream hosts opened.")
+		fmt.Fprintln(out, "# TYPE downloadsound_upstream_circuit_opens_total counter")
+		for _, host := range hosts {
+			fmt.Fprintf(out, "downloadsound_upstream_circuit_opens_total{host=%s} %d\n", strconv.Quote(host.Host), host.Opens)
+		}
+
+		fmt.Fprintln(out, "# HELP downloadsound_upstream_queue_length Requests waiting for the outbound limiter, by lane.")
+		fmt.Fprintln(out, "# TYPE downloadsound_upstream_queue_length gauge")
+		lanes := s.outbound.snapshot()
+		for _, l := range lanes {
+			fmt.Fprintf(out, "downloadsound_upstream_queue_length{lane=%s} %d\n", strconv.Quote(l.lane.String()), l.queued)
+		}
+
+		fmt.Fprintln(out, "# HELP downloadsound_upstream_queue_wait_seconds Time requests waited for the outbound limiter, by lane.")
+		fmt.Fprintln(out, "# TYPE downloadsound_upstream_queue_wait_seconds histogram")
+		for _, l := range lanes {
+			name := strconv.Quote(l.lane.String())
+			for i, bound := range queueWaitBuckets {
+				fmt.Fprintf(out, "downloadsound_upstream_queue_wait_seconds_bucket{lane=%s,le=\"%g\"} %d\n", name, bound, l.buckets[i])
+			}
+			fmt.Fprintf(out, "downloadsound_upstream_queue_wait_seconds_bucket{lane=%s,le=\"+Inf\"} %d\n", name, l.count)
+			fmt.Fprintf(out, "downloadsound_upstream_queue_wait_seconds_sum{lane=%s} %g\n", name, l.sum)
+			fmt.Fprintf(out, "downloadsound_upstream_queue_wait_seconds_count{lane=%s} %d\n", name, l.count)
+		}
+
+		proxies := s.proxies.snapshot()
+		fmt.Fprintln(out, "# HELP downloadsound_proxy_requests_total Upstream requests sent through each proxy.")
+		fmt.Fprintln(out, "# TYPE downloadsound_proxy_requests_total counter")
+		for _, proxy := range proxies {
+			fmt.Fprintf(out, "downloadsound_proxy_requests_total{proxy=%s} %d\n", strconv.Quote(proxy.Proxy), proxy.Requests)
+		}
+
+		fmt.Fprintln(out, "# HELP downloadsound_proxy_errors_total Upstream requests through each proxy that failed or were blocked.")
+		fmt.Fprintln(out, "# TYPE downloadsound_proxy_errors_total counter")
+		for _, proxy := range proxies {
+			fmt.Fprintf(out, "downloadsound_proxy_errors_total{proxy=%s} %d\n", strconv.Quote(proxy.Proxy), proxy.Errors)
+		}
+
+		fmt.Fprintln(out, "# HELP downloadsound_proxy_evicted Whether each proxy is evicted for getting blocked.")
+		fmt.Fprintln(out, "# TYPE downloadsound_proxy_evicted gauge")
+		for _, proxy := range proxies {
+			evicted := 0
+			if proxy.Evicted {
+				evicted = 1
+			}
+			fmt.Fprintf(out, "downloadsound_proxy_evicted{proxy=%s} %d\n", strconv.Quote(proxy.Proxy), evicted)
+		}
+
+		return nil
+	}
+}
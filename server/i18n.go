@@ -0,0 +1,133 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLanguage is used when the client doesn't ask for a language we have, and for
+// messages missing from a translation
+const defaultLanguage = "en"
+
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// catalog holds the user-facing messages of every language, keyed by error code. Variants of
+// a message are keyed as "CODE.variant" and placeholders are written as {name}.
+type catalog map[string]map[string]string
+
+var messages = loadCatalog()
+
+// loadCatalog reads the embedded locale files, named after the language they contain
+func loadCatalog() catalog {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+
+	c := catalog{}
+	for _, f := range files {
+		data, err := localeFiles.ReadFile(path.Join("locales", f.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		lang := map[string]string{}
+		if err := json.Unmarshal(data, &lang); err != nil {
+			panic(fmt.Sprintf("invalid locale file %s: %s", f.Name(), err.Error()))
+		}
+		c[strings.TrimSuffix(f.Name(), ".json")] = lang
+	}
+
+	if _, ok := c[defaultLanguage]; !ok {
+		panic("missing locale file for " + defaultLanguage)
+	}
+
+	return c
+}
+
+// supports returns the language of the catalog matching tag, e.g. "pt" for "pt-BR"
+func (c catalog) supports(tag string) (string, bool) {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if _, ok := c[tag]; ok {
+		return tag, true
+	}
+
+	base := strings.SplitN(tag, "-", 2)[0]
+	_, ok := c[base]
+	return base, ok
+}
+
+// render returns the message for key in lang, falling back to English when it isn't translated
+func (c catalog) render(lang string, key string, params map[string]string) string {
+	message, ok := c[lang][key]
+	if !ok {
+		message, ok = c[defaultLanguage][key]
+	}
+	if !ok {
+		return key
+	}
+
+	for name, value := range params {
+		message = strings.ReplaceAll(message, "{"+name+"}", value)
+	}
+
+	return message
+}
+
+// negotiate picks the supported language the client prefers most from an Accept-Language header
+func (c catalog) negotiate(acceptLanguage string) string {
+	type preference struct {
+		lang string
+		q    float64
+	}
+
+	prefs := []preference{}
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(part, ";")
+		q := 1.0
+		for _, param := range fields[1:] {
+			if value := strings.TrimSpace(param); strings.HasPrefix(value, "q=") {
+				if parsed, err := strconv.ParseFloat(value[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		if lang, ok := c.supports(fields[0]); ok && q > 0 {
+			prefs = append(prefs, preference{lang, q})
+		}
+	}
+
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	if len(prefs) == 0 {
+		return defaultLanguage
+	}
+
+	return prefs[0].lang
+}
+
+// language returns the language to respond to a request in. A lang field in the body takes
+// precedence over a lang query parameter, which takes precedence over Accept-Language.
+func language(r *http.Request, requested string) string {
+	if requested == "" {
+		if body, ok := requestBody(r); ok {
+			requested = body.Lang
+		}
+	}
+	if requested == "" {
+		requested = r.URL.Query().Get("lang")
+	}
+
+	if lang, ok := messages.supports(requested); ok {
+		return lang
+	}
+
+	return messages.negotiate(r.Header.Get("Accept-Language"))
+}
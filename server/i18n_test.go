@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var placeholderRegex = regexp.MustCompile(`\{[a-z]+\}`)
+
+func TestCatalogHasEveryErrorCode(t *testing.T) {
+	for code := range errorStatuses {
+		if _, ok := messages[defaultLanguage][string(code)]; !ok {
+			t.Errorf("%s has no %s message", code, defaultLanguage)
+		}
+	}
+}
+
+func TestTranslationsMatchEnglish(t *testing.T) {
+	for lang, translated := range messages {
+		for key, message := range translated {
+			english, ok := messages[defaultLanguage][key]
+			if !ok {
+				t.Errorf("%s: %s isn't an English message", lang, key)
+				continue
+			}
+
+			got, want := placeholderRegex.FindAllString(message, -1), placeholderRegex.FindAllString(english, -1)
+			sort.Strings(got)
+			sort.Strings(want)
+			if strings.Join(got, ",") != strings.Join(want, ",") {
+				t.Errorf("%s: %s has placeholders %v, want %v", lang, key, got, want)
+			}
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	c := catalog{
+		"en": {"GREETING": "Hello {name}", "ENGLISH_ONLY": "Only in English"},
+		"de": {"GREETING": "Hallo {name}"},
+	}
+
+	tests := []struct {
+		lang string
+		key  string
+		want string
+	}{
+		{"de", "GREETING", "Hallo Ada"},
+		{"en", "GREETING", "Hello Ada"},
+		{"de", "ENGLISH_ONLY", "Only in English"},
+		{"xx", "GREETING", "Hello Ada"},
+		{"de", "MISSING", "MISSING"},
+	}
+
+	for _, test := range tests {
+		if got := c.render(test.lang, test.key, map[string]string{"name": "Ada"}); got != test.want {
+			t.Errorf("render(%s, %s) = %q, want %q", test.lang, test.key, got, test.want)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		acceptLanguage string
+		want           string
+	}{
+		{"", "en"},
+		{"de", "de"},
+		{"pt-BR,pt;q=0.9", "pt"},
+		{"ja, fr;q=0.5, de;q=0.8", "de"},
+		{"FR-ca", "fr"},
+		{"de;q=0, es", "es"},
+		{"ja, zh", "en"},
+	}
+
+	for _, test := range tests {
+		if got := messages.negotiate(test.acceptLanguage); got != test.want {
+			t.Errorf("negotiate(%q) = %s, want %s", test.acceptLanguage, got, test.want)
+		}
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	tests := []struct {
+		name      string
+		path      string
+		body      string
+		requested string
+		want      string
+	}{
+		{"Accept-Language", "/v1/track", "", "", "de"},
+		{"query", "/v1/track?lang=fr", "", "", "fr"},
+		{"body", "/v1/track?lang=fr", `{"url":"x","lang":"es"}`, "", "es"},
+		{"requested", "/v1/track?lang=fr", `{"url":"x","lang":"es"}`, "pt-BR", "pt"},
+		{"unsupported", "/v1/track?lang=ja", "", "", "de"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", test.path, strings.NewReader(test.body))
+		r.Header.Set("Accept-Language", "de")
+		if test.body != "" {
+			body := &urlRequestBody{}
+			if err := json.Unmarshal([]byte(test.body), body); err != nil {
+				t.Fatal(err)
+			}
+			r = r.WithContext(context.WithValue(r.Context(), ContextBody, body))
+		}
+
+		if got := language(r, test.requested); got != test.want {
+			t.Errorf("%s: language() = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestErrorsAreLocalized(t *testing.T) {
+	s := newTestServer(t, nil)
+	handler := s.handler()
+
+	tests := []struct {
+		acceptLanguage string
+		lang           string
+	}{
+		{"de-DE,de;q=0.9", "de"},
+		{"ja", "en"},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/v1/track", strings.NewReader(`{"url":"https://example.com/track"}`))
+		r.Header.Set("Accept-Language", test.acceptLanguage)
+		handler.ServeHTTP(w, r)
+
+		if got := w.Header().Get("Content-Language"); got != test.lang {
+			t.Errorf("%s: Content-Language = %q, want %s", test.acceptLanguage, got, test.lang)
+		}
+
+		res := errResponse{}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if want := messages.render(test.lang, "INVALID_URL.not_track", nil); res.Code != codeInvalidURL || res.Err != want {
+			t.Errorf("%s: got %+v, want %q", test.acceptLanguage, res, want)
+		}
+	}
+}
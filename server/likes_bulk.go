@@ -58,9 +58,10 @@ func (s *Server) getLikesBulk(ctx context.Context, arr *[]soundcloudapi.Like, op
 */
 
 func (s *Server) getLikesBulk(ctx context.Context, arr *[]soundcloudapi.Like, options soundcloudapi.GetLikesOptions) error {
+	api := s.soundcloud(ctx)
 	i := 0
 	for {
-		likes, err := s.scdl.GetLikes(options)
+		likes, err := api.GetLikes(options)
 		if err != nil {
 			return err
 		}
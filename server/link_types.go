@@ -7,3 +7,16 @@ const (
 	linkTypePlaylist
 	linkTypeLikes
 )
+
+func (l linkType) String() string {
+	switch l {
+	case linkTypeTrack:
+		return "track"
+	case linkTypePlaylist:
+		return "playlist"
+	case linkTypeLikes:
+		return "likes"
+	}
+
+	return "unknown"
+}
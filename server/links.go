@@ -0,0 +1,231 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// downloadLink is what a signed download link grants, it is encoded into the link itself
+type downloadLink struct {
+	TrackID int64  `json:"t"`
+	Format  string `json:"f,omitempty"`
+	// SecretToken is the secret token of a private track, the client already has it
+	SecretToken string `json:"s,omitempty"`
+	// Original is set for links to the original file rather than a transcoding
+	Original bool `json:"o,omitempty"`
+	// IP is the client the link was issued to, if links are bound to clients
+	IP      string `json:"ip,omitempty"`
+	Expires int64  `json:"e"`
+}
+
+// formats returns the format preferences the media of link is resolved with
+func (l *downloadLink) formats() []string {
+	if l.Format == "" {
+		return nil
+	}
+
+	return []string{l.Format}
+}
+
+// linkIssuer is what signed links are issued with, it is in the context of requests that get
+// signed links rather than SoundCloud's
+type linkIssuer struct {
+	// base is the origin and version prefix of the links, e.g. https://api.example.com/v1
+	base string
+	ip   string
+}
+
+var errInvalidLink = errors.New("Invalid download link")
+
+// signLink encodes link and signs it with secret, as the payload and the signature in base64
+// separated by a dot
+func signLink(secret string, link downloadLink) string {
+	payload, _ := json.Marshal(link)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(linkSignature(secret, encoded))
+}
+
+// verifyLink decodes a link signed with secret, it doesn't check whether the link expired
+func verifyLink(secret string, token string) (*downloadLink, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, errInvalidLink
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(signature, linkSignature(secret, parts[0])) {
+		return nil, errInvalidLink
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errInvalidLink
+	}
+
+	link := &downloadLink{}
+	if err := json.Unmarshal(payload, link); err != nil || link.TrackID == 0 {
+		return nil, errInvalidLink
+	}
+
+	return link, nil
+}
+
+func linkSignature(secret string, payload string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// issueLinks makes the tracks resolved by a request point at signed download links of the
+// API instead of SoundCloud's CDN, if a download link secret is configured
+func (s *Server) issueLinks(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+		if cfg.DownloadLinkSecret == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The links point at the configured URL, the Host header is up to the client
+		base := fmt.Sprintf("%s/v%d", strings.TrimRight(cfg.PublicURL, "/"), requestVersion(r))
+		issuer := &linkIssuer{base: base}
+		if cfg.DownloadLinkBindIP {
+			issuer.ip = s.clientKey(r)
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ContextLinkIssuer, issuer)))
+	}
+}
+
+// grpcIssueLinks is issueLinks for gRPC calls, whose links point at the v1 download routes
+func (s *Server) grpcIssueLinks(ctx context.Context) context.Context {
+	cfg := s.cfg()
+	if cfg.DownloadLinkSecret == "" {
+		return ctx
+	}
+
+	issuer := &linkIssuer{base: strings.TrimRight(cfg.PublicURL, "/") + "/v1"}
+	if cfg.DownloadLinkBindIP {
+		issuer.ip = s.grpcClientKey(ctx)
+	}
+
+	return context.WithValue(ctx, ContextLinkIssuer, issuer)
+}
+
+// signedLink returns the signed download link of a track, or "" if the tracks of ctx keep
+// SoundCloud's links. Links aren't issued for requests made on behalf of a user, the OAuth
+// token they need to be resolved again can't be put in them.
+func (s *Server) signedLink(ctx context.Context, link downloadLink) string {
+	issuer, ok := ctx.Value(ContextLinkIssuer).(*linkIssuer)
+	if !ok || oauthToken(ctx) != "" {
+		return ""
+	}
+
+	cfg := s.cfg()
+	link.IP = issuer.ip
+	link.Expires = time.Now().Add(cfg.DownloadLinkTTL.Duration).Unix()
+	return issuer.base + "/download/link/" + signLink(cfg.DownloadLinkSecret, link)
+}
+
+// signTrack replaces the links of a resolved track with signed ones. The links always serve
+// the whole file, so HLS tracks aren't HLS anymore.
+func (s *Server) signTrack(ctx context.Context, track *trackInfo) {
+	link := s.signedLink(ctx, downloadLink{TrackID: track.id, Format: track.Format, SecretToken: track.secretToken})
+	if link == "" {
+		return
+	}
+
+	track.URL = link
+	track.HLS = false
+	if track.Original != nil {
+		original := *track.Original
+		original.URL = s.signedLink(ctx, downloadLink{TrackID: track.id, SecretToken: track.secretToken, Original: true})
+		track.Original = &original
+	}
+}
+
+// resolveOriginalSource returns the signed URL of the original file of a track, which isn't
+// cached as it is rarely downloaded more than once
+func (s *Server) resolveOriginalSource(ctx context.Context, trackID int64, secretToken string) (*mediaSource, error) {
+	original, err := s.getOriginalFile(ctx, trackID, secretToken)
+	if err != nil {
+		return nil, upstreamError(err, codeTrackNotFound)
+	}
+
+	source := &mediaSource{
+		url:         original.URL,
+		filename:    sanitizeFilename(original.Filename),
+		contentType: "application/octet-stream",
+		expires:     time.Now().Add(mediaURLLifetime),
+		pin:         &proxyPin{},
+	}
+	source.transcoding.Format.Protocol = "progressive"
+	if source.filename == "" {
+		source.filename = fmt.Sprintf("%d", trackID)
+	}
+
+	return source, nil
+}
+
+// resolveLinkSource returns the source a signed link points at
+func (s *Server) resolveLinkSource(ctx context.Context, link *downloadLink, refresh bool) (*mediaSource, error) {
+	if link.Original {
+		return s.resolveOriginalSource(ctx, link.TrackID, link.SecretToken)
+	}
+
+	return s.resolveMediaSource(ctx, link.TrackID, link.formats(), link.SecretToken, refresh)
+}
+
+// handleSignedDownload proxies the media of a signed download link. Links that expired less
+// than the grace period ago are still served if the track is still available, it is resolved
+// again rather than trusting what the link was issued for.
+func (s *Server) handleSignedDownload() apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		cfg := s.cfg()
+		if cfg.DownloadLinkSecret == "" {
+			return newAPIError(codeDownloadLinkInvalid)
+		}
+
+		link, err := verifyLink(cfg.DownloadLinkSecret, mux.Vars(r)["token"])
+		if err != nil {
+			return newAPIError(codeDownloadLinkInvalid).wrap(err)
+		}
+
+		if link.IP != "" && link.IP != s.clientKey(r) {
+			return newAPIError(codeDownloadLinkInvalid).variant("ip")
+		}
+
+		expired := time.Now().After(time.Unix(link.Expires, 0))
+		if expired && time.Now().After(time.Unix(link.Expires, 0).Add(cfg.DownloadLinkGrace.Duration)) {
+			return newAPIError(codeDownloadLinkExpired)
+		}
+
+		// Originals aren't cached, so every range of them is charged
+		key := ""
+		if !link.Original {
+			key = mediaCacheKey(link.TrackID, link.formats(), link.SecretToken)
+		}
+		if err := s.chargeDownload(w, r, key); err != nil {
+			return err
+		}
+
+		source, err := s.resolveLinkSource(r.Context(), link, expired)
+		if err != nil {
+			return err
+		}
+
+		return s.serveMedia(w, r, link.TrackID, source, func() (*mediaSource, error) {
+			return s.resolveLinkSource(r.Context(), link, true)
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLinkTestServer(t *testing.T) *Server {
+	return newTestServer(t, func(cfg *Config) {
+		cfg.DownloadLinkSecret = "secret"
+		cfg.PublicURL = "https://api.example.com/"
+		cfg.DownloadLinkBindIP = true
+		cfg.TrustedProxies = []string{"10.0.0.1"}
+	})
+}
+
+func TestIssueLinksUsesPublicURL(t *testing.T) {
+	s := newLinkTestServer(t)
+
+	var issuer *linkIssuer
+	handler := s.issueLinks(func(w http.ResponseWriter, r *http.Request) {
+		issuer, _ = r.Context().Value(ContextLinkIssuer).(*linkIssuer)
+	})
+
+	req := httptest.NewRequest("POST", "http://evil.example.com/v1/track", nil)
+	req.Header.Set("X-Forwarded-Proto", "gopher")
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.RemoteAddr = "203.0.113.7:4000"
+	handler(httptest.NewRecorder(), req)
+
+	if issuer == nil {
+		t.Fatal("no link issuer in the context")
+	}
+	if issuer.base != "https://api.example.com/v1" {
+		t.Errorf("base = %q, want the public URL", issuer.base)
+	}
+	if issuer.ip != "203.0.113.7" {
+		t.Errorf("ip = %q, want the untrusted peer rather than X-Forwarded-For", issuer.ip)
+	}
+}
+
+func TestSignedDownloadRejections(t *testing.T) {
+	s := newLinkTestServer(t)
+	ctx := context.WithValue(context.Background(), ContextLinkIssuer, &linkIssuer{base: "https://api.example.com/v1", ip: "203.0.113.7"})
+	link := s.signedLink(ctx, downloadLink{TrackID: 5, Format: "mp3_progressive"})
+	token := link[strings.LastIndex(link, "/")+1:]
+
+	expired := signLink("secret", downloadLink{TrackID: 5, Expires: time.Now().Add(-48 * time.Hour).Unix()})
+	forged := signLink("other", downloadLink{TrackID: 5, Expires: time.Now().Add(time.Hour).Unix()})
+
+	tests := []struct {
+		name      string
+		token     string
+		remote    string
+		forwarded string
+		status    int
+		code      errorCode
+	}{
+		{"forged", forged, "203.0.113.7:4000", "", http.StatusForbidden, codeDownloadLinkInvalid},
+		{"tampered", token[:len(token)-2] + "xx", "203.0.113.7:4000", "", http.StatusForbidden, codeDownloadLinkInvalid},
+		{"other client", token, "198.51.100.1:4000", "", http.StatusForbidden, codeDownloadLinkInvalid},
+		{"spoofed forwarded for", token, "198.51.100.1:4000", "203.0.113.7", http.StatusForbidden, codeDownloadLinkInvalid},
+		{"expired past grace", expired, "203.0.113.7:4000", "", http.StatusGone, codeDownloadLinkExpired},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/v1/download/link/"+test.token, nil)
+			req.RemoteAddr = test.remote
+			if test.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", test.forwarded)
+			}
+			w := httptest.NewRecorder()
+			s.handler().ServeHTTP(w, req)
+
+			if w.Code != test.status || !strings.Contains(w.Body.String(), string(test.code)) {
+				t.Errorf("got %d %s, want %d %s", w.Code, w.Body.String(), test.status, test.code)
+			}
+		})
+	}
+}
+
+func TestDownloadLinksNeedPublicURL(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.FrontendURL = "http://frontend.test"
+	cfg.DownloadLinkSecret = "secret"
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "publicURL") {
+		t.Errorf("Validate() = %v, want publicURL to be required", err)
+	}
+}
+
+func TestSignedDownloadRangesAreChargedUnlessCached(t *testing.T) {
+	s, _ := newDownloadTestServer(t, func(cfg *Config) {
+		cfg.DownloadLinkSecret = "secret"
+		cfg.PublicURL = "https://api.example.com"
+		cfg.RateLimitPerMinute = 1
+		cfg.RateLimitBurst = 1
+	})
+	handler := s.handler()
+	expires := time.Now().Add(time.Hour).Unix()
+
+	tests := []struct {
+		name   string
+		link   downloadLink
+		status int
+	}{
+		{"uncached range", downloadLink{TrackID: 1, Expires: expires}, http.StatusOK},
+		{"cached range", downloadLink{TrackID: 1, Expires: expires}, http.StatusOK},
+		{"range of the original", downloadLink{TrackID: 1, Original: true, Expires: expires}, http.StatusTooManyRequests},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/v1/download/link/"+signLink("secret", test.link), nil)
+		req.Header.Set("Range", "bytes=1-")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
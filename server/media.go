@@ -1,41 +1,60 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
 )
 
 type getMediaURLResponse struct {
 	URL string `json:"url"`
 }
 
-type failedRequestError struct {
-	status int
-	errMsg string
+// originalFile is the file the uploader originally uploaded, available when they enabled downloads
+type originalFile struct {
+	URL      string `json:"url"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size,omitempty"`
 }
 
-type errResponse struct {
-	Err string `json:"err"`
-}
+const trackDownloadURL = "https://api-v2.soundcloud.com/tracks/%d/download"
 
-func (f *failedRequestError) Error() string {
-	if f.errMsg == "" {
-		return fmt.Sprintf("Request returned non 2xx status: %d", f.status)
-	}
-
-	return fmt.Sprintf("Request failed with status %d: %s", f.status, f.errMsg)
-}
+var contentRangeSizeRegex = regexp.MustCompile(`/(\d+)$`)
 
 type trackInfo struct {
-	Title    string `json:"title"`
-	URL      string `json:"url"`
-	HLS      bool   `json:"hls"`
-	Author   string `json:"author"`
-	ImageURL string `json:"imageURL"`
+	Title        string            `json:"title"`
+	URL          string            `json:"url"`
+	HLS          bool              `json:"hls"`
+	Author       string            `json:"author"`
+	ImageURL     string            `json:"imageURL"`
+	Format       string            `json:"format"`
+	Transcodings []transcodingInfo `json:"transcodings"`
+	Original     *originalFile     `json:"original,omitempty"`
+	// Permalink is the URL of the track on SoundCloud, URL is replaced by the media URL
+	Permalink string `json:"permalink"`
+	// Private is set for tracks shared with a secret token
+	Private bool `json:"private"`
+	// Unlocked is set for tracks that could only be resolved with the user's OAuth token
+	Unlocked bool `json:"unlocked"`
+	trackMetadata
+
+	id             int64
+	downloadable   bool
+	transcodingURL string
+	waveformURL    string
+	secretToken    string
+	// regional is set if the track is geo-blocked here and is resolved through the regional proxy
+	regional bool
 }
 
 // getIMGURL returns the URL to download the image specified by the given url.
@@ -51,24 +70,39 @@ func (s *Server) getIMGURL(url string) string {
 	return string([]rune(url)[0:strings.LastIndex(url, "-")]) + "-t500x500.jpg"
 }
 
-// getMediaURL returns the URL to download the given SoundCloud resource
-func (s *Server) getMediaURL(url string) (string, error) {
-	res, err := http.Get(url + "?client_id=" + s.scdl.ClientID())
+// getMediaURL returns the URL to download the given SoundCloud transcoding, secretToken is
+// required for private tracks
+func (s *Server) getMediaURL(ctx context.Context, transcodingURL string, secretToken string) (string, error) {
+	u, err := url.Parse(withSecretToken(transcodingURL, secretToken))
 	if err != nil {
-		if data, err := ioutil.ReadAll(res.Body); err == nil {
-			return "", &failedRequestError{status: res.StatusCode, errMsg: string(data)}
-		}
-		return "", &failedRequestError{status: res.StatusCode}
+		return "", err
+	}
+	q := u.Query()
+	q.Set("client_id", s.scdl.ClientID())
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode < 200 || res.StatusCode > 299 {
 		if data, err := ioutil.ReadAll(res.Body); err == nil {
-			return "", &failedRequestError{status: res.StatusCode, errMsg: string(data)}
+			return "", &soundcloudapi.FailedRequestError{Status: res.StatusCode, ErrMsg: string(data)}
 		}
-		return "", &failedRequestError{status: res.StatusCode}
+		return "", &soundcloudapi.FailedRequestError{Status: res.StatusCode}
 	}
 
 	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
 
 	body := &getMediaURLResponse{}
 
@@ -85,42 +119,130 @@ func (s *Server) getMediaURL(url string) (string, error) {
 	return body.URL, nil
 }
 
-// getMediaURLMany concurrently fetches all the URLs for the given tracks
-// and sets each tracks URL
-func (s *Server) getMediaURLMany(urls []trackInfo) ([]trackInfo, error) {
-	if len(urls) == 0 {
-		return nil, errors.New("No URLs provided")
+// isDownloadable returns true if the uploader of the track allows downloading the original file
+func isDownloadable(track soundcloudapi.Track) bool {
+	return track.Downloadable && track.HasDownloadsLeft
+}
+
+// getOriginalFile returns the link to the original file of a downloadable track along with
+// its filename and size when SoundCloud provides them. secretToken is required for private
+// tracks.
+func (s *Server) getOriginalFile(ctx context.Context, trackID int64, secretToken string) (*originalFile, error) {
+	u, err := url.Parse(withSecretToken(fmt.Sprintf(trackDownloadURL, trackID), secretToken))
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("client_id", s.scdl.ClientID())
+	u.RawQuery = q.Encode()
+
+	downloadReq, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.httpClient.Do(downloadReq)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, &soundcloudapi.FailedRequestError{Status: res.StatusCode}
+	}
+
+	body := &soundcloudapi.DownloadURLResponse{}
+	if err := json.NewDecoder(res.Body).Decode(body); err != nil || body.URL == "" {
+		return nil, errors.New("Invalid download response")
+	}
+
+	original := &originalFile{URL: body.URL}
+
+	// Only ask for the first byte, we just want the headers
+	req, err := http.NewRequestWithContext(ctx, "GET", body.URL, nil)
+	if err != nil {
+		return original, nil
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	fileRes, err := s.httpClient.Do(req)
+	if err != nil {
+		return original, nil
+	}
+	fileRes.Body.Close()
+
+	if _, params, err := mime.ParseMediaType(fileRes.Header.Get("Content-Disposition")); err == nil {
+		original.Filename = params["filename"]
+	}
+
+	if match := contentRangeSizeRegex.FindStringSubmatch(fileRes.Header.Get("Content-Range")); match != nil {
+		original.Size, _ = strconv.ParseInt(match[1], 10, 64)
+	} else if fileRes.StatusCode == http.StatusOK && fileRes.ContentLength > 0 {
+		original.Size = fileRes.ContentLength
 	}
+
+	return original, nil
+}
+
+// getMediaURLMany concurrently fetches the download URLs for the selected transcoding
+// of each track and sets each tracks URL, original file and waveform. The requests are made
+// in the bulk lane of the outbound limiter, and given up on as soon as one fails.
+func (s *Server) getMediaURLMany(ctx context.Context, urls []trackInfo, opts resolveOptions) ([]trackInfo, error) {
+	ctx, cancel := context.WithCancel(withLane(ctx, laneBulk))
+	defer cancel()
+
 	type result struct {
-		url   string
-		index int
+		url      string
+		original *originalFile
+		waveform []float64
+		index    int
 	}
 	resChan := make(chan result, len(urls))
-	errChan := make(chan error)
+	errChan := make(chan error, len(urls))
 
 	for i, d := range urls {
-		go func(i int, url string) {
-			mediaURL, err := s.scdl.GetDownloadURL(url, "progressive")
+		go func(i int, d trackInfo) {
+			ctx := ctx
+			if d.regional {
+				ctx = s.regionalContext(ctx)
+			}
+
+			mediaURL, err := s.getMediaURL(ctx, d.transcodingURL, d.secretToken)
 			if err != nil {
 				errChan <- err
 				return
 			}
-			resChan <- result{url: mediaURL, index: i}
-		}(i, d.URL)
+
+			var original *originalFile
+			if d.downloadable {
+				// The transcoded stream is still usable, so don't fail the whole request
+				original, err = s.getOriginalFile(ctx, d.id, d.secretToken)
+				if err != nil {
+					fmt.Println(err.Error())
+				}
+			}
+
+			// Neither is the waveform, it's only used for previews
+			waveform, err := s.getWaveform(ctx, d.waveformURL, opts.bars(true))
+			if err != nil {
+				fmt.Println(err.Error())
+			}
+			resChan <- result{url: mediaURL, original: original, waveform: waveform, index: i}
+		}(i, d)
 	}
 
-	count := 0
-	for {
+	for count := 0; count < len(urls); count++ {
 		select {
 		case err := <-errChan:
 			return nil, err
 		case res := <-resChan:
 			urls[res.index].URL = res.url
-			count++
-		}
-
-		if count == len(urls) {
-			break
+			urls[res.index].Original = res.original
+			urls[res.index].Waveform = res.waveform
+			s.signTrack(ctx, &urls[res.index])
+			if opts.onTrack != nil {
+				opts.onTrack(urls[res.index])
+			}
 		}
 	}
 
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+func TestIsDownloadable(t *testing.T) {
+	tests := []struct {
+		track soundcloudapi.Track
+		want  bool
+	}{
+		{soundcloudapi.Track{Downloadable: true, HasDownloadsLeft: true}, true},
+		{soundcloudapi.Track{Downloadable: true}, false},
+		{soundcloudapi.Track{HasDownloadsLeft: true}, false},
+	}
+
+	for _, test := range tests {
+		if got := isDownloadable(test.track); got != test.want {
+			t.Errorf("isDownloadable(%+v) = %t, want %t", test.track, got, test.want)
+		}
+	}
+}
+
+func TestGetOriginalFile(t *testing.T) {
+	const fileURL = "https://cf-media.sndcdn.com/original.wav"
+	tests := []struct {
+		name     string
+		file     http.HandlerFunc
+		filename string
+		size     int64
+	}{
+		{"partial content", func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") != "bytes=0-0" {
+				t.Errorf("got Range %q, want only the first byte", r.Header.Get("Range"))
+			}
+			w.Header().Set("Content-Disposition", `attachment; filename="Track One.wav"`)
+			w.Header().Set("Content-Range", "bytes 0-0/52428800")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write([]byte{0})
+		}, "Track One.wav", 52428800},
+		{"ranges not supported", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Length", "4")
+			w.Write([]byte("RIFF"))
+		}, "", 4},
+		{"unknown size", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("RIFF"))
+		}, "", 0},
+		{"file unavailable", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		}, "", 0},
+	}
+
+	for _, test := range tests {
+		s, upstream := newUpstreamTestServer(t, nil)
+		upstream.handle("api-v2.soundcloud.com/tracks/1/download", respondWithJSON(map[string]string{"redirectUri": fileURL}))
+		upstream.handle("cf-media.sndcdn.com/original.wav", test.file)
+
+		original, err := s.getOriginalFile(context.Background(), 1, "")
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		// The link is returned even if the details of the file can't be read
+		if original.URL != fileURL || original.Filename != test.filename || original.Size != test.size {
+			t.Errorf("%s: got %+v, want %s named %q of %d bytes", test.name, original, fileURL, test.filename, test.size)
+		}
+	}
+}
+
+func TestGetOriginalFileFails(t *testing.T) {
+	s, upstream := newUpstreamTestServer(t, nil)
+	upstream.handle("api-v2.soundcloud.com/tracks/2/download", respondWithJSON(map[string]string{}))
+
+	if _, err := s.getOriginalFile(context.Background(), 1, ""); err == nil {
+		t.Error("got no error for a track without a download")
+	}
+	if _, err := s.getOriginalFile(context.Background(), 2, ""); err == nil {
+		t.Error("got no error for a download response without a link")
+	}
+}
+
+func TestTrackListsTheOriginalFile(t *testing.T) {
+	tests := []struct {
+		name         string
+		downloadable bool
+		downloadsOK  bool
+		original     bool
+	}{
+		{"downloadable", true, true, true},
+		{"not downloadable", false, true, false},
+		{"download failed", true, false, false},
+	}
+
+	for _, test := range tests {
+		s, upstream := newSoundCloudStandIn(t, nil)
+		track := standInTrack(1, "Track One", "")
+		track["downloadable"] = test.downloadable
+		track["has_downloads_left"] = true
+		upstream.handle("api-v2.soundcloud.com/resolve", respondWithJSON(track))
+		if test.downloadsOK {
+			upstream.handle("api-v2.soundcloud.com/tracks/1/download", respondWithJSON(map[string]string{"redirectUri": "https://cf-media.sndcdn.com/original.wav"}))
+		}
+
+		w := httptest.NewRecorder()
+		s.handler().ServeHTTP(w, httptest.NewRequest("POST", "/v2/track", strings.NewReader(urlBody(standInTrackURL))))
+		// The transcoded stream is still served when the original can't be
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s, want 200", test.name, w.Code, w.Body.String())
+		}
+
+		res := struct {
+			URL      string        `json:"url"`
+			Original *originalFile `json:"original"`
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if (res.Original != nil) != test.original || res.URL == "" {
+			t.Errorf("%s: got %+v, want an original file: %t", test.name, res, test.original)
+		}
+		if test.original && res.Original.URL != "https://cf-media.sndcdn.com/original.wav" {
+			t.Errorf("%s: original = %+v", test.name, res.Original)
+		}
+	}
+}
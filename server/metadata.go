@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+const (
+	// defaultWaveformBars is how many bars the waveform of a single track is downsampled to
+	// unless the client asks otherwise
+	defaultWaveformBars = 100
+	// maxWaveformBars is the most bars a waveform can be downsampled to
+	maxWaveformBars = 1800
+)
+
+var bpmRegex = regexp.MustCompile(`(?i)\b(\d{2,3})\s?bpm\b`)
+
+// trackMetadata is descriptive information about a track used to render previews
+type trackMetadata struct {
+	DurationMS    int64     `json:"durationMS"`
+	Waveform      []float64 `json:"waveform,omitempty"`
+	Genre         string    `json:"genre"`
+	Tags          []string  `json:"tags"`
+	Label         string    `json:"label,omitempty"`
+	BPM           int       `json:"bpm,omitempty"`
+	PlaybackCount int64     `json:"playbackCount"`
+	LikesCount    int64     `json:"likesCount"`
+	CreatedAt     string    `json:"createdAt"`
+}
+
+type waveformResponse struct {
+	Width   int   `json:"width"`
+	Height  int   `json:"height"`
+	Samples []int `json:"samples"`
+}
+
+// parseTags splits SoundCloud's tag list, where tags containing spaces are quoted
+func parseTags(tagList string) []string {
+	tags := []string{}
+	for i, part := range strings.Split(tagList, `"`) {
+		if i%2 == 1 {
+			if part = strings.TrimSpace(part); part != "" {
+				tags = append(tags, part)
+			}
+			continue
+		}
+		tags = append(tags, strings.Fields(part)...)
+	}
+
+	return tags
+}
+
+// findBPM looks for a tempo like "128bpm" in the track's tags and title, returning 0 if there is none
+func findBPM(track soundcloudapi.Track) int {
+	for _, text := range []string{track.TagList, track.Title} {
+		if match := bpmRegex.FindStringSubmatch(text); match != nil {
+			bpm, _ := strconv.Atoi(match[1])
+			return bpm
+		}
+	}
+
+	return 0
+}
+
+// getTrackMetadata returns the metadata of a track, the waveform is filled in separately
+func getTrackMetadata(track soundcloudapi.Track) trackMetadata {
+	duration := track.FullDurationMS
+	if duration == 0 {
+		duration = track.DurationMS
+	}
+
+	return trackMetadata{
+		DurationMS:    duration,
+		Genre:         track.Genre,
+		Tags:          parseTags(track.TagList),
+		Label:         track.LabelName,
+		BPM:           findBPM(track),
+		PlaybackCount: track.PlaybackCount,
+		LikesCount:    track.LikesCount,
+		CreatedAt:     track.CreatedAt,
+	}
+}
+
+// downsample averages samples into the given number of bars, scaled between 0 and 1
+func downsample(samples []int, height int, bars int) []float64 {
+	if len(samples) == 0 || height <= 0 {
+		return nil
+	}
+
+	if bars > len(samples) {
+		bars = len(samples)
+	}
+
+	waveform := make([]float64, bars)
+	for i := range waveform {
+		start := i * len(samples) / bars
+		end := (i + 1) * len(samples) / bars
+
+		sum := 0
+		for _, sample := range samples[start:end] {
+			sum += sample
+		}
+
+		avg := float64(sum) / float64(end-start) / float64(height)
+		waveform[i] = math.Round(avg*1000) / 1000
+	}
+
+	return waveform
+}
+
+// getWaveform fetches the waveform of a track and downsamples it to the given number of bars
+func (s *Server) getWaveform(ctx context.Context, waveformURL string, bars int) ([]float64, error) {
+	if waveformURL == "" || bars <= 0 {
+		return nil, nil
+	}
+
+	// Older tracks link to a PNG, but the same samples are available as JSON
+	if strings.HasSuffix(waveformURL, ".png") {
+		waveformURL = strings.TrimSuffix(waveformURL, ".png") + ".json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", waveformURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &soundcloudapi.FailedRequestError{Status: res.StatusCode}
+	}
+
+	waveform := &waveformResponse{}
+	if err := json.NewDecoder(res.Body).Decode(waveform); err != nil {
+		return nil, err
+	}
+
+	if bars > maxWaveformBars {
+		bars = maxWaveformBars
+	}
+
+	return downsample(waveform.Samples, waveform.Height, bars), nil
+}
@@ -2,15 +2,39 @@ package server
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"net/http"
-	"net/url"
+	"strings"
 
 	soundcloudapi "github.com/zackradisic/soundcloud-api"
 )
 
 type urlRequestBody struct {
 	URL string `json:"url"`
+	// Formats are the preferred formats to download in order, see matchesFormat
+	Formats []string `json:"formats"`
+	// WaveformBars is how many bars to downsample waveforms to, 0 disables waveforms
+	WaveformBars *int `json:"waveformBars"`
+	// Lang is the language of error messages, see language
+	Lang string `json:"lang"`
+	// Manifest is the manifest of a previous response to sync with, see syncManifest
+	Manifest *syncManifest `json:"manifest"`
+}
+
+// options returns the options to resolve the requested resource with. Syncing is only
+// supported from v2, as v1 responses don't include removed tracks, and v1 responses have
+// no waveforms to fetch.
+func (b *urlRequestBody) options(version apiVersion) resolveOptions {
+	opts := newResolveOptions(b.Formats, b.WaveformBars, b.Lang)
+	if version == apiV1 {
+		noWaveforms := 0
+		opts.waveformBars = &noWaveforms
+		return opts
+	}
+
+	opts.manifest = b.Manifest
+	return opts
 }
 
 func (s *Server) validateLink(link linkType, next http.HandlerFunc) http.HandlerFunc {
@@ -21,76 +45,18 @@ func (s *Server) validateLink(link linkType, next http.HandlerFunc) http.Handler
 		err := decoder.Decode(body)
 
 		if err != nil {
-			s.respondError(w, "Invalid request body", http.StatusBadRequest)
+			s.respondError(w, r, newAPIError(codeInvalidRequest))
 			return
 		}
 
-		if soundcloudapi.IsFirebaseURL(body.URL) {
-			url, err := soundcloudapi.ConvertFirebaseLink(body.URL)
-			if err != nil {
-				s.respondError(w, "Invalid URL", http.StatusUnprocessableEntity)
-				return
-			}
-
-			body.URL = url
-		} else if soundcloudapi.IsMobileURL(body.URL) {
-			body.URL = soundcloudapi.StripMobilePrefix(body.URL)
-		} else if soundcloudapi.IsSearchURL(body.URL) {
-			u, err := url.Parse(body.URL)
-			if err != nil {
-				s.respondError(w, "Invalid URL", http.StatusBadRequest)
-				return
-			}
-
-			query := u.Query().Get("q")
-			response, err := s.scdl.Search(soundcloudapi.SearchOptions{
-				Query: query,
-				Limit: 1,
-				Kind:  soundcloudapi.KindTrack,
-			})
-
-			data, err := json.Marshal(response)
-			pgQuery := &soundcloudapi.PaginatedQuery{}
-
-			err = json.Unmarshal(data, pgQuery)
-			if err != nil {
-				s.respondError(w, "Invalid URL", http.StatusBadRequest)
-				return
-			}
-
-			track, err := pgQuery.GetTracks()
-			if err != nil || len(track) == 0 {
-				s.respondError(w, "Invalid URL", http.StatusBadRequest)
-				return
-			}
-
-			body.URL = track[0].PermalinkURL
+		body.Lang = language(r, body.Lang)
+		if !s.cfg().Features.Sync {
+			body.Manifest = nil
 		}
-
-		switch link {
-		case linkTypeTrack:
-			if !s.scdl.IsURL(body.URL) {
-				s.respondError(w, "URL is not a track", http.StatusUnprocessableEntity)
-				return
-			}
-
-			if soundcloudapi.IsPlaylistURL(body.URL) {
-				s.respondError(w, "URL is a playlist not a track", http.StatusBadRequest)
-				return
-			}
-			break
-		case linkTypePlaylist:
-			if !s.scdl.IsURL(body.URL) || !soundcloudapi.IsPlaylistURL(body.URL) {
-				s.respondError(w, "URL is not a playlist", http.StatusUnprocessableEntity)
-				return
-			}
-			break
-		case linkTypeLikes:
-			if !s.scdl.IsURL(body.URL) {
-				s.respondError(w, "URL is not a valid SoundCloud link", http.StatusUnprocessableEntity)
-				return
-			}
-			break
+		body.URL, err = s.checkLink(link, body.URL)
+		if err != nil {
+			s.respondError(w, r, inLanguage(err, body.Lang))
+			return
 		}
 
 		ctx = context.WithValue(ctx, ContextBody, body)
@@ -98,3 +64,70 @@ func (s *Server) validateLink(link linkType, next http.HandlerFunc) http.Handler
 		next.ServeHTTP(w, r.WithContext(ctx))
 	}
 }
+
+// checkLink expands rawURL and checks that it is a link of the given type
+func (s *Server) checkLink(link linkType, rawURL string) (string, error) {
+	u, err := s.expandURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	switch link {
+	case linkTypeTrack:
+		if !s.scdl.IsURL(u) {
+			return "", newAPIError(codeInvalidURL).variant("not_track")
+		}
+
+		if soundcloudapi.IsPlaylistURL(u) {
+			return "", newAPIError(codeWrongLinkType).variant("playlist")
+		}
+	case linkTypePlaylist:
+		if !s.scdl.IsURL(u) || !soundcloudapi.IsPlaylistURL(u) {
+			return "", newAPIError(codeInvalidURL).variant("not_playlist")
+		}
+	case linkTypeLikes:
+		if !s.scdl.IsURL(u) {
+			return "", newAPIError(codeInvalidURL).variant("not_soundcloud")
+		}
+
+		// Routes of likes also take playlists, but a track would be looked up as a user
+		if detectLinkType(u) == linkTypeTrack {
+			return "", newAPIError(codeWrongLinkType).variant("track")
+		}
+	}
+
+	return u, nil
+}
+
+// requestBody returns the body that was validated by validateLink
+func requestBody(r *http.Request) (*urlRequestBody, bool) {
+	body, ok := r.Context().Value(ContextBody).(*urlRequestBody)
+	return body, ok && body != nil
+}
+
+// requireAdmin only allows requests authenticated with the admin token through
+func (s *Server) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		adminToken := s.cfg().AdminToken
+		if adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			s.respondError(w, r, newAPIError(codeUnauthorized))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
+
+// requireFeature responds with FEATURE_DISABLED unless enabled returns true for the current
+// features, which can change while the server is running
+func (s *Server) requireFeature(enabled func(f Features) bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !enabled(s.cfg().Features) {
+			s.respondError(w, r, newAPIError(codeFeatureDisabled))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
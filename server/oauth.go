@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+	"google.golang.org/grpc/metadata"
+)
+
+// soundCloudTokenHeader is the request header carrying the SoundCloud OAuth token of a
+// logged-in user, its gRPC metadata key is the lowercase form
+const soundCloudTokenHeader = "X-SoundCloud-Token"
+
+// soundCloudAPIHosts are the hosts that get the OAuth token, media hosts never see it
+var soundCloudAPIHosts = map[string]bool{
+	"api-v2.soundcloud.com": true,
+	"api.soundcloud.com":    true,
+}
+
+// withOAuthToken returns a context whose upstream requests are made on behalf of the user
+// the token belongs to, or anonymously if token is empty
+func withOAuthToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, ContextOAuthToken, token)
+}
+
+// oauthToken returns the OAuth token upstream requests of ctx are made with, "" if they are
+// anonymous
+func oauthToken(ctx context.Context) string {
+	token, _ := ctx.Value(ContextOAuthToken).(string)
+	return token
+}
+
+// authenticate makes the upstream requests of a request on behalf of the SoundCloud user
+// whose OAuth token it carries. The token is only kept in the request's context, so it is
+// never logged or shared with the requests of other users.
+func (s *Server) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get(soundCloudTokenHeader), "OAuth "))
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withOAuthToken(r.Context(), token)))
+	}
+}
+
+// grpcAuthenticate is authenticate for gRPC calls, which send the token as metadata
+func grpcAuthenticate(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(soundCloudTokenHeader)) == 0 {
+		return ctx
+	}
+
+	token := strings.TrimSpace(strings.TrimPrefix(md.Get(soundCloudTokenHeader)[0], "OAuth "))
+	return withOAuthToken(ctx, token)
+}
+
+// authenticateUpstream returns req authenticated with the OAuth token of its context, if it
+// has one and is made to the SoundCloud API. SoundCloud still wants the client ID alongside.
+func authenticateUpstream(req *http.Request) *http.Request {
+	token := oauthToken(req.Context())
+	if token == "" || !soundCloudAPIHosts[req.URL.Host] {
+		return req
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "OAuth "+token)
+	return req
+}
+
+// tokenError replaces the CLIENT_ID_INVALID errors of authenticated requests, SoundCloud
+// rejected the user's token rather than the client ID
+func tokenError(ctx context.Context, apiErr *apiError) *apiError {
+	if apiErr.Code != codeClientIDInvalid || oauthToken(ctx) == "" {
+		return apiErr
+	}
+
+	return newAPIError(codeSoundCloudTokenInvalid).wrap(apiErr.Err)
+}
+
+// unlockedTracks returns which of the tracks resolved on behalf of a user can't be
+// downloaded anonymously, e.g. Go+ tracks or the user's own private tracks. It is nil for
+// anonymous requests, or if it couldn't be worked out.
+func (s *Server) unlockedTracks(ctx context.Context, tracks []soundcloudapi.Track, formats []string) map[int64]bool {
+	if oauthToken(ctx) == "" || len(tracks) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(tracks))
+	for _, track := range tracks {
+		ids = append(ids, track.ID)
+	}
+
+	anonymous, err := s.getTrackPolicies(withOAuthToken(ctx, ""), ids)
+	if err != nil {
+		return nil
+	}
+
+	unlocked := map[int64]bool{}
+	for _, id := range ids {
+		track, ok := anonymous[id]
+		if !ok {
+			// Private tracks aren't returned at all
+			unlocked[id] = true
+			continue
+		}
+
+		if _, ok := selectTranscoding(track.Media.Transcodings, formats); !ok {
+			unlocked[id] = true
+		}
+	}
+
+	return unlocked
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zackradisic/downloadsound.cloud-api-go/pb"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestAuthenticateUpstream(t *testing.T) {
+	tests := []struct {
+		url  string
+		sent bool
+	}{
+		{"https://api-v2.soundcloud.com/resolve?url=x", true},
+		{"https://api.soundcloud.com/tracks/1", true},
+		{"https://cf-media.sndcdn.com/1.mp3", false},
+		{"https://cf-hls-opus-media.sndcdn.com/playlist/1.opus/playlist.m3u8", false},
+		{"https://wave.sndcdn.com/1_m.json", false},
+		{"https://i1.sndcdn.com/artworks-1-large.jpg", false},
+		{"https://api-v2.soundcloud.com.evil.test/resolve", false},
+	}
+
+	ctx := withOAuthToken(context.Background(), "user-token")
+	for _, test := range tests {
+		req := authenticateUpstream(httptest.NewRequest("GET", test.url, nil).WithContext(ctx))
+		if sent := req.Header.Get("Authorization") == "OAuth user-token"; sent != test.sent {
+			t.Errorf("%s: token sent = %t, want %t", test.url, sent, test.sent)
+		}
+	}
+
+	anonymous := authenticateUpstream(httptest.NewRequest("GET", tests[0].url, nil))
+	if header := anonymous.Header.Get("Authorization"); header != "" {
+		t.Errorf("anonymous request got Authorization %q", header)
+	}
+}
+
+// serveWithToken serves a request made on behalf of the user of token
+func serveWithToken(handler http.Handler, method string, path string, body string, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set(soundCloudTokenHeader, "OAuth "+token)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+func TestOAuthTokenOnlyReachesAPIHosts(t *testing.T) {
+	s, upstream := newDownloadTestServer(t, nil)
+	handler := s.handler()
+
+	for _, w := range []*httptest.ResponseRecorder{
+		serveWithToken(handler, "POST", "/v2/track", urlBody(standInTrackURL), "user-token"),
+		serveWithToken(handler, "POST", "/v1/playlist", urlBody(standInPlaylistURL), "user-token"),
+		serveWithToken(handler, "GET", "/v1/download/1", "", "user-token"),
+	} {
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d %s, want 200", w.Code, w.Body.String())
+		}
+	}
+
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	// Unlocked tracks are found by asking for their policies anonymously, so not every API
+	// request carries the token
+	hosts := map[string]bool{}
+	for _, req := range upstream.requests {
+		sent := strings.Contains(req.Header.Get("Authorization"), "user-token") || strings.Contains(req.URL.RawQuery, "user-token")
+		if sent && !soundCloudAPIHosts[req.URL.Host] {
+			t.Errorf("%s: the token was sent to a media host", req.URL)
+		}
+		hosts[req.URL.Host] = hosts[req.URL.Host] || sent
+	}
+	if !hosts["api-v2.soundcloud.com"] {
+		t.Error("the token never reached the API")
+	}
+	for _, host := range []string{"wave.sndcdn.com", "cf-media.sndcdn.com"} {
+		if _, ok := hosts[host]; !ok {
+			t.Errorf("no request was made to %s", host)
+		}
+	}
+}
+
+func TestAuthenticatedRequestsBypassCaches(t *testing.T) {
+	// Authenticated requests neither use the caches nor fill them for anonymous ones
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		route  string
+	}{
+		{"playlist", "POST", "/v1/playlist", urlBody(standInPlaylistURL), "api-v2.soundcloud.com/resolve"},
+		{"media", "GET", "/v1/download/1", "", "api-v2.soundcloud.com/tracks"},
+	}
+
+	for _, test := range tests {
+		s, upstream := newDownloadTestServer(t, nil)
+		handler := s.handler()
+
+		for i, request := range []struct {
+			token string
+			count int
+		}{
+			{"user-token", 1},
+			{"", 2},
+			{"", 2},
+			{"user-token", 3},
+		} {
+			w := serveWithToken(handler, test.method, test.path, test.body, request.token)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s %d: got %d %s, want 200", test.name, i, w.Code, w.Body.String())
+			}
+
+			if count := upstream.count(test.route); count != request.count {
+				t.Errorf("%s %d: %s was requested %d times, want %d", test.name, i, test.route, count, request.count)
+			}
+		}
+	}
+}
+
+func TestGRPCCallsOnBehalfOfUsers(t *testing.T) {
+	s, upstream := newSoundCloudStandIn(t, nil)
+	// Track 3 can't be downloaded anonymously, the user's token unlocks it
+	upstream.handle("api-v2.soundcloud.com/resolve", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "OAuth user-token" {
+			http.NotFound(w, r)
+			return
+		}
+		respondWithJSON(standInTrack(3, "Go+", ""))(w, r)
+	})
+	upstream.handle("api-v2.soundcloud.com/media/soundcloud:tracks:3/mp3/stream/progressive", respondWithJSON(map[string]string{
+		"url": "https://cf-media.sndcdn.com/3.mp3?Policy=signed",
+	}))
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-soundcloud-token", "OAuth user-token"))
+	track, err := (&grpcServer{s: s}).ResolveTrack(ctx, &pb.ResolveRequest{Url: "https://soundcloud.com/artist/go-plus"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !track.Unlocked {
+		t.Errorf("track = %+v, want it unlocked", track)
+	}
+
+	if _, err := (&grpcServer{s: s}).ResolveTrack(context.Background(), &pb.ResolveRequest{Url: "https://soundcloud.com/artist/go-plus"}); err == nil {
+		t.Error("the track was resolved without the token")
+	}
+}
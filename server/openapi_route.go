@@ -0,0 +1,19 @@
+package server
+
+import (
+	_ "embed" // for the OpenAPI document
+	"net/http"
+)
+
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// handleOpenAPI serves the OpenAPI document describing every route, request body and
+// error code of the API. Keep openapi.json in sync when changing a response shape.
+func (s *Server) handleOpenAPI() apiHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(openAPIDocument)
+		return nil
+	}
+}
@@ -0,0 +1,426 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// openAPISpec is openapi.json with just enough of JSON Schema to check the responses of the
+// API against it. Objects may only have the properties the schema documents, so a field
+// added to a response without documenting it fails the test.
+type openAPISpec map[string]interface{}
+
+func loadOpenAPISpec(t *testing.T) openAPISpec {
+	t.Helper()
+
+	spec := openAPISpec{}
+	if err := json.Unmarshal(openAPIDocument, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+// resolve follows the $ref of node, e.g. "#/components/schemas/Track"
+func (spec openAPISpec) resolve(node map[string]interface{}) map[string]interface{} {
+	for {
+		ref, ok := node["$ref"].(string)
+		if !ok {
+			return node
+		}
+
+		var target interface{} = map[string]interface{}(spec)
+		for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			target = target.(map[string]interface{})[key]
+		}
+		node = target.(map[string]interface{})
+	}
+}
+
+// operation returns the operation of a method and path, or nil if it isn't documented
+func (spec openAPISpec) operation(method string, path string) map[string]interface{} {
+	paths := spec["paths"].(map[string]interface{})
+	item, ok := paths[path].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	operation, _ := item[strings.ToLower(method)].(map[string]interface{})
+	return operation
+}
+
+// operations returns every documented operation as "METHOD path"
+func (spec openAPISpec) operations() []string {
+	operations := []string{}
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		for method := range item.(map[string]interface{}) {
+			if method != "parameters" {
+				operations = append(operations, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+	sort.Strings(operations)
+	return operations
+}
+
+// flatten returns schema along with the schemas of its allOf, resolved
+func (spec openAPISpec) flatten(schema map[string]interface{}) []map[string]interface{} {
+	schema = spec.resolve(schema)
+	schemas := []map[string]interface{}{schema}
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			schemas = append(schemas, spec.flatten(sub.(map[string]interface{}))...)
+		}
+	}
+	return schemas
+}
+
+// validate returns the problems of value against schema, each prefixed with where in the
+// value it is
+func (spec openAPISpec) validate(schema map[string]interface{}, value interface{}, at string) []string {
+	problems := []string{}
+	properties := map[string]interface{}{}
+	var extra map[string]interface{}
+	strict := false
+
+	for _, sub := range spec.flatten(schema) {
+		problems = append(problems, spec.validateShape(sub, value, at)...)
+
+		if one, ok := sub["oneOf"].([]interface{}); ok {
+			matches := 0
+			for _, candidate := range one {
+				if len(spec.validate(candidate.(map[string]interface{}), value, at)) == 0 {
+					matches++
+				}
+			}
+			if matches != 1 {
+				problems = append(problems, fmt.Sprintf("%s: matches %d of the oneOf schemas, want 1", at, matches))
+			}
+		}
+
+		if own, ok := sub["properties"].(map[string]interface{}); ok {
+			strict = true
+			for name, property := range own {
+				properties[name] = property
+			}
+		}
+		if additional, ok := sub["additionalProperties"].(map[string]interface{}); ok {
+			extra = additional
+		}
+	}
+
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return problems
+	}
+	for name, property := range object {
+		documented, ok := properties[name].(map[string]interface{})
+		switch {
+		case ok:
+			problems = append(problems, spec.validate(documented, property, at+"."+name)...)
+		case extra != nil:
+			problems = append(problems, spec.validate(extra, property, at+"."+name)...)
+		case strict:
+			problems = append(problems, fmt.Sprintf("%s.%s: isn't documented", at, name))
+		}
+	}
+
+	return problems
+}
+
+// validateShape checks the keywords of schema that don't depend on other schemas
+func (spec openAPISpec) validateShape(schema map[string]interface{}, value interface{}, at string) []string {
+	problems := []string{}
+
+	if kind, ok := schema["type"].(string); ok {
+		valid := false
+		switch kind {
+		case "object":
+			_, valid = value.(map[string]interface{})
+		case "array":
+			_, valid = value.([]interface{})
+		case "string":
+			_, valid = value.(string)
+		case "boolean":
+			_, valid = value.(bool)
+		case "number":
+			_, valid = value.(float64)
+		case "integer":
+			n, ok := value.(float64)
+			valid = ok && n == float64(int64(n))
+		}
+		if !valid {
+			return append(problems, fmt.Sprintf("%s: %v isn't of type %s", at, value, kind))
+		}
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if allowed == value {
+				found = true
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: %v isn't one of %v", at, value, enum))
+		}
+	}
+
+	if n, ok := value.(float64); ok {
+		if minimum, ok := schema["minimum"].(float64); ok && n < minimum {
+			problems = append(problems, fmt.Sprintf("%s: %v is less than %v", at, n, minimum))
+		}
+		if maximum, ok := schema["maximum"].(float64); ok && n > maximum {
+			problems = append(problems, fmt.Sprintf("%s: %v is more than %v", at, n, maximum))
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		if maxLength, ok := schema["maxLength"].(float64); ok && float64(len([]rune(s))) > maxLength {
+			problems = append(problems, fmt.Sprintf("%s: is longer than %v", at, maxLength))
+		}
+	}
+
+	if items, ok := value.([]interface{}); ok {
+		if minItems, ok := schema["minItems"].(float64); ok && float64(len(items)) < minItems {
+			problems = append(problems, fmt.Sprintf("%s: has less than %v items", at, minItems))
+		}
+		if maxItems, ok := schema["maxItems"].(float64); ok && float64(len(items)) > maxItems {
+			problems = append(problems, fmt.Sprintf("%s: has more than %v items", at, maxItems))
+		}
+		if itemSchema, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range items {
+				problems = append(problems, spec.validate(itemSchema, item, fmt.Sprintf("%s[%d]", at, i))...)
+			}
+		}
+	}
+
+	if object, ok := value.(map[string]interface{}); ok {
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := object[name.(string)]; !ok {
+					problems = append(problems, fmt.Sprintf("%s: %s is required", at, name))
+				}
+			}
+		}
+	}
+
+	return problems
+}
+
+// validateResponse checks the status, Content-Type and body of a response against the
+// documented responses of operation
+func (spec openAPISpec) validateResponse(operation map[string]interface{}, w *httptest.ResponseRecorder) []string {
+	responses := operation["responses"].(map[string]interface{})
+	response, ok := responses[strconv.Itoa(w.Code)].(map[string]interface{})
+	if !ok {
+		if response, ok = responses["default"].(map[string]interface{}); !ok {
+			return []string{fmt.Sprintf("status %d isn't documented", w.Code)}
+		}
+	}
+	response = spec.resolve(response)
+
+	content, ok := response["content"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	contentType := w.Header().Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return []string{fmt.Sprintf("Content-Type %q: %s", contentType, err)}
+	}
+	documented, ok := content[mediaType].(map[string]interface{})
+	if !ok {
+		documented, ok = content[strings.Split(mediaType, "/")[0]+"/*"].(map[string]interface{})
+	}
+	if !ok {
+		return []string{fmt.Sprintf("Content-Type %q isn't documented", contentType)}
+	}
+
+	schema, ok := documented["schema"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	switch mediaType {
+	case "application/json":
+		var body interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			return []string{fmt.Sprintf("body isn't JSON: %s", err)}
+		}
+		return spec.validate(schema, body, "body")
+	case "application/x-ndjson":
+		problems := []string{}
+		lines := bufio.NewScanner(bytes.NewReader(w.Body.Bytes()))
+		for i := 0; lines.Scan(); i++ {
+			var line interface{}
+			if err := json.Unmarshal(lines.Bytes(), &line); err != nil {
+				return append(problems, fmt.Sprintf("line %d isn't JSON: %s", i, err))
+			}
+			problems = append(problems, spec.validate(schema, line, fmt.Sprintf("line %d", i))...)
+		}
+		return problems
+	}
+
+	return nil
+}
+
+// openAPIRequest is a request to a documented operation, the operation being the path of
+// openapi.json the request matches
+type openAPIRequest struct {
+	name      string
+	method    string
+	operation string
+	path      string
+	body      string
+	header    map[string]string
+	status    int
+}
+
+// openAPIRequests returns requests covering every documented operation of s, in an order where
+// the admin routes have a report to list and resolve
+func openAPIRequests(s *Server) []openAPIRequest {
+	admin := map[string]string{"Authorization": "Bearer admin-token"}
+	token := signLink(s.cfg().DownloadLinkSecret, downloadLink{TrackID: 1, Expires: time.Now().Add(time.Hour).Unix()})
+	batch := `{"urls":["` + standInTrackURL + `","` + standInPlaylistURL + `","` + standInMissingURL + `"]}`
+
+	requests := []openAPIRequest{}
+	for _, version := range []string{"/v1", "/v2"} {
+		requests = append(requests,
+			openAPIRequest{"track", "POST", version + "/track", version + "/track", urlBody(standInTrackURL), nil, http.StatusOK},
+			openAPIRequest{"track not found", "POST", version + "/track", version + "/track", urlBody(standInMissingURL), nil, http.StatusNotFound},
+			openAPIRequest{"invalid url", "POST", version + "/track", version + "/track", urlBody("https://example.com/artist/one"), nil, http.StatusUnprocessableEntity},
+			openAPIRequest{"playlist", "POST", version + "/playlist", version + "/playlist", urlBody(standInPlaylistURL), nil, http.StatusOK},
+			openAPIRequest{"all tracks copyrighted", "POST", version + "/playlist", version + "/playlist", urlBody(standInBlockedURL), nil, http.StatusConflict},
+			openAPIRequest{"likes", "POST", version + "/likes", version + "/likes", urlBody(standInUserURL), nil, http.StatusOK},
+			openAPIRequest{"export", "POST", version + "/export", version + "/export", urlBody(standInPlaylistURL), nil, http.StatusOK},
+			openAPIRequest{"export as csv", "POST", version + "/export", version + "/export?format=csv", urlBody(standInPlaylistURL), nil, http.StatusOK},
+			openAPIRequest{"export as jsonl", "POST", version + "/export", version + "/export", urlBody(standInUserURL), map[string]string{"Accept": "application/x-ndjson"}, http.StatusOK},
+			openAPIRequest{"batch", "POST", version + "/batch", version + "/batch", batch, nil, http.StatusOK},
+			openAPIRequest{"invalid batch", "POST", version + "/batch", version + "/batch", `{"urls":`, nil, http.StatusBadRequest},
+			openAPIRequest{"download", "GET", version + "/download/{trackID}", version + "/download/1", "", nil, http.StatusOK},
+			openAPIRequest{"download link", "GET", version + "/download/link/{token}", version + "/download/link/" + token, "", nil, http.StatusOK},
+			openAPIRequest{"forged download link", "GET", version + "/download/link/{token}", version + "/download/link/forged", "", nil, http.StatusForbidden},
+			openAPIRequest{"report", "POST", version + "/report", version + "/report", `{"url":"` + standInTrackURL + `","downloadType":"track","reason":"broken"}`, nil, http.StatusOK},
+		)
+	}
+
+	return append(requests,
+		openAPIRequest{"reports", "GET", "/admin/reports", "/admin/reports", "", admin, http.StatusOK},
+		openAPIRequest{"reports without token", "GET", "/admin/reports", "/admin/reports", "", nil, http.StatusUnauthorized},
+		openAPIRequest{"reports export", "GET", "/admin/reports/export", "/admin/reports/export", "", admin, http.StatusOK},
+		openAPIRequest{"reports export as json", "GET", "/admin/reports/export", "/admin/reports/export?format=json", "", admin, http.StatusOK},
+		openAPIRequest{"resolve report", "POST", "/admin/reports/{id}/resolve", "/admin/reports/1/resolve", "", admin, http.StatusOK},
+		openAPIRequest{"resolve missing report", "POST", "/admin/reports/{id}/resolve", "/admin/reports/999/resolve", "", admin, http.StatusNotFound},
+		openAPIRequest{"test webhooks", "POST", "/admin/webhooks/test", "/admin/webhooks/test", "", admin, http.StatusOK},
+		openAPIRequest{"webhook deliveries", "GET", "/admin/webhooks/deliveries", "/admin/webhooks/deliveries", "", admin, http.StatusOK},
+		openAPIRequest{"openapi", "GET", "/openapi.json", "/openapi.json", "", nil, http.StatusOK},
+		openAPIRequest{"health", "GET", "/healthz", "/healthz", "", nil, http.StatusOK},
+		openAPIRequest{"metrics", "GET", "/metrics", "/metrics", "", nil, http.StatusOK},
+	)
+}
+
+func TestResponsesMatchOpenAPI(t *testing.T) {
+	var received int32
+	receiver := newWebhookReceiver(t, 0, &received)
+	s, upstream := newSoundCloudStandIn(t, func(cfg *Config) {
+		cfg.Features.Batch = true
+		cfg.Features.Export = true
+		cfg.Features.Reports = true
+		cfg.AdminToken = "admin-token"
+		cfg.DownloadLinkSecret = "link-secret"
+		cfg.PublicURL = "https://api.example.com"
+		cfg.WebhookURLs = []string{receiver.URL}
+	})
+	upstream.handle("cf-media.sndcdn.com/1.mp3", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "audio/mpeg")
+		w.Write([]byte("audio"))
+	})
+	spec := loadOpenAPISpec(t)
+	handler := s.handler()
+
+	covered := map[string]bool{}
+	for _, c := range openAPIRequests(s) {
+		name := c.method + " " + c.operation
+		operation := spec.operation(c.method, c.operation)
+		if operation == nil {
+			t.Errorf("%s: isn't documented", name)
+			continue
+		}
+		covered[name] = true
+
+		req := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		req.Header.Set("Content-Type", "application/json")
+		for key, value := range c.header {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		if w.Code != c.status {
+			t.Errorf("%s (%s): status = %d, want %d: %s", name, c.name, w.Code, c.status, w.Body.String())
+		}
+		for _, problem := range spec.validateResponse(operation, w) {
+			t.Errorf("%s (%s): %s", name, c.name, problem)
+		}
+	}
+
+	for _, operation := range spec.operations() {
+		if !covered[operation] {
+			t.Errorf("%s: no request covers it", operation)
+		}
+	}
+	if atomic.LoadInt32(&received) == 0 {
+		t.Error("the test webhook wasn't sent")
+	}
+}
+
+// Every route of the router is documented, the unprefixed routes as their /v1 counterpart
+func TestRoutesAreDocumented(t *testing.T) {
+	s := newTestServer(t, nil)
+	spec := loadOpenAPISpec(t)
+
+	err := s.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		// {trackID:[0-9]+} is documented as {trackID}
+		path := template
+		for strings.Contains(path, ":") {
+			start := strings.Index(path, ":")
+			end := strings.Index(path[start:], "}")
+			path = path[:start] + path[start+end:]
+		}
+
+		for _, method := range methods {
+			if method == "OPTIONS" {
+				continue
+			}
+			if spec.operation(method, path) == nil && spec.operation(method, "/v1"+path) == nil {
+				t.Errorf("%s %s isn't documented", method, template)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
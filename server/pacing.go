@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// lane is the priority of an upstream request in the outbound limiter
+type lane int
+
+const (
+	// laneInteractive is for requests a user is directly waiting on, such as resolving a
+	// single track. Requests made without a lane, e.g. by the SoundCloud client, use it too.
+	laneInteractive lane = iota
+	// laneBulk is for the fan-out of collections
+	laneBulk
+	laneCount
+)
+
+func (l lane) String() string {
+	if l == laneBulk {
+		return "bulk"
+	}
+
+	return "interactive"
+}
+
+// interactiveStreak is how many interactive requests are let through in a row while bulk
+// requests are waiting, so that the bulk lane is slowed down but never starved
+const interactiveStreak = 4
+
+// queueWaitBuckets are the upper bounds in seconds of the queue wait histogram
+var queueWaitBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// withLane returns a context whose upstream requests are made in the given lane
+func withLane(ctx context.Context, l lane) context.Context {
+	return context.WithValue(ctx, ContextLane, l)
+}
+
+// requestLane returns the lane of an upstream request
+func requestLane(ctx context.Context) lane {
+	if l, ok := ctx.Value(ContextLane).(lane); ok {
+		return l
+	}
+
+	return laneInteractive
+}
+
+// waitHistogram records how long requests waited for a token
+type waitHistogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func (h *waitHistogram) observe(wait time.Duration) {
+	seconds := wait.Seconds()
+	if h.counts == nil {
+		h.counts = make([]int64, len(queueWaitBuckets))
+	}
+
+	for i, bound := range queueWaitBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+type waiter struct {
+	ready    chan struct{}
+	queuedAt time.Time
+}
+
+// outboundLimiter paces every request made to SoundCloud with a token bucket shared by the
+// whole server, so that large collections can't get our IP throttled. Requests that have to
+// wait are queued per lane.
+type outboundLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second, 0 disables pacing
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	queues [laneCount][]*waiter
+	streak int
+	timer  *time.Timer
+	waits  [laneCount]waitHistogram
+}
+
+func newOutboundLimiter(perSecond int, burst int) *outboundLimiter {
+	l := &outboundLimiter{last: time.Now()}
+	l.setLimits(perSecond, burst)
+	l.tokens = l.burst
+
+	return l
+}
+
+// setLimits changes the pacing, perSecond 0 disables it
+func (l *outboundLimiter) setLimits(perSecond int, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.rate = float64(perSecond)
+	l.burst = math.Max(float64(burst), 1)
+	l.tokens = math.Min(l.tokens, l.burst)
+	l.dispatch()
+}
+
+// wait blocks until a request may be made in the lane of ctx
+func (l *outboundLimiter) wait(ctx context.Context) error {
+	ln := requestLane(ctx)
+
+	l.mu.Lock()
+	now := time.Now()
+	l.refill(now)
+	if l.rate == 0 || (l.queued() == 0 && l.tokens >= 1) {
+		if l.rate != 0 {
+			l.tokens--
+		}
+		l.waits[ln].observe(0)
+		l.mu.Unlock()
+		return nil
+	}
+
+	w := &waiter{ready: make(chan struct{}), queuedAt: now}
+	l.queues[ln] = append(l.queues[ln], w)
+	l.schedule()
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		for i, queued := range l.queues[ln] {
+			if queued == w {
+				l.queues[ln] = append(l.queues[ln][:i], l.queues[ln][i+1:]...)
+				return ctx.Err()
+			}
+		}
+
+		// The token was granted while giving up, hand it to the next request
+		l.tokens++
+		l.dispatch()
+		return ctx.Err()
+	}
+}
+
+func (l *outboundLimiter) refill(now time.Time) {
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+func (l *outboundLimiter) queued() int {
+	n := 0
+	for _, queue := range l.queues {
+		n += len(queue)
+	}
+
+	return n
+}
+
+// dispatch hands the available tokens to queued requests, interactive ones first
+func (l *outboundLimiter) dispatch() {
+	now := time.Now()
+	l.refill(now)
+
+	for l.queued() > 0 && (l.rate == 0 || l.tokens >= 1) {
+		ln := laneInteractive
+		if len(l.queues[laneInteractive]) == 0 || (len(l.queues[laneBulk]) > 0 && l.streak >= interactiveStreak) {
+			ln = laneBulk
+		}
+
+		if ln == laneInteractive {
+			l.streak++
+		} else {
+			l.streak = 0
+		}
+
+		w := l.queues[ln][0]
+		l.queues[ln] = l.queues[ln][1:]
+		if l.rate != 0 {
+			l.tokens--
+		}
+		l.waits[ln].observe(now.Sub(w.queuedAt))
+		close(w.ready)
+	}
+
+	l.schedule()
+}
+
+// schedule dispatches again once the next token is available
+func (l *outboundLimiter) schedule() {
+	if l.timer != nil || l.queued() == 0 || l.rate == 0 {
+		return
+	}
+
+	wait := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+	l.timer = time.AfterFunc(wait, func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.timer = nil
+		l.dispatch()
+	})
+}
+
+// laneSnapshot is a copy of the queue stats of a lane
+type laneSnapshot struct {
+	lane    lane
+	queued  int
+	buckets []int64
+	sum     float64
+	count   int64
+}
+
+func (l *outboundLimiter) snapshot() []laneSnapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	snapshots := make([]laneSnapshot, laneCount)
+	for ln := lane(0); ln < laneCount; ln++ {
+		h := l.waits[ln]
+		buckets := make([]int64, len(queueWaitBuckets))
+		copy(buckets, h.counts)
+
+		snapshots[ln] = laneSnapshot{
+			lane:    ln,
+			queued:  len(l.queues[ln]),
+			buckets: buckets,
+			sum:     h.sum,
+			count:   h.count,
+		}
+	}
+
+	return snapshots
+}
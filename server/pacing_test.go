@@ -0,0 +1,47 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestPacingDoesNotTripBreaker(t *testing.T) {
+	s, upstream := newUpstreamTestServer(t, func(cfg *Config) {
+		cfg.UpstreamRequestsPerSecond = 100
+		cfg.UpstreamBurst = 1
+		cfg.UpstreamAttemptTimeout = Duration{20 * time.Millisecond}
+		cfg.UpstreamTimeout = Duration{100 * time.Millisecond}
+	})
+	upstream.handle("api-v2.soundcloud.com/tracks", respondWithJSON([]interface{}{}))
+
+	// 50 requests at 100 per second wait up to 500ms in the queue, longer than any time limit
+	const requests = 50
+	ctx := withLane(context.Background(), laneBulk)
+	errs := make(chan error, requests)
+	start := time.Now()
+	for i := 0; i < requests; i++ {
+		go func() {
+			req, _ := http.NewRequestWithContext(ctx, "GET", "https://api-v2.soundcloud.com/tracks", nil)
+			res, err := s.httpClient.Do(req)
+			if err == nil {
+				res.Body.Close()
+			}
+			errs <- err
+		}()
+	}
+	for i := 0; i < requests; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("requests took %s, want them paced", elapsed)
+	}
+	snapshot := s.hosts.snapshot()
+	if len(snapshot) != 1 || snapshot[0].State != "closed" || snapshot[0].Outcomes[outcomeOK] != requests || snapshot[0].Retries != 0 {
+		t.Errorf("hosts = %+v, want %d requests that succeeded first time", snapshot, requests)
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+// prewarmRecheck is how often a disabled prewarmer checks whether it was enabled by a reload
+const prewarmRecheck = time.Minute
+
+// maxRequestLogEntries bounds the playlists counted between two prewarms
+const maxRequestLogEntries = 10000
+
+type cachedPlaylist struct {
+	playlist soundcloudapi.Playlist
+	expires  time.Time
+}
+
+// playlistCache remembers the metadata of playlists, so that popular ones don't have to be
+// fetched again for every request. Cached playlists are shared, so they must not be modified.
+type playlistCache struct {
+	mu        sync.Mutex
+	playlists map[string]cachedPlaylist
+}
+
+func newPlaylistCache() *playlistCache {
+	return &playlistCache{playlists: map[string]cachedPlaylist{}}
+}
+
+func (c *playlistCache) get(key string) (soundcloudapi.Playlist, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.playlists[key]
+	if !ok || time.Now().After(cached.expires) {
+		delete(c.playlists, key)
+		return soundcloudapi.Playlist{}, false
+	}
+
+	return cached.playlist, true
+}
+
+func (c *playlistCache) set(key string, playlist soundcloudapi.Playlist, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range c.playlists {
+		if now.After(v.expires) {
+			delete(c.playlists, k)
+		}
+	}
+
+	c.playlists[key] = cachedPlaylist{playlist: playlist, expires: now.Add(ttl)}
+}
+
+// requestLog counts how often public playlists are requested, so that the most popular ones
+// can be prewarmed. Counts are halved on every prewarm so that they follow recent demand.
+type requestLog struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newRequestLog() *requestLog {
+	return &requestLog{counts: map[string]int{}}
+}
+
+func (l *requestLog) record(playlistURL string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := canonicalURL(playlistURL)
+	if _, ok := l.counts[key]; !ok && len(l.counts) >= maxRequestLogEntries {
+		return
+	}
+	l.counts[key]++
+}
+
+// top returns the n most requested playlists, most requested first
+func (l *requestLog) top(n int) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	urls := make([]string, 0, len(l.counts))
+	for u := range l.counts {
+		urls = append(urls, u)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if l.counts[urls[i]] != l.counts[urls[j]] {
+			return l.counts[urls[i]] > l.counts[urls[j]]
+		}
+		return urls[i] < urls[j]
+	})
+
+	if len(urls) > n {
+		urls = urls[:n]
+	}
+	return urls
+}
+
+// decay halves every count, playlists requested only once are forgotten
+func (l *requestLog) decay() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for u, count := range l.counts {
+		if count/2 == 0 {
+			delete(l.counts, u)
+			continue
+		}
+		l.counts[u] = count / 2
+	}
+}
+
+// isChartPage returns true if u is a chart page of SoundCloud, which lists the tracks of a
+// chart but isn't a playlist. The charts themselves are system playlists under /discover/sets/.
+func isChartPage(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || !soundcloudapi.IsURL(u, false, false) {
+		return false
+	}
+
+	return parsed.Path == "/charts" || strings.HasPrefix(parsed.Path, "/charts/")
+}
+
+// getPlaylist fetches the info of a playlist, from the cache unless refresh is true. Playlists
+// fetched on behalf of a user or through a secret link are never cached.
+func (s *Server) getPlaylist(ctx context.Context, playlistURL string, refresh bool) (soundcloudapi.Playlist, error) {
+	ttl := s.cfg().PlaylistCacheTTL.Duration
+	cacheable := ttl > 0 && oauthToken(ctx) == "" && secretToken(playlistURL) == ""
+	key := canonicalURL(playlistURL)
+	if cacheable && !refresh {
+		if playlist, ok := s.playlistCache.get(key); ok {
+			return playlist, nil
+		}
+	}
+
+	playlist, err := s.soundcloud(ctx).GetPlaylistInfo(playlistURL)
+	if err != nil {
+		return playlist, err
+	}
+
+	if cacheable {
+		s.playlistCache.set(key, playlist, ttl)
+	}
+
+	return playlist, nil
+}
+
+// Prewarm fetches the configured playlists and the most requested ones into the playlist
+// cache on every prewarm interval, starting right away. Its requests are paced in the bulk
+// lane, so they give way to those of users. It returns once ctx is done.
+func (s *Server) Prewarm(ctx context.Context) {
+	for {
+		// The interval itself can be reloaded, so it is read on every iteration
+		cfg := s.cfg()
+		wait := cfg.PrewarmInterval.Duration
+		if wait > 0 && cfg.PlaylistCacheTTL.Duration > 0 {
+			s.prewarm(ctx, cfg)
+		} else {
+			wait = prewarmRecheck
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// prewarm fetches every prewarm target once
+func (s *Server) prewarm(ctx context.Context, cfg Config) {
+	ctx = withLane(ctx, laneBulk)
+
+	targets := []string{}
+	seen := map[string]bool{}
+	for _, u := range append(append([]string{}, cfg.PrewarmURLs...), s.requests.top(cfg.PrewarmTopRequested)...) {
+		if key := canonicalURL(u); !seen[key] {
+			seen[key] = true
+			targets = append(targets, u)
+		}
+	}
+	s.requests.decay()
+
+	if len(targets) == 0 {
+		return
+	}
+
+	start := time.Now()
+	failed := 0
+	for _, u := range targets {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if _, err := s.getPlaylist(ctx, u, true); err != nil {
+			failed++
+			fmt.Println(Entry{
+				Message:   fmt.Sprintf("Couldn't prewarm %s: %s", u, err.Error()),
+				Severity:  "WARNING",
+				Component: "prewarm",
+			})
+		}
+	}
+
+	fmt.Println(Entry{
+		Message:   fmt.Sprintf("Prewarmed %d of %d playlists in %s", len(targets)-failed, len(targets), time.Since(start).Round(time.Millisecond)),
+		Component: "prewarm",
+	})
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+func TestRequestLogTop(t *testing.T) {
+	l := newRequestLog()
+	for _, u := range []string{
+		"https://soundcloud.com/artist/sets/b",
+		"https://soundcloud.com/artist/sets/a",
+		"https://soundcloud.com/artist/sets/c",
+		"https://www.soundcloud.com/artist/sets/c/",
+		"https://m.soundcloud.com/artist/sets/c?si=share",
+		"https://soundcloud.com/artist/sets/d",
+		"https://soundcloud.com/artist/sets/d",
+	} {
+		l.record(u)
+	}
+
+	// Ties are broken by URL so that the same playlists are picked every time
+	want := []string{"https://soundcloud.com/artist/sets/c", "https://soundcloud.com/artist/sets/d", "https://soundcloud.com/artist/sets/a"}
+	if got := l.top(3); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("top(3) = %v, want %v", got, want)
+	}
+	if got := l.top(10); len(got) != 4 {
+		t.Errorf("top(10) = %v, want every playlist", got)
+	}
+
+	// Decaying forgets the playlists requested once and halves the others
+	l.decay()
+	want = []string{"https://soundcloud.com/artist/sets/c", "https://soundcloud.com/artist/sets/d"}
+	if got := l.top(10); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("top after a decay = %v, want %v", got, want)
+	}
+	l.decay()
+	if got := l.top(10); len(got) != 0 {
+		t.Errorf("top after two decays = %v, want nothing", got)
+	}
+}
+
+func TestPlaylistCacheExpiry(t *testing.T) {
+	c := newPlaylistCache()
+	c.set("fresh", soundcloudapi.Playlist{Title: "Fresh"}, time.Minute)
+	c.set("stale", soundcloudapi.Playlist{Title: "Stale"}, 10*time.Millisecond)
+
+	if playlist, ok := c.get("stale"); !ok || playlist.Title != "Stale" {
+		t.Fatalf("get(stale) = %+v, %t before it expired", playlist, ok)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, ok := c.get("stale"); ok {
+		t.Error("got an expired playlist")
+	}
+	if playlist, ok := c.get("fresh"); !ok || playlist.Title != "Fresh" {
+		t.Errorf("get(fresh) = %+v, %t, want the playlist until it expires", playlist, ok)
+	}
+	if _, ok := c.get("missing"); ok {
+		t.Error("got a playlist that was never cached")
+	}
+
+	// Expired playlists are dropped when others are cached
+	c.set("stale", soundcloudapi.Playlist{}, -time.Second)
+	c.set("other", soundcloudapi.Playlist{}, time.Minute)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.playlists["stale"]; ok {
+		t.Error("an expired playlist was kept")
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	s, upstream := newSoundCloudStandIn(t, func(cfg *Config) {
+		cfg.PrewarmURLs = []string{standInPlaylistURL}
+		cfg.PrewarmTopRequested = 1
+		cfg.PrewarmInterval = Duration{time.Hour}
+	})
+	handler := s.handler()
+
+	// The blocked playlist is the most requested one, the configured playlist is only
+	// prewarmed once
+	for _, u := range []string{standInBlockedURL, standInBlockedURL, standInPlaylistURL} {
+		s.requests.record(u)
+	}
+	resolved := upstream.count("api-v2.soundcloud.com/resolve")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Prewarm(ctx)
+		close(done)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for upstream.count("api-v2.soundcloud.com/resolve") < resolved+2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Prewarm didn't return once its context was done")
+	}
+
+	if count := upstream.count("api-v2.soundcloud.com/resolve"); count != resolved+2 {
+		t.Errorf("prewarming resolved %d playlists, want the configured and the most requested one", count-resolved)
+	}
+
+	// Prewarmed playlists are served from the cache
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/v2/playlist", strings.NewReader(urlBody(standInPlaylistURL))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d %s, want 200", w.Code, w.Body.String())
+	}
+	if count := upstream.count("api-v2.soundcloud.com/resolve"); count != resolved+2 {
+		t.Errorf("a prewarmed playlist was resolved again")
+	}
+}
+
+func TestPrewarmURLsMustBePlaylists(t *testing.T) {
+	tests := []struct {
+		url     string
+		problem string
+	}{
+		{"https://soundcloud.com/discover/sets/charts-top:all-music", ""},
+		{"https://soundcloud.com/artist/sets/mix", ""},
+		{"https://soundcloud.com/charts/top?genre=all-music", "system playlist of the chart"},
+		{"https://soundcloud.com/charts", "system playlist of the chart"},
+		{"https://soundcloud.com/artist", "playlist URLs"},
+	}
+
+	for _, test := range tests {
+		cfg := DefaultConfig()
+		cfg.ClientID = "test-client-id"
+		cfg.FrontendURL = "http://frontend.test"
+		cfg.ReportStore = "memory"
+		cfg.PrewarmURLs = []string{test.url}
+
+		err := cfg.Validate()
+		if test.problem == "" {
+			if err != nil {
+				t.Errorf("%s: Validate() = %v, want nil", test.url, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.problem) {
+			t.Errorf("%s: Validate() = %v, want an error about %s", test.url, err, test.problem)
+		}
+	}
+}
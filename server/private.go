@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+const trackByIDURL = "https://api-v2.soundcloud.com/tracks/%d"
+
+// secretTokenRegex matches the secret token of links to private tracks and sets
+var secretTokenRegex = regexp.MustCompile(`^s-[A-Za-z0-9]+$`)
+
+// secretToken returns the secret token of a link to a private track or set, or "" if the
+// link is public. Shared links end with the token, e.g. soundcloud.com/user/track/s-AbC12,
+// but it can also be given as the secret_token parameter.
+func secretToken(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+
+	// Sets have one more segment, user/sets/s-set is a public set called s-set
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	minSegments := 3
+	if len(segments) > 1 && segments[1] == "sets" {
+		minSegments = 4
+	}
+	if last := segments[len(segments)-1]; len(segments) >= minSegments && secretTokenRegex.MatchString(last) {
+		return last
+	}
+
+	if token := u.Query().Get("secret_token"); secretTokenRegex.MatchString(token) {
+		return token
+	}
+
+	return ""
+}
+
+// normalizeSecretURL returns a link to a private track or set in the form SoundCloud
+// resolves, with the secret token at the end of the path. The other query parameters, such
+// as the tracking ones of shared links, are dropped. Public links are returned as is.
+func normalizeSecretURL(rawURL string) string {
+	token := secretToken(rawURL)
+	if token == "" {
+		return rawURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	u.Path = strings.TrimRight(u.Path, "/")
+	if !strings.HasSuffix(u.Path, "/"+token) {
+		u.Path += "/" + token
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+
+	return u.String()
+}
+
+// withSecretToken adds the secret token of a private track to an API URL, public tracks
+// don't need one
+func withSecretToken(rawURL string, token string) string {
+	if token == "" {
+		return rawURL
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	q := u.Query()
+	q.Set("secret_token", token)
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// getPrivateTrack fetches a private track by ID. The SoundCloud client can only fetch them
+// by ID along with the playlist they are in.
+func (s *Server) getPrivateTrack(ctx context.Context, trackID int64, token string) (*soundcloudapi.Track, error) {
+	u, err := url.Parse(fmt.Sprintf(trackByIDURL, trackID))
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = url.Values{"client_id": {s.scdl.ClientID()}, "secret_token": {token}}.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, &soundcloudapi.FailedRequestError{Status: res.StatusCode}
+	}
+
+	track := &soundcloudapi.Track{}
+	if err := json.NewDecoder(res.Body).Decode(track); err != nil || track.ID == 0 {
+		return nil, errors.New("Invalid track response")
+	}
+
+	return track, nil
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/zackradisic/downloadsound.cloud-api-go/pb"
+)
+
+func TestSecretToken(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://soundcloud.com/user/track", ""},
+		{"https://soundcloud.com/user/track/s-AbC12", "s-AbC12"},
+		{"https://soundcloud.com/user/track/s-AbC12/", "s-AbC12"},
+		{"https://soundcloud.com/user/track?secret_token=s-AbC12", "s-AbC12"},
+		{"https://soundcloud.com/user/track?secret_token=not-a-token", ""},
+		{"https://soundcloud.com/user/sets/set/s-AbC12", "s-AbC12"},
+		// A public track or set can be called s-something
+		{"https://soundcloud.com/user/s-track", ""},
+		{"https://soundcloud.com/user/sets/s-set", ""},
+		{"https://soundcloud.com/user/track/s-Ab_C12", ""},
+	}
+
+	for _, test := range tests {
+		if got := secretToken(test.url); got != test.want {
+			t.Errorf("secretToken(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeSecretURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"https://soundcloud.com/user/track?si=tracking", "https://soundcloud.com/user/track?si=tracking"},
+		{"https://soundcloud.com/user/track/s-AbC12?si=tracking&utm_source=clipboard", "https://soundcloud.com/user/track/s-AbC12"},
+		{"https://soundcloud.com/user/track/s-AbC12/", "https://soundcloud.com/user/track/s-AbC12"},
+		{"https://soundcloud.com/user/track?secret_token=s-AbC12#t=0:30", "https://soundcloud.com/user/track/s-AbC12"},
+		{"https://soundcloud.com/user/sets/set/s-AbC12", "https://soundcloud.com/user/sets/set/s-AbC12"},
+	}
+
+	for _, test := range tests {
+		if got := normalizeSecretURL(test.url); got != test.want {
+			t.Errorf("normalizeSecretURL(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestWithSecretToken(t *testing.T) {
+	tests := []struct {
+		url   string
+		token string
+		want  string
+	}{
+		{"https://api-v2.soundcloud.com/media/1/stream/progressive", "", "https://api-v2.soundcloud.com/media/1/stream/progressive"},
+		{"https://api-v2.soundcloud.com/media/1/stream/progressive", "s-AbC12", "https://api-v2.soundcloud.com/media/1/stream/progressive?secret_token=s-AbC12"},
+		{"https://api-v2.soundcloud.com/media/1/stream/hls?client_id=id", "s-AbC12", "https://api-v2.soundcloud.com/media/1/stream/hls?client_id=id&secret_token=s-AbC12"},
+		{"https://api-v2.soundcloud.com/media/1/stream/hls?secret_token=s-Old1", "s-AbC12", "https://api-v2.soundcloud.com/media/1/stream/hls?secret_token=s-AbC12"},
+	}
+
+	for _, test := range tests {
+		if got := withSecretToken(test.url, test.token); got != test.want {
+			t.Errorf("withSecretToken(%q, %q) = %q, want %q", test.url, test.token, got, test.want)
+		}
+	}
+}
+
+// tokenRequests returns the upstream requests to route and how many of them carried token
+func tokenRequests(upstream *fakeUpstream, route string, token string) (int, int) {
+	upstream.mu.Lock()
+	defer upstream.mu.Unlock()
+
+	requests, withToken := 0, 0
+	for _, req := range upstream.requests {
+		if req.URL.Host+req.URL.Path != route {
+			continue
+		}
+		requests++
+		if req.URL.Query().Get("secret_token") == token {
+			withToken++
+		}
+	}
+
+	return requests, withToken
+}
+
+func TestPrivateTracksForwardTheirToken(t *testing.T) {
+	const token = "s-AbC12"
+	const media = "api-v2.soundcloud.com/media/soundcloud:tracks:1/mp3/stream/progressive"
+	private := standInTrack(1, "Track One", "")
+	private["secret_token"] = token
+
+	s, upstream := newDownloadTestServer(t, nil)
+	upstream.handle("api-v2.soundcloud.com/resolve", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("url") != standInTrackURL+"/"+token {
+			http.NotFound(w, r)
+			return
+		}
+		respondWithJSON(private)(w, r)
+	})
+	upstream.handle("api-v2.soundcloud.com/tracks/1", respondWithJSON(private))
+	handler := s.handler()
+
+	// Shared links carry tracking parameters, they are resolved without them
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/v2/track", strings.NewReader(urlBody(standInTrackURL+"/"+token+"?si=tracking"))))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"private":true`) {
+		t.Fatalf("track: got %d %s, want a private track", w.Code, w.Body.String())
+	}
+	if requests, withToken := tokenRequests(upstream, media, token); requests != 1 || withToken != 1 {
+		t.Errorf("track: %d of %d media URL requests had the token, want 1 of 1", withToken, requests)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/v1/download/1?secret_token="+token, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("download: got %d %s, want 200", w.Code, w.Body.String())
+	}
+	if requests, withToken := tokenRequests(upstream, "api-v2.soundcloud.com/tracks/1", token); requests != 1 || withToken != 1 {
+		t.Errorf("download: %d of %d track requests had the token, want 1 of 1", withToken, requests)
+	}
+	if requests, withToken := tokenRequests(upstream, media, token); requests != 2 || withToken != 2 {
+		t.Errorf("download: %d of %d media URL requests had the token, want 2 of 2", withToken, requests)
+	}
+
+	track, err := (&grpcServer{s: s}).ResolveTrack(context.Background(), &pb.ResolveRequest{Url: standInTrackURL + "/" + token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !track.Private {
+		t.Error("gRPC track isn't private")
+	}
+}
@@ -0,0 +1,251 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Ways to pick the proxy of an upstream request
+const (
+	proxyRoundRobin  = "round-robin"
+	proxyLeastErrors = "least-errors"
+)
+
+// proxyState tracks the health of an outbound proxy
+type proxyState struct {
+	url *url.URL
+
+	mu sync.Mutex
+	// blocks is how many 403 and 429 responses the proxy got in a row
+	blocks       int
+	requests     int64
+	errors       int64
+	evictions    int64
+	evictedUntil time.Time
+}
+
+// name identifies the proxy in logs and metrics without its credentials
+func (p *proxyState) name() string {
+	return p.url.Redacted()
+}
+
+func (p *proxyState) evicted(now time.Time) bool {
+	return now.Before(p.returnsAt())
+}
+
+// returnsAt returns when the proxy is used again after being evicted
+func (p *proxyState) returnsAt() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.evictedUntil
+}
+
+// errorRate returns the share of requests through the proxy that failed
+func (p *proxyState) errorRate() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.requests == 0 {
+		return 0
+	}
+
+	return float64(p.errors) / float64(p.requests)
+}
+
+// record records the outcome of a request, evicting the proxy for evictFor once it got
+// evictAfter 403 or 429 responses in a row
+func (p *proxyState) record(res *http.Response, err error, evictAfter int, evictFor time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.requests++
+	blocked := err == nil && (res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusTooManyRequests)
+	if err != nil || blocked || res.StatusCode >= 500 {
+		p.errors++
+	}
+
+	if !blocked {
+		if err == nil {
+			p.blocks = 0
+		}
+		return
+	}
+
+	p.blocks++
+	if p.blocks >= evictAfter {
+		p.blocks = 0
+		p.evictions++
+		p.evictedUntil = time.Now().Add(evictFor)
+	}
+}
+
+// proxyPool spreads upstream requests over the configured proxies
+type proxyPool struct {
+	proxies []*proxyState
+
+	mu   sync.Mutex
+	next int
+}
+
+// newProxyPool returns a pool of the given proxy URLs, or nil if there are none so that
+// requests are made directly
+func newProxyPool(proxyURLs []string) (*proxyPool, error) {
+	if len(proxyURLs) == 0 {
+		return nil, nil
+	}
+
+	pool := &proxyPool{}
+	for _, raw := range proxyURLs {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, err
+		}
+		pool.proxies = append(pool.proxies, &proxyState{url: u})
+	}
+
+	return pool, nil
+}
+
+// newRegionalProxy returns the proxy geo-blocked tracks are resolved through, or nil if
+// there is none
+func newRegionalProxy(proxyURL string) (*proxyState, error) {
+	if proxyURL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyState{url: u}, nil
+}
+
+// pick returns the proxy for the next request. Evicted proxies are skipped, unless all of
+// them are evicted, in which case the one that comes back first is used.
+func (p *proxyPool) pick(selection string) *proxyState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	var best *proxyState
+	for i := range p.proxies {
+		proxy := p.proxies[(p.next+i)%len(p.proxies)]
+		if proxy.evicted(now) {
+			continue
+		}
+
+		if best == nil || (selection == proxyLeastErrors && proxy.errorRate() < best.errorRate()) {
+			best = proxy
+		}
+
+		if selection != proxyLeastErrors {
+			break
+		}
+	}
+
+	if best == nil {
+		for _, proxy := range p.proxies {
+			if best == nil || proxy.returnsAt().Before(best.returnsAt()) {
+				best = proxy
+			}
+		}
+	}
+
+	p.next++
+	return best
+}
+
+// proxyPin makes every upstream request of a context go through the same proxy, the first
+// request picks it unless it is set beforehand
+type proxyPin struct {
+	mu    sync.Mutex
+	proxy *proxyState
+}
+
+// withProxyPin returns a context whose upstream requests all use the proxy of pin
+func withProxyPin(ctx context.Context, pin *proxyPin) context.Context {
+	return context.WithValue(ctx, ContextProxyPin, pin)
+}
+
+// proxyTransport sends every request through a proxy of the pool or the proxy it is pinned
+// to, recording how it went
+type proxyTransport struct {
+	next   http.RoundTripper
+	server *Server
+}
+
+func (t *proxyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	pool := t.server.proxies
+	cfg := t.server.cfg()
+
+	// A pin can come with its proxy, such as the regional proxy, which is used even without
+	// a pool
+	var proxy *proxyState
+	if pin, ok := req.Context().Value(ContextProxyPin).(*proxyPin); ok {
+		pin.mu.Lock()
+		if pin.proxy == nil && pool != nil {
+			pin.proxy = pool.pick(cfg.ProxySelection)
+		}
+		proxy = pin.proxy
+		pin.mu.Unlock()
+	} else if pool != nil {
+		proxy = pool.pick(cfg.ProxySelection)
+	}
+
+	if proxy == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	res, err := t.next.RoundTrip(req.WithContext(context.WithValue(req.Context(), ContextProxy, proxy)))
+	if req.Context().Err() == nil {
+		proxy.record(res, err, cfg.ProxyEvictAfter, cfg.ProxyEvictFor.Duration)
+	}
+
+	return res, err
+}
+
+// requestProxy is the Proxy of the upstream http.Transports. It uses the proxy chosen by
+// proxyTransport, or the environment if there is no pool.
+func requestProxy(req *http.Request) (*url.URL, error) {
+	if proxy, ok := req.Context().Value(ContextProxy).(*proxyState); ok {
+		return proxy.url, nil
+	}
+
+	return http.ProxyFromEnvironment(req)
+}
+
+// proxySnapshot is a copy of the stats of a proxy
+type proxySnapshot struct {
+	Proxy     string `json:"proxy"`
+	Evicted   bool   `json:"evicted"`
+	Requests  int64  `json:"requests"`
+	Errors    int64  `json:"errors"`
+	Evictions int64  `json:"evictions"`
+}
+
+func (p *proxyPool) snapshot() []proxySnapshot {
+	if p == nil {
+		return []proxySnapshot{}
+	}
+
+	now := time.Now()
+	snapshots := make([]proxySnapshot, 0, len(p.proxies))
+	for _, proxy := range p.proxies {
+		proxy.mu.Lock()
+		snapshots = append(snapshots, proxySnapshot{
+			Proxy:     proxy.name(),
+			Evicted:   now.Before(proxy.evictedUntil),
+			Requests:  proxy.requests,
+			Errors:    proxy.errors,
+			Evictions: proxy.evictions,
+		})
+		proxy.mu.Unlock()
+	}
+
+	return snapshots
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// standInProxy is an HTTP proxy that answers every request itself with its handler
+type standInProxy struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	hits []string
+}
+
+func newStandInProxy(t *testing.T, handler http.HandlerFunc) *standInProxy {
+	t.Helper()
+
+	p := &standInProxy{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		p.hits = append(p.hits, r.URL.String())
+		p.mu.Unlock()
+
+		handler(w, r)
+	}))
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func (p *standInProxy) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.hits)
+}
+
+func respondWith(status int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}
+}
+
+// newProxiedTestServer returns a server whose upstream requests go through the given proxies
+func newProxiedTestServer(t *testing.T, selection string, proxies ...*standInProxy) *Server {
+	t.Helper()
+
+	return newTestServer(t, func(cfg *Config) {
+		cfg.UpstreamRetries = 0
+		cfg.ProxySelection = selection
+		cfg.ProxyEvictAfter = 2
+		for _, proxy := range proxies {
+			cfg.Proxies = append(cfg.Proxies, proxy.URL)
+		}
+	})
+}
+
+func getMedia(t *testing.T, s *Server, ctx context.Context, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		req, _ := http.NewRequest("GET", "http://cdn.test/media.mp3", nil)
+		res, err := s.mediaClient.Do(req.WithContext(ctx))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+}
+
+func proxyCounts(proxies ...*standInProxy) []int {
+	counts := []int{}
+	for _, proxy := range proxies {
+		counts = append(counts, proxy.count())
+	}
+	return counts
+}
+
+func TestProxyRoundRobin(t *testing.T) {
+	a, b, c := newStandInProxy(t, respondWith(200)), newStandInProxy(t, respondWith(200)), newStandInProxy(t, respondWith(200))
+	s := newProxiedTestServer(t, proxyRoundRobin, a, b, c)
+
+	getMedia(t, s, context.Background(), 6)
+
+	for i, count := range proxyCounts(a, b, c) {
+		if count != 2 {
+			t.Errorf("proxy %d got %d requests, want 2", i, count)
+		}
+	}
+	if a.hits[0] != "http://cdn.test/media.mp3" {
+		t.Errorf("proxy got %q, want the upstream URL", a.hits[0])
+	}
+}
+
+func TestProxyLeastErrors(t *testing.T) {
+	failing, healthy := newStandInProxy(t, respondWith(500)), newStandInProxy(t, respondWith(200))
+	s := newProxiedTestServer(t, proxyLeastErrors, failing, healthy)
+
+	getMedia(t, s, context.Background(), 5)
+
+	if counts := proxyCounts(failing, healthy); counts[0] != 1 || counts[1] != 4 {
+		t.Errorf("proxies got %v requests, want [1 4]", counts)
+	}
+}
+
+func TestProxyEviction(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusTooManyRequests} {
+		blocked, healthy := newStandInProxy(t, respondWith(status)), newStandInProxy(t, respondWith(200))
+		s := newProxiedTestServer(t, proxyRoundRobin, blocked, healthy)
+
+		getMedia(t, s, context.Background(), 8)
+
+		// The blocked proxy is evicted after its second response in a row
+		if counts := proxyCounts(blocked, healthy); counts[0] != 2 || counts[1] != 6 {
+			t.Errorf("%d: proxies got %v requests, want [2 6]", status, counts)
+		}
+		snapshot := s.proxies.snapshot()
+		if !snapshot[0].Evicted || snapshot[0].Evictions != 1 || snapshot[1].Evicted {
+			t.Errorf("%d: snapshot = %+v, want only the blocked proxy evicted", status, snapshot)
+		}
+	}
+}
+
+func TestProxyEvictionNeedsBlocksInARow(t *testing.T) {
+	var responses int32
+	flaky := newStandInProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&responses, 1)%2 == 0 {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	})
+	s := newProxiedTestServer(t, proxyRoundRobin, flaky)
+
+	getMedia(t, s, context.Background(), 6)
+
+	if snapshot := s.proxies.snapshot(); snapshot[0].Evictions != 0 {
+		t.Errorf("evictions = %d, want 0", snapshot[0].Evictions)
+	}
+}
+
+func TestProxyPin(t *testing.T) {
+	a, b, c := newStandInProxy(t, respondWith(200)), newStandInProxy(t, respondWith(200)), newStandInProxy(t, respondWith(200))
+	s := newProxiedTestServer(t, proxyRoundRobin, a, b, c)
+
+	getMedia(t, s, context.Background(), 1)
+	getMedia(t, s, withProxyPin(context.Background(), &proxyPin{}), 5)
+
+	if counts := proxyCounts(a, b, c); counts[0] != 1 || counts[1] != 5 || counts[2] != 0 {
+		t.Errorf("proxies got %v requests, want [1 5 0]", counts)
+	}
+}
+
+func TestHLSDownloadUsesPinnedProxy(t *testing.T) {
+	cdn := func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/hls/playlist.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXTINF:10.0,\nsegment/0.mp3\n#EXTINF:10.0,\nhttp://cdn.test/hls/segment/1.mp3\n#EXT-X-ENDLIST\n"))
+		case "/hls/segment/0.mp3":
+			w.Write([]byte("first "))
+		case "/hls/segment/1.mp3":
+			w.Write([]byte("second"))
+		default:
+			http.NotFound(w, r)
+		}
+	}
+	a, b := newStandInProxy(t, cdn), newStandInProxy(t, cdn)
+	s := newProxiedTestServer(t, proxyRoundRobin, a, b)
+
+	source := &mediaSource{url: "http://cdn.test/hls/playlist.m3u8", filename: "track.mp3", contentType: "audio/mpeg", pin: &proxyPin{}}
+	source.transcoding.Format.Protocol = "hls"
+
+	w := httptest.NewRecorder()
+	err := s.serveMedia(w, httptest.NewRequest("GET", "/v1/download/1", nil), 1, source, func() (*mediaSource, error) {
+		t.Fatal("the source was refreshed")
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := ioutil.ReadAll(w.Body)
+	if string(body) != "first second" {
+		t.Errorf("body = %q, want the segments in order", body)
+	}
+	if counts := proxyCounts(a, b); counts[0] != 3 || counts[1] != 0 {
+		t.Errorf("proxies got %v requests, want [3 0]", counts)
+	}
+	if !strings.HasSuffix(a.hits[1], "/hls/segment/0.mp3") {
+		t.Errorf("segment URL = %q, want it relative to the playlist", a.hits[1])
+	}
+}
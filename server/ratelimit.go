@@ -0,0 +1,188 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a per-client token bucket rate limiter. Every resolved resource costs one
+// token, so a batch of N URLs is accounted the same as N separate requests. The limits are
+// passed in from the config a request read, so a reload changes them along with the rest of
+// the config.
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*bucket{}}
+}
+
+// take removes cost tokens from the bucket for key, which refills at perMinute up to burst.
+// If there are not enough tokens nothing is removed and the time to wait until there are
+// is returned. Buckets above a lowered burst are capped.
+func (rl *rateLimiter) take(key string, cost int, perMinute int, burst int) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rate, capacity := float64(perMinute)/60, float64(burst)
+	now := time.Now()
+	rl.calls++
+	if rl.calls%1000 == 0 {
+		rl.prune(now, rate, capacity)
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		rl.buckets[key] = b
+	}
+
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if float64(cost) > capacity {
+		return false, 0
+	}
+
+	if b.tokens < float64(cost) {
+		wait := (float64(cost) - b.tokens) / rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+
+	b.tokens -= float64(cost)
+	return true, 0
+}
+
+// prune removes buckets that have refilled completely, they are identical to new buckets
+func (rl *rateLimiter) prune(now time.Time, rate float64, capacity float64) {
+	for key, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= capacity {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// parseTrustedProxies parses the IPs and CIDR ranges of trusted proxies, IPs are taken as
+// single-address ranges
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return nil, fmt.Errorf("got %q", proxy)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("got %q", proxy)
+		}
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// isTrusted returns true if ip belongs to one of the trusted proxies
+func isTrusted(trusted []*net.IPNet, ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, ipNet := range trusted {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP returns the IP of the client a connection from remoteAddr was made for. The
+// X-Forwarded-For chain is only followed through trusted proxies, from the closest one, so
+// the first address a client made up itself is never reached.
+func (s *Server) clientIP(remoteAddr string, forwarded []string) string {
+	ip, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		ip = remoteAddr
+	}
+
+	trusted := s.cfg().trustedProxies
+	if !isTrusted(trusted, ip) {
+		return ip
+	}
+
+	hops := []string{}
+	for _, header := range forwarded {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip = hops[i]
+		if !isTrusted(trusted, ip) {
+			break
+		}
+	}
+
+	return ip
+}
+
+// clientKey identifies the client that made a request
+func (s *Server) clientKey(r *http.Request) string {
+	return s.clientIP(r.RemoteAddr, r.Header.Values("X-Forwarded-For"))
+}
+
+// chargeRequest charges cost tokens to the client making the request, returning an error
+// if the client has exceeded the rate limit
+func (s *Server) chargeRequest(w http.ResponseWriter, r *http.Request, cost int) error {
+	cfg := s.cfg()
+	ok, wait := s.limiter.take(s.clientKey(r), cost, cfg.RateLimitPerMinute, cfg.RateLimitBurst)
+	if ok {
+		return nil
+	}
+
+	if wait == 0 {
+		return newAPIError(codeBatchTooLarge).variant("rate_limit")
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	return newAPIError(codeRateLimited)
+}
+
+// rateLimit charges a single token per request
+func (s *Server) rateLimit(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := s.chargeRequest(w, r, 1); err != nil {
+			s.respondError(w, r, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.TrustedProxies = []string{"10.0.0.1", "172.16.0.0/12"}
+	})
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "203.0.113.7:4000", nil, "203.0.113.7"},
+		{"untrusted forwarded", "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed hop", "10.0.0.1:4000", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", "10.0.0.1:4000", []string{"198.51.100.1, 172.16.5.5"}, "198.51.100.1"},
+		{"repeated headers", "10.0.0.1:4000", []string{"1.1.1.1", "198.51.100.1"}, "198.51.100.1"},
+		{"trusted proxy without header", "10.0.0.1:4000", nil, "10.0.0.1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := s.clientIP(test.remote, test.forwarded); got != test.want {
+				t.Errorf("clientIP(%q, %q) = %q, want %q", test.remote, test.forwarded, got, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimitIgnoresUntrustedForwardedFor(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.RateLimitPerMinute = 1
+		cfg.RateLimitBurst = 1
+	})
+	handler := s.rateLimit(func(w http.ResponseWriter, r *http.Request) {})
+
+	statuses := []int{}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest("POST", "/v1/track", nil)
+		req.RemoteAddr = "203.0.113.7:4000"
+		req.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(i))
+		w := httptest.NewRecorder()
+		handler(w, req)
+		statuses = append(statuses, w.Code)
+	}
+
+	if statuses[0] != http.StatusOK || statuses[1] != http.StatusTooManyRequests || statuses[2] != http.StatusTooManyRequests {
+		t.Errorf("got statuses %v, rotating X-Forwarded-For shouldn't get a fresh bucket", statuses)
+	}
+}
+
+func TestTrustedProxiesFollowReloads(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "trustedProxies: [10.0.0.1]\n")
+
+	cfg, err := LoadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwarded := []string{"198.51.100.1"}
+	if got := s.clientIP("10.0.0.1:4000", forwarded); got != "198.51.100.1" {
+		t.Errorf("clientIP() = %q through a trusted proxy, want the forwarded IP", got)
+	}
+
+	writeConfig(t, path, "trustedProxies: [10.0.0.2]\n")
+	s.reloadConfig()
+	if got := s.clientIP("10.0.0.1:4000", forwarded); got != "10.0.0.1" {
+		t.Errorf("clientIP() = %q through a proxy no longer trusted, want the proxy", got)
+	}
+	if got := s.clientIP("10.0.0.2:4000", forwarded); got != "198.51.100.1" {
+		t.Errorf("clientIP() = %q through the newly trusted proxy, want the forwarded IP", got)
+	}
+}
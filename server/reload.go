@@ -0,0 +1,166 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// configChange is a setting that differs between two configs
+type configChange struct {
+	name     string
+	from, to string
+	// restart is set if the setting only takes effect on restart
+	restart bool
+}
+
+func (c configChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.name, c.from, c.to)
+}
+
+// WatchConfig reloads the config on SIGHUP, and whenever the config file changes if a
+// reload interval is configured. It never returns.
+func (s *Server) WatchConfig() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	modTime := configModTime(s.cfg().file)
+	for {
+		// The interval itself can be reloaded, so the timer is created on every iteration
+		var tick <-chan time.Time
+		if interval := s.cfg().ReloadInterval.Duration; interval > 0 && s.cfg().file != "" {
+			tick = time.After(interval)
+		}
+
+		select {
+		case <-hup:
+		case <-tick:
+			latest := configModTime(s.cfg().file)
+			if latest.Equal(modTime) {
+				continue
+			}
+		}
+
+		modTime = configModTime(s.cfg().file)
+		s.reloadConfig()
+	}
+}
+
+// configModTime returns when the config file was last modified, zero if it can't be read
+func configModTime(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
+
+// reloadConfig loads the config again with the same flags and applies it. Invalid configs
+// are rejected and the current one is kept.
+func (s *Server) reloadConfig() {
+	current := s.cfg()
+	cfg, err := LoadConfig(current.args)
+	if err != nil {
+		fmt.Println(Entry{
+			Severity:  "ERROR",
+			Message:   "Rejected config reload: " + err.Error(),
+			Component: "config",
+		})
+		return
+	}
+
+	changes := diffConfig(current, cfg)
+	applied := []string{}
+	for _, change := range changes {
+		if change.restart {
+			fmt.Println(Entry{
+				Severity:  "WARNING",
+				Message:   "Config change needs a restart to take effect: " + change.String(),
+				Component: "config",
+			})
+			continue
+		}
+
+		applied = append(applied, change.String())
+	}
+
+	s.applyConfig(keepRestartSettings(current, cfg).withParsed())
+
+	if len(applied) == 0 {
+		fmt.Println(Entry{Message: "Reloaded config, nothing changed", Component: "config"})
+		return
+	}
+
+	fmt.Println(Entry{
+		Message:   "Reloaded config: " + strings.Join(applied, ", "),
+		Component: "config",
+	})
+}
+
+// applyConfig makes cfg the current config. Requests in flight keep the config they
+// started with where they already read it. Everything requests read, the rate limits
+// included, comes from the config, so it is swapped in a single store. The outbound
+// limiter and the webhooks aren't used by a request on its own and follow once it's stored.
+func (s *Server) applyConfig(cfg Config) {
+	s.config.Store(cfg)
+	s.outbound.setLimits(cfg.UpstreamRequestsPerSecond, cfg.UpstreamBurst)
+	s.webhooks.configure(cfg.WebhookURLs, cfg.WebhookSecret)
+}
+
+// keepRestartSettings returns next with the settings that need a restart taken from current,
+// so that the running server and its config agree
+func keepRestartSettings(current Config, next Config) Config {
+	cur := reflect.ValueOf(&current).Elem()
+	nxt := reflect.ValueOf(&next).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		if cur.Type().Field(i).Tag.Get("reload") == "restart" {
+			nxt.Field(i).Set(cur.Field(i))
+		}
+	}
+
+	return next
+}
+
+// diffConfig lists the settings that differ between two configs, with secrets redacted
+func diffConfig(from Config, to Config) []configChange {
+	return diffValues("", reflect.ValueOf(from), reflect.ValueOf(to), reflect.ValueOf(from.Redacted()), reflect.ValueOf(to.Redacted()))
+}
+
+// diffValues compares the fields of two structs, shown holds the values that are logged
+func diffValues(prefix string, from, to, fromShown, toShown reflect.Value) []configChange {
+	changes := []configChange{}
+	for i := 0; i < from.NumField(); i++ {
+		field := from.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name := prefix + strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(Duration{}) {
+			changes = append(changes, diffValues(name+".", from.Field(i), to.Field(i), fromShown.Field(i), toShown.Field(i))...)
+			continue
+		}
+
+		if reflect.DeepEqual(from.Field(i).Interface(), to.Field(i).Interface()) {
+			continue
+		}
+
+		changes = append(changes, configChange{
+			name:    name,
+			from:    fmt.Sprintf("%v", fromShown.Field(i).Interface()),
+			to:      fmt.Sprintf("%v", toShown.Field(i).Interface()),
+			restart: field.Tag.Get("reload") == "restart",
+		})
+	}
+
+	return changes
+}
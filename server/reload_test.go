@@ -0,0 +1,126 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffConfig(t *testing.T) {
+	from := DefaultConfig()
+	from.WebhookSecret = "old-secret"
+
+	to := from
+	to.RateLimitPerMinute = 120
+	to.Addr = ":9000"
+	to.Features.Export = !from.Features.Export
+	to.UpstreamTimeout = Duration{time.Minute}
+	to.WebhookSecret = "new-secret"
+	to.WebhookURLs = []string{"https://hooks.example.com/hooks/webhook-token"}
+	to.args = []string{"-addr", ":9000"}
+
+	changes := map[string]configChange{}
+	for _, change := range diffConfig(from, to) {
+		changes[change.name] = change
+	}
+
+	want := map[string]bool{
+		"rateLimitPerMinute": false,
+		"addr":               true,
+		"features.export":    false,
+		"upstreamTimeout":    false,
+		"webhookSecret":      false,
+		"webhookURLs":        false,
+	}
+	if len(changes) != len(want) {
+		t.Errorf("got changes %v, want %d", changes, len(want))
+	}
+	for name, restart := range want {
+		change, ok := changes[name]
+		if !ok {
+			t.Errorf("%s: no change", name)
+			continue
+		}
+		if change.restart != restart {
+			t.Errorf("%s: restart = %t, want %t", name, change.restart, restart)
+		}
+	}
+
+	if change := changes["rateLimitPerMinute"]; change.String() != "rateLimitPerMinute: 60 -> 120" {
+		t.Errorf("change = %q", change.String())
+	}
+	if change := changes["upstreamTimeout"]; change.to != "1m0s" {
+		t.Errorf("upstreamTimeout changed to %q, want a duration", change.to)
+	}
+
+	// Secrets and the tokens in webhook URLs are never logged
+	for _, change := range changes {
+		for _, secret := range []string{"old-secret", "new-secret", "webhook-token"} {
+			if strings.Contains(change.String(), secret) {
+				t.Errorf("change %q shows %s", change.String(), secret)
+			}
+		}
+	}
+
+	if changes := diffConfig(from, from); len(changes) != 0 {
+		t.Errorf("got changes %v between the same configs", changes)
+	}
+}
+
+// writeConfig writes the YAML config of a test server to path
+func writeConfig(t *testing.T, path string, config string) {
+	t.Helper()
+
+	config = "clientID: test-client-id\nfrontendURL: http://frontend.test\nreportStore: memory\n" + config
+	if err := ioutil.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "addr: :8000\nrateLimitPerMinute: 60\nrateLimitBurst: 3\n")
+
+	cfg, err := LoadConfig([]string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := s.rateLimit(func(w http.ResponseWriter, r *http.Request) {})
+
+	writeConfig(t, path, "addr: :9000\nrateLimitPerMinute: 60\nrateLimitBurst: 1\nwebhookURLs: [https://hooks.example.com/]\n")
+	s.reloadConfig()
+
+	// Settings that need a restart keep the value the server runs with
+	if got := s.cfg(); got.RateLimitBurst != 1 || got.Addr != ":8000" || got.file != path {
+		t.Errorf("config after a reload = %+v, want the new burst and the old addr", got)
+	}
+	if urls, _ := s.webhooks.targets(); len(urls) != 1 {
+		t.Errorf("webhooks after a reload = %v, want the new one", urls)
+	}
+
+	// The rate limit follows the config right away
+	codes := []int{}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("POST", "/v1/track", nil))
+		codes = append(codes, w.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusTooManyRequests {
+		t.Errorf("got %v, want a burst of 1 after the reload", codes)
+	}
+
+	// Invalid configs are rejected as a whole
+	writeConfig(t, path, "rateLimitBurst: 10\nrateLimitPerMinut: 120\n")
+	s.reloadConfig()
+	if got := s.cfg(); got.RateLimitBurst != 1 {
+		t.Errorf("config after an invalid reload = %+v, want the previous one", got)
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons a user can report a link for
+const (
+	reportReasonBroken     = "broken"
+	reportReasonCopyright  = "copyright"
+	reportReasonWrongTrack = "wrong_track"
+	reportReasonOther      = "other"
+)
+
+var reportReasons = []string{reportReasonBroken, reportReasonCopyright, reportReasonWrongTrack, reportReasonOther}
+
+var errReportNotFound = errors.New("Report not found")
+
+// report is a user report about a link that couldn't be downloaded properly. Reports of the
+// same URL are merged and counted, keeping the reason and download type of the latest one.
+type report struct {
+	ID           int64     `json:"id"`
+	URL          string    `json:"url"`
+	DownloadType string    `json:"downloadType"`
+	Reason       string    `json:"reason"`
+	Comment      string    `json:"comment"`
+	Count        int       `json:"count"`
+	Resolved     bool      `json:"resolved"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+
+	normalizedURL string
+}
+
+// reportFilter narrows down the reports returned by a reportStore. Zero values match everything.
+type reportFilter struct {
+	Reason       string
+	DownloadType string
+	URL          string
+	Resolved     *bool
+	Limit        int
+	Offset       int
+}
+
+// reportStore persists reports
+type reportStore interface {
+	// Add stores a report, or increments the count of an existing report of the same URL
+	// and reopens it
+	Add(r report) (report, error)
+	// List returns the reports matching the filter, most reported first
+	List(filter reportFilter) ([]report, error)
+	// Resolve marks a report as resolved and resets its count, so that the URL notifies
+	// webhooks again if it is reported as often after the fix
+	Resolve(id int64) (report, error)
+	Close() error
+}
+
+// normalizeReason maps a user supplied reason onto one of reportReasons
+func normalizeReason(reason string) string {
+	reason = strings.ToLower(strings.TrimSpace(reason))
+	for _, r := range reportReasons {
+		if r == reason {
+			return r
+		}
+	}
+
+	return reportReasonOther
+}
+
+// newReport returns a report of a URL made now
+func newReport(url string, downloadType string, reason string, comment string) report {
+	now := time.Now().UTC()
+	return report{
+		URL:           url,
+		DownloadType:  strings.ToLower(downloadType),
+		Reason:        normalizeReason(reason),
+		Comment:       comment,
+		Count:         1,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+		normalizedURL: canonicalURL(url),
+	}
+}
+
+// memoryReportStore keeps reports in memory, they are lost when the server stops
+type memoryReportStore struct {
+	mu      sync.Mutex
+	reports []report
+}
+
+func newMemoryReportStore() *memoryReportStore {
+	return &memoryReportStore{}
+}
+
+func (m *memoryReportStore) Add(r report) (report, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, existing := range m.reports {
+		if existing.normalizedURL == r.normalizedURL {
+			m.reports[i].Count++
+			m.reports[i].Resolved = false
+			m.reports[i].Reason = r.Reason
+			m.reports[i].DownloadType = r.DownloadType
+			m.reports[i].UpdatedAt = r.UpdatedAt
+			if r.Comment != "" {
+				m.reports[i].Comment = r.Comment
+			}
+			return m.reports[i], nil
+		}
+	}
+
+	r.ID = int64(len(m.reports) + 1)
+	m.reports = append(m.reports, r)
+	return r, nil
+}
+
+func (m *memoryReportStore) List(filter reportFilter) ([]report, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	reports := []report{}
+	for _, r := range m.reports {
+		if filter.Reason != "" && r.Reason != filter.Reason {
+			continue
+		}
+		if filter.DownloadType != "" && r.DownloadType != filter.DownloadType {
+			continue
+		}
+		if filter.URL != "" && r.normalizedURL != canonicalURL(filter.URL) {
+			continue
+		}
+		if filter.Resolved != nil && r.Resolved != *filter.Resolved {
+			continue
+		}
+		reports = append(reports, r)
+	}
+
+	sort.SliceStable(reports, func(i, j int) bool {
+		if reports[i].Count != reports[j].Count {
+			return reports[i].Count > reports[j].Count
+		}
+		return reports[i].UpdatedAt.After(reports[j].UpdatedAt)
+	})
+
+	if filter.Offset >= len(reports) {
+		return []report{}, nil
+	}
+	reports = reports[filter.Offset:]
+
+	if filter.Limit > 0 && filter.Limit < len(reports) {
+		reports = reports[:filter.Limit]
+	}
+
+	return reports, nil
+}
+
+func (m *memoryReportStore) Resolve(id int64) (report, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, r := range m.reports {
+		if r.ID == id {
+			m.reports[i].Resolved = true
+			m.reports[i].Count = 0
+			m.reports[i].UpdatedAt = time.Now().UTC()
+			return m.reports[i], nil
+		}
+	}
+
+	return report{}, errReportNotFound
+}
+
+func (m *memoryReportStore) Close() error {
+	return nil
+}
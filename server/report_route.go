@@ -6,29 +6,75 @@ import (
 	"net/http"
 )
 
-func (s *Server) handleReport() http.HandlerFunc {
-	type responseBody struct {
+const (
+	// maxReportBodyBytes bounds the body of a report, so that reports can't grow the store
+	// without bound
+	maxReportBodyBytes = 16 << 10
+	// maxReportURLLength is the longest URL that can be reported
+	maxReportURLLength = 2048
+	// maxReportCommentLength is how many characters of a comment are kept
+	maxReportCommentLength = 1000
+	// maxReportTypeLength is how many characters of a download type are kept
+	maxReportTypeLength = 32
+)
+
+// truncate returns the first max characters of s
+func truncate(s string, max int) string {
+	if runes := []rune(s); len(runes) > max {
+		return string(runes[:max])
+	}
+
+	return s
+}
+
+func (s *Server) handleReport() apiHandler {
+	type requestBody struct {
 		URL          string `json:"url"`
 		DownloadType string `json:"downloadType"`
+		Reason       string `json:"reason"`
+		Comment      string `json:"comment"`
 	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", s.frontendURL)
+	type responseBody struct {
+		URL    string `json:"url"`
+		Reason string `json:"reason"`
+		// Count is how many times the URL was reported since it was last fixed
+		Count int `json:"count"`
+	}
 
-		decoder := json.NewDecoder(r.Body)
-		body := &responseBody{}
+	return func(w http.ResponseWriter, r *http.Request) error {
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxReportBodyBytes))
+		body := &requestBody{}
 
 		err := decoder.Decode(body)
+		if err != nil || body.URL == "" {
+			return newAPIError(codeInvalidRequest)
+		}
+
+		if len(body.URL) > maxReportURLLength {
+			return newAPIError(codeInvalidRequest).variant("report_url").with("max", maxReportURLLength)
+		}
+
+		comment := truncate(body.Comment, maxReportCommentLength)
+		rep, err := s.reports.Add(newReport(body.URL, truncate(body.DownloadType, maxReportTypeLength), body.Reason, comment))
 		if err != nil {
-			s.respondError(w, "Invalid body", http.StatusBadRequest)
-			return
+			return err
 		}
 
 		fmt.Println(Entry{
 			Severity:  "NOTICE",
-			Message:   fmt.Sprintf("TYPE: %s URL: %s", body.DownloadType, body.URL),
+			Message:   fmt.Sprintf("TYPE: %s URL: %s REASON: %s COUNT: %d", rep.DownloadType, rep.URL, rep.Reason, rep.Count),
 			Component: "report-link",
 			Trace:     "downloadsoundcloud",
 		})
+
+		// Resolving a report resets its count, so the threshold is crossed again if the URL
+		// breaks again
+		if rep.Count == s.cfg().ReportWebhookThreshold {
+			s.webhooks.dispatch(eventReportThreshold, &rep)
+		}
+
+		s.respondJSON(w, &responseBody{URL: rep.URL, Reason: rep.Reason, Count: rep.Count}, http.StatusOK)
+		return nil
 	}
 }
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	// Registers the sqlite3 driver
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const reportSchema = `
+CREATE TABLE IF NOT EXISTS reports (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	url TEXT NOT NULL,
+	normalized_url TEXT NOT NULL,
+	download_type TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	comment TEXT NOT NULL DEFAULT '',
+	count INTEGER NOT NULL DEFAULT 1,
+	resolved BOOLEAN NOT NULL DEFAULT 0,
+	created_at DATETIME NOT NULL,
+	updated_at DATETIME NOT NULL,
+	UNIQUE (normalized_url)
+);
+CREATE INDEX IF NOT EXISTS reports_count ON reports (count DESC, updated_at DESC);
+`
+
+// reportMigration merges the reports of databases that kept a report per URL and reason
+// into the latest report of each URL
+const reportMigration = `
+UPDATE reports SET count = (SELECT SUM(count) FROM reports AS other WHERE other.normalized_url = reports.normalized_url)
+	WHERE id IN (SELECT MAX(id) FROM reports GROUP BY normalized_url HAVING COUNT(*) > 1);
+DELETE FROM reports WHERE id NOT IN (SELECT MAX(id) FROM reports GROUP BY normalized_url);
+CREATE UNIQUE INDEX IF NOT EXISTS reports_url ON reports (normalized_url);
+`
+
+const reportColumns = "id, url, normalized_url, download_type, reason, comment, count, resolved, created_at, updated_at"
+
+// sqliteReportStore persists reports to a SQLite database file
+type sqliteReportStore struct {
+	db *sql.DB
+}
+
+func newSQLiteReportStore(path string) (*sqliteReportStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only supports a single writer
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(reportSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := migrateReports(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &sqliteReportStore{db: db}, nil
+}
+
+// migrateReports runs reportMigration in a transaction
+func migrateReports(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(reportMigration); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanReport(row rowScanner) (report, error) {
+	r := report{}
+	err := row.Scan(&r.ID, &r.URL, &r.normalizedURL, &r.DownloadType, &r.Reason, &r.Comment, &r.Count, &r.Resolved, &r.CreatedAt, &r.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return r, errReportNotFound
+	}
+
+	return r, err
+}
+
+func (s *sqliteReportStore) Add(r report) (report, error) {
+	_, err := s.db.Exec(`
+		INSERT INTO reports (url, normalized_url, download_type, reason, comment, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (normalized_url) DO UPDATE SET
+			count = count + 1,
+			resolved = 0,
+			reason = excluded.reason,
+			download_type = excluded.download_type,
+			updated_at = excluded.updated_at,
+			comment = CASE WHEN excluded.comment != '' THEN excluded.comment ELSE comment END`,
+		r.URL, r.normalizedURL, r.DownloadType, r.Reason, r.Comment, r.CreatedAt, r.UpdatedAt)
+	if err != nil {
+		return report{}, err
+	}
+
+	return scanReport(s.db.QueryRow("SELECT "+reportColumns+" FROM reports WHERE normalized_url = ?", r.normalizedURL))
+}
+
+func (s *sqliteReportStore) List(filter reportFilter) ([]report, error) {
+	where := []string{}
+	args := []interface{}{}
+	if filter.Reason != "" {
+		where = append(where, "reason = ?")
+		args = append(args, filter.Reason)
+	}
+	if filter.DownloadType != "" {
+		where = append(where, "download_type = ?")
+		args = append(args, filter.DownloadType)
+	}
+	if filter.URL != "" {
+		where = append(where, "normalized_url = ?")
+		args = append(args, canonicalURL(filter.URL))
+	}
+	if filter.Resolved != nil {
+		where = append(where, "resolved = ?")
+		args = append(args, *filter.Resolved)
+	}
+
+	query := "SELECT " + reportColumns + " FROM reports"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY count DESC, updated_at DESC LIMIT ? OFFSET ?"
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	args = append(args, limit, filter.Offset)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []report{}
+	for rows.Next() {
+		r, err := scanReport(rows)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, r)
+	}
+
+	return reports, rows.Err()
+}
+
+func (s *sqliteReportStore) Resolve(id int64) (report, error) {
+	res, err := s.db.Exec("UPDATE reports SET resolved = 1, count = 0, updated_at = ? WHERE id = ?", time.Now().UTC(), id)
+	if err != nil {
+		return report{}, err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return report{}, errReportNotFound
+	}
+
+	return scanReport(s.db.QueryRow("SELECT "+reportColumns+" FROM reports WHERE id = ?", id))
+}
+
+func (s *sqliteReportStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,284 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// reportStores returns a new store of every kind, keyed by name
+func reportStores(t *testing.T) map[string]reportStore {
+	t.Helper()
+
+	sqlite, err := newSQLiteReportStore(filepath.Join(t.TempDir(), "reports.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlite.Close() })
+
+	return map[string]reportStore{"memory": newMemoryReportStore(), "sqlite": sqlite}
+}
+
+func TestReportStoreMergesReportsOfAURL(t *testing.T) {
+	for name, store := range reportStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, rep := range []report{
+				newReport("https://soundcloud.com/artist/one", "track", "broken", "No sound"),
+				newReport("https://www.soundcloud.com/artist/one/", "track", "copyright", ""),
+				newReport("https://soundcloud.com/artist/two", "track", "broken", ""),
+				newReport("https://m.soundcloud.com/artist/one", "playlist", "wrong_track", ""),
+			} {
+				if _, err := store.Add(rep); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			reports, err := store.List(reportFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(reports) != 2 {
+				t.Fatalf("got %d reports, want the 2 reported URLs", len(reports))
+			}
+
+			// The latest report of a URL says what is wrong with it, its comment is kept
+			merged := reports[0]
+			if merged.Count != 3 || merged.Reason != reportReasonWrongTrack || merged.DownloadType != "playlist" || merged.Comment != "No sound" {
+				t.Errorf("merged report = %+v, want 3 reports with the reason and type of the latest one", merged)
+			}
+			if reports[1].Count != 1 {
+				t.Errorf("report of another URL = %+v, want a count of 1", reports[1])
+			}
+		})
+	}
+}
+
+func TestReportStoreFilters(t *testing.T) {
+	for name, store := range reportStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, u := range []string{"one", "one", "one", "two", "two", "three"} {
+				reason := "broken"
+				if u == "three" {
+					reason = "copyright"
+				}
+				if _, err := store.Add(newReport("https://soundcloud.com/artist/"+u, "track", reason, "")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			open, resolved := false, true
+			tests := []struct {
+				name   string
+				filter reportFilter
+				want   []string
+			}{
+				{"everything", reportFilter{}, []string{"one", "two", "three"}},
+				{"reason", reportFilter{Reason: reportReasonCopyright}, []string{"three"}},
+				{"URL", reportFilter{URL: "https://www.soundcloud.com/artist/two/"}, []string{"two"}},
+				{"open", reportFilter{Resolved: &open}, []string{"one", "two", "three"}},
+				{"resolved", reportFilter{Resolved: &resolved}, []string{}},
+				{"page", reportFilter{Limit: 1, Offset: 1}, []string{"two"}},
+				{"past the end", reportFilter{Offset: 3}, []string{}},
+			}
+
+			for _, test := range tests {
+				reports, err := store.List(test.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				got := []string{}
+				for _, rep := range reports {
+					got = append(got, strings.TrimPrefix(rep.URL, "https://soundcloud.com/artist/"))
+				}
+				if strings.Join(got, ",") != strings.Join(test.want, ",") {
+					t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestReportStoreResolve(t *testing.T) {
+	for name, store := range reportStores(t) {
+		t.Run(name, func(t *testing.T) {
+			rep, _ := store.Add(newReport("https://soundcloud.com/artist/one", "track", "broken", ""))
+			store.Add(newReport("https://soundcloud.com/artist/one", "track", "broken", ""))
+
+			resolved, err := store.Resolve(rep.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !resolved.Resolved || resolved.Count != 0 {
+				t.Errorf("resolved report = %+v, want it resolved with its count reset", resolved)
+			}
+
+			// Reports after the fix reopen it and count from scratch
+			reopened, err := store.Add(newReport("https://soundcloud.com/artist/one", "track", "broken", ""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reopened.ID != rep.ID || reopened.Resolved || reopened.Count != 1 {
+				t.Errorf("reopened report = %+v, want report %d open with a count of 1", reopened, rep.ID)
+			}
+
+			if _, err := store.Resolve(rep.ID + 100); err != errReportNotFound {
+				t.Errorf("resolving a missing report: err = %v, want %v", err, errReportNotFound)
+			}
+		})
+	}
+}
+
+func TestSQLiteReportStorePersists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.db")
+	store, err := newSQLiteReportStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep, _ := store.Add(newReport("https://soundcloud.com/artist/one", "track", "broken", "No sound"))
+	store.Add(newReport("https://soundcloud.com/artist/one", "track", "broken", ""))
+	store.Resolve(rep.ID)
+	store.Add(newReport("https://soundcloud.com/artist/one", "track", "copyright", ""))
+	store.Add(newReport("https://soundcloud.com/artist/two", "track", "broken", ""))
+	store.Close()
+
+	store, err = newSQLiteReportStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if reports, _ := store.List(reportFilter{}); len(reports) != 2 {
+		t.Fatalf("got %d reports after a restart, want 2", len(reports))
+	}
+	reports, err := store.List(reportFilter{URL: "https://soundcloud.com/artist/one"})
+	if err != nil || len(reports) != 1 {
+		t.Fatalf("reports of the URL after a restart = %v, %v", reports, err)
+	}
+	if got := reports[0]; got.ID != rep.ID || got.Count != 1 || got.Reason != reportReasonCopyright || got.Comment != "No sound" || got.Resolved {
+		t.Errorf("report after a restart = %+v", got)
+	}
+
+	// Reports keep being merged after a restart
+	if merged, _ := store.Add(newReport("https://soundcloud.com/artist/two", "track", "other", "")); merged.Count != 2 {
+		t.Errorf("report after a restart = %+v, want a count of 2", merged)
+	}
+}
+
+func TestSQLiteReportStoreMigratesReportsPerReason(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The schema used to have a report per URL and reason
+	old := strings.Replace(reportSchema, "UNIQUE (normalized_url)", "UNIQUE (normalized_url, reason)", 1)
+	if _, err := db.Exec(old); err != nil {
+		t.Fatal(err)
+	}
+	for _, rep := range []report{
+		newReport("https://soundcloud.com/artist/one", "track", "broken", ""),
+		newReport("https://soundcloud.com/artist/one", "track", "copyright", ""),
+		newReport("https://soundcloud.com/artist/two", "track", "broken", ""),
+	} {
+		_, err := db.Exec("INSERT INTO reports (url, normalized_url, download_type, reason, comment, count, created_at, updated_at) VALUES (?, ?, ?, ?, ?, 2, ?, ?)",
+			rep.URL, rep.normalizedURL, rep.DownloadType, rep.Reason, rep.Comment, rep.CreatedAt, rep.UpdatedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	store, err := newSQLiteReportStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	merged, err := store.Add(newReport("https://soundcloud.com/artist/one", "track", "other", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Count != 5 || merged.Reason != reportReasonOther {
+		t.Errorf("merged report = %+v, want the 4 earlier reports and the new one", merged)
+	}
+	if reports, _ := store.List(reportFilter{}); len(reports) != 2 {
+		t.Errorf("got %d reports, want one per URL", len(reports))
+	}
+}
+
+// waitForDeliveries waits for the dispatcher to log n deliveries
+func waitForDeliveries(t *testing.T, d *webhookDispatcher, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for len(d.deliveries()) < n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Give unexpected deliveries a chance to show up
+	time.Sleep(20 * time.Millisecond)
+
+	if deliveries := d.deliveries(); len(deliveries) != n {
+		t.Fatalf("got %d webhook deliveries, want %d", len(deliveries), n)
+	}
+}
+
+func TestReportThresholdNotifiesWebhooksOncePerFix(t *testing.T) {
+	var received int32
+	receiver := newWebhookReceiver(t, 0, &received)
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.WebhookURLs = []string{receiver.URL}
+		cfg.ReportWebhookThreshold = 2
+	})
+	handler := s.handler()
+
+	report := func(reason string) int {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		body := `{"url":"https://soundcloud.com/artist/one","downloadType":"track","reason":"` + reason + `"}`
+		handler.ServeHTTP(w, httptest.NewRequest("POST", "/v2/report", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d %s, want 200", w.Code, w.Body.String())
+		}
+
+		res := struct {
+			Count int `json:"count"`
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Count
+	}
+
+	// Reports of any reason count towards the threshold of a URL
+	report("broken")
+	if count := report("copyright"); count != 2 {
+		t.Errorf("count = %d, want 2", count)
+	}
+	report("broken")
+	waitForDeliveries(t, s.webhooks, 1)
+
+	reports, _ := s.reports.List(reportFilter{})
+	if _, err := s.reports.Resolve(reports[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once fixed, the URL notifies webhooks again if it breaks again
+	if count := report("broken"); count != 1 {
+		t.Errorf("count after the fix = %d, want 1", count)
+	}
+	waitForDeliveries(t, s.webhooks, 1)
+	report("broken")
+	waitForDeliveries(t, s.webhooks, 2)
+
+	if received := atomic.LoadInt32(&received); received != 2 {
+		t.Errorf("webhook got %d requests, want 2", received)
+	}
+}
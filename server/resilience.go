@@ -0,0 +1,415 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// retryBaseDelay is the delay before the first retry, it doubles every retry
+	retryBaseDelay = 200 * time.Millisecond
+	// retryMaxDelay caps the delay between retries
+	retryMaxDelay = 5 * time.Second
+	// retryMaxAfter is the longest Retry-After that is waited for, the response is returned
+	// as is if SoundCloud asks for more
+	retryMaxAfter = 10 * time.Second
+)
+
+// errCircuitOpen is returned without contacting a host whose circuit breaker is open
+var errCircuitOpen = errors.New("upstream circuit breaker is open")
+
+// Outcomes of a request to an upstream host
+const (
+	outcomeOK          = "ok"
+	outcomeRateLimited = "rate_limited"
+	outcomeServerError = "server_error"
+	outcomeTimeout     = "timeout"
+	outcomeError       = "error"
+	outcomeCanceled    = "canceled"
+	outcomeRejected    = "rejected"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	}
+
+	return "closed"
+}
+
+// circuitBreaker stops requests to a host after too many consecutive failures. Once the
+// cooldown has passed a single request is let through, which closes the breaker again if it
+// succeeds.
+type circuitBreaker struct {
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+	opens    int64
+}
+
+// allow reports whether a request may be made
+func (b *circuitBreaker) allow(cooldown time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerOpen && time.Since(b.openedAt) >= cooldown {
+		b.state = breakerHalfOpen
+	}
+
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+
+	return true
+}
+
+// record records the outcome of an allowed request
+func (b *circuitBreaker) record(failed bool, threshold int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if !failed {
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= threshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		b.opens++
+	}
+}
+
+// abort gives up on an allowed request without recording an outcome, e.g. when the client
+// went away
+func (b *circuitBreaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// hostStats are the circuit breaker and counters of an upstream host
+type hostStats struct {
+	breaker circuitBreaker
+
+	mu       sync.Mutex
+	outcomes map[string]int64
+	retries  int64
+}
+
+func (h *hostStats) count(outcome string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.outcomes[outcome]++
+}
+
+func (h *hostStats) retried() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.retries++
+}
+
+// upstreamHosts keeps the stats of every host the server makes requests to
+type upstreamHosts struct {
+	mu    sync.Mutex
+	hosts map[string]*hostStats
+}
+
+func newUpstreamHosts() *upstreamHosts {
+	return &upstreamHosts{hosts: map[string]*hostStats{}}
+}
+
+func (u *upstreamHosts) get(host string) *hostStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	h, ok := u.hosts[host]
+	if !ok {
+		h = &hostStats{outcomes: map[string]int64{}}
+		u.hosts[host] = h
+	}
+
+	return h
+}
+
+// hostSnapshot is a copy of the stats of a host
+type hostSnapshot struct {
+	Host                string           `json:"host"`
+	State               string           `json:"state"`
+	ConsecutiveFailures int              `json:"consecutiveFailures"`
+	Opens               int64            `json:"opens"`
+	Retries             int64            `json:"retries"`
+	Outcomes            map[string]int64 `json:"outcomes"`
+	state               breakerState
+}
+
+// snapshot returns the stats of every host, sorted by host
+func (u *upstreamHosts) snapshot() []hostSnapshot {
+	u.mu.Lock()
+	hosts := make(map[string]*hostStats, len(u.hosts))
+	for name, h := range u.hosts {
+		hosts[name] = h
+	}
+	u.mu.Unlock()
+
+	snapshots := make([]hostSnapshot, 0, len(hosts))
+	for name, h := range hosts {
+		snap := hostSnapshot{Host: name, Outcomes: map[string]int64{}}
+
+		h.breaker.mu.Lock()
+		snap.state = h.breaker.state
+		snap.ConsecutiveFailures = h.breaker.failures
+		snap.Opens = h.breaker.opens
+		h.breaker.mu.Unlock()
+		snap.State = snap.state.String()
+
+		h.mu.Lock()
+		snap.Retries = h.retries
+		for outcome, n := range h.outcomes {
+			snap.Outcomes[outcome] = n
+		}
+		h.mu.Unlock()
+
+		snapshots = append(snapshots, snap)
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Host < snapshots[j].Host })
+	return snapshots
+}
+
+// resilientTransport paces every request with the outbound limiter and retries idempotent
+// requests that failed with a 429, a 5xx, a timeout or a network error, with jittered
+// exponential backoff or as long as Retry-After says. Every host has a circuit breaker so
+// that requests fail fast while SoundCloud is down.
+type resilientTransport struct {
+	next   http.RoundTripper
+	server *Server
+	// timeAttempts limits every attempt with UpstreamAttemptTimeout and the whole request with
+	// UpstreamTimeout, it is off for transports with their own ResponseHeaderTimeout
+	timeAttempts bool
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cfg := t.server.cfg()
+	stats := t.server.hosts.get(req.URL.Host)
+
+	attempts := 1
+	if req.Method == "GET" || req.Method == "HEAD" || req.Method == "OPTIONS" {
+		attempts += cfg.UpstreamRetries
+	}
+
+	// The time limit of the request starts once the outbound limiter first lets it through,
+	// so that the requests of a large collection don't time out while they are paced. It is
+	// released with the body of the response.
+	limited := req
+	var cancel context.CancelFunc
+	defer func() {
+		if cancel != nil {
+			cancel()
+		}
+	}()
+	keep := func(res *http.Response) *http.Response {
+		if res != nil && cancel != nil {
+			res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+			cancel = nil
+		}
+		return res
+	}
+
+	for attempt := 0; ; attempt++ {
+		// Waiting for the limiter is neither part of an attempt nor an outcome of the host
+		if err := t.server.outbound.wait(limited.Context()); err != nil {
+			return nil, err
+		}
+		if cancel == nil && t.timeAttempts && cfg.UpstreamTimeout.Duration > 0 {
+			ctx, cancelLimit := context.WithTimeout(req.Context(), cfg.UpstreamTimeout.Duration)
+			limited, cancel = req.WithContext(ctx), cancelLimit
+		}
+
+		if !stats.breaker.allow(cfg.UpstreamBreakerCooldown.Duration) {
+			stats.count(outcomeRejected)
+			return nil, errCircuitOpen
+		}
+
+		timeout := time.Duration(0)
+		if t.timeAttempts {
+			timeout = cfg.UpstreamAttemptTimeout.Duration
+		}
+
+		res, err := t.attempt(limited, timeout)
+		outcome := classifyOutcome(req, res, err)
+		stats.count(outcome)
+
+		switch outcome {
+		case outcomeCanceled:
+			stats.breaker.abort()
+			return keep(res), err
+		case outcomeOK, outcomeRateLimited:
+			stats.breaker.record(false, cfg.UpstreamBreakerThreshold)
+		default:
+			stats.breaker.record(true, cfg.UpstreamBreakerThreshold)
+		}
+
+		if outcome == outcomeOK || attempt+1 >= attempts {
+			return keep(res), err
+		}
+
+		delay := retryDelay(attempt)
+		if res != nil {
+			if after, ok := retryAfter(res); ok {
+				if after > retryMaxAfter {
+					return keep(res), err
+				}
+				delay = after
+			}
+		}
+
+		if deadline, ok := limited.Context().Deadline(); ok && time.Until(deadline) < delay {
+			return keep(res), err
+		}
+
+		if res != nil {
+			io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64<<10))
+			res.Body.Close()
+		}
+
+		stats.retried()
+		select {
+		case <-time.After(delay):
+		case <-limited.Context().Done():
+			return nil, limited.Context().Err()
+		}
+	}
+}
+
+// attempt makes a single request, giving up if the response headers take longer than
+// timeout. The body isn't limited, so that media can be streamed.
+func (t *resilientTransport) attempt(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return t.next.RoundTrip(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+
+	res, err := t.next.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() && atomic.LoadInt32(&timedOut) == 1 {
+		if res != nil {
+			res.Body.Close()
+		}
+		// DeadlineExceeded is a net.Error that reports a timeout
+		return nil, context.DeadlineExceeded
+	}
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	res.Body = &cancelOnClose{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelOnClose releases the context of a request once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func classifyOutcome(req *http.Request, res *http.Response, err error) string {
+	switch {
+	case req.Context().Err() != nil:
+		return outcomeCanceled
+	case isTimeout(err):
+		return outcomeTimeout
+	case err != nil:
+		return outcomeError
+	case res.StatusCode == http.StatusTooManyRequests:
+		return outcomeRateLimited
+	case res.StatusCode >= 500:
+		return outcomeServerError
+	}
+
+	return outcomeOK
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// retryDelay returns the delay before retry number attempt+1, with full jitter on its upper half
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << uint(attempt)
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter parses the Retry-After header, given in seconds or as an HTTP date
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// scriptedResponse is a response of a scripted upstream
+type scriptedResponse struct {
+	status     int
+	retryAfter string
+	delay      time.Duration
+}
+
+// newScriptedUpstream returns an upstream that answers its requests with responses in order,
+// repeating the last one, and counts them in requests
+func newScriptedUpstream(t *testing.T, responses []scriptedResponse, requests *int32) *httptest.Server {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(requests, 1))
+		if n > len(responses) {
+			n = len(responses)
+		}
+		res := responses[n-1]
+
+		time.Sleep(res.delay)
+		if res.retryAfter != "" {
+			w.Header().Set("Retry-After", res.retryAfter)
+		}
+		w.WriteHeader(res.status)
+	}))
+	t.Cleanup(upstream.Close)
+
+	return upstream
+}
+
+// newResilientClient returns a client whose requests go through the retries and circuit
+// breakers of a test server
+func newResilientClient(t *testing.T, configure func(*Config)) (*Server, *http.Client) {
+	t.Helper()
+
+	s := newTestServer(t, configure)
+	return s, &http.Client{Transport: s.upstreamRoundTripper(http.DefaultTransport, true)}
+}
+
+func TestUpstreamRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		responses []scriptedResponse
+		status    int
+		requests  int32
+		outcomes  map[string]int64
+	}{
+		{"server error", "GET", []scriptedResponse{{status: 503, retryAfter: "0"}, {status: 200}}, 200, 2, map[string]int64{outcomeServerError: 1, outcomeOK: 1}},
+		{"rate limited", "GET", []scriptedResponse{{status: 429, retryAfter: "0"}, {status: 200}}, 200, 2, map[string]int64{outcomeRateLimited: 1, outcomeOK: 1}},
+		{"timed out attempt", "GET", []scriptedResponse{{status: 200, delay: 100 * time.Millisecond}, {status: 200}}, 200, 2, map[string]int64{outcomeTimeout: 1, outcomeOK: 1}},
+		{"gives up", "GET", []scriptedResponse{{status: 500, retryAfter: "0"}}, 500, 3, map[string]int64{outcomeServerError: 3}},
+		{"client error", "GET", []scriptedResponse{{status: 404}, {status: 200}}, 404, 1, map[string]int64{outcomeOK: 1}},
+		{"not idempotent", "POST", []scriptedResponse{{status: 500, retryAfter: "0"}, {status: 200}}, 500, 1, map[string]int64{outcomeServerError: 1}},
+		{"Retry-After too long", "GET", []scriptedResponse{{status: 429, retryAfter: "60"}, {status: 200}}, 429, 1, map[string]int64{outcomeRateLimited: 1}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests int32
+			upstream := newScriptedUpstream(t, test.responses, &requests)
+			s, client := newResilientClient(t, func(cfg *Config) {
+				cfg.UpstreamRetries = 2
+				cfg.UpstreamAttemptTimeout = Duration{20 * time.Millisecond}
+			})
+
+			req, _ := http.NewRequest(test.method, upstream.URL, nil)
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("status = %d, want %d", res.StatusCode, test.status)
+			}
+			if requests := atomic.LoadInt32(&requests); requests != test.requests {
+				t.Errorf("upstream got %d requests, want %d", requests, test.requests)
+			}
+			if snapshot := s.hosts.snapshot(); !reflect.DeepEqual(snapshot[0].Outcomes, test.outcomes) {
+				t.Errorf("outcomes = %v, want %v", snapshot[0].Outcomes, test.outcomes)
+			}
+		})
+	}
+}
+
+func TestUpstreamRetryAfterIsWaitedFor(t *testing.T) {
+	var requests int32
+	upstream := newScriptedUpstream(t, []scriptedResponse{{status: 429, retryAfter: "1"}, {status: 200}}, &requests)
+	_, client := newResilientClient(t, nil)
+
+	start := time.Now()
+	res, err := client.Get(upstream.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != 200 {
+		t.Errorf("status = %d, want 200", res.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want the second of Retry-After", elapsed)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var requests int32
+	var failing int32 = 1
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer upstream.Close()
+	s, client := newResilientClient(t, func(cfg *Config) {
+		cfg.UpstreamRetries = 0
+		cfg.UpstreamBreakerThreshold = 2
+		cfg.UpstreamBreakerCooldown = Duration{50 * time.Millisecond}
+	})
+
+	get := func(want int, wantRequests int32) {
+		t.Helper()
+
+		res, err := client.Get(upstream.URL)
+		switch {
+		case want == 0 && !errors.Is(err, errCircuitOpen):
+			t.Errorf("err = %v, want the circuit breaker to be open", err)
+		case want != 0 && err != nil:
+			t.Errorf("err = %v, want %d", err, want)
+		case want != 0 && res.StatusCode != want:
+			t.Errorf("status = %d, want %d", res.StatusCode, want)
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		if requests := atomic.LoadInt32(&requests); requests != wantRequests {
+			t.Errorf("upstream got %d requests, want %d", requests, wantRequests)
+		}
+	}
+
+	get(500, 1)
+	get(500, 2)
+	// Open after 2 failures in a row, requests fail without reaching the upstream
+	get(0, 2)
+
+	// A failed probe after the cooldown opens it again
+	time.Sleep(60 * time.Millisecond)
+	get(500, 3)
+	get(0, 3)
+
+	// A successful probe closes it
+	time.Sleep(60 * time.Millisecond)
+	atomic.StoreInt32(&failing, 0)
+	get(200, 4)
+	get(200, 5)
+
+	snapshot := s.hosts.snapshot()
+	if snapshot[0].State != "closed" || snapshot[0].Opens != 2 || snapshot[0].Outcomes[outcomeRejected] != 2 {
+		t.Errorf("snapshot = %+v, want a closed breaker that opened twice and rejected 2 requests", snapshot[0])
+	}
+}
+
+func TestCircuitBreakerProbesOnce(t *testing.T) {
+	b := &circuitBreaker{}
+	b.record(true, 1)
+
+	if b.allow(time.Hour) {
+		t.Error("an open breaker allowed a request before its cooldown")
+	}
+	if !b.allow(0) {
+		t.Error("a half-open breaker didn't allow a probe")
+	}
+	if b.allow(0) {
+		t.Error("a half-open breaker allowed a second probe while the first is in flight")
+	}
+
+	b.abort()
+	if !b.allow(0) {
+		t.Error("an aborted probe wasn't given back")
+	}
+	b.record(false, 1)
+	if !b.allow(time.Hour) || b.state != breakerClosed {
+		t.Errorf("state = %s, want closed after a successful probe", b.state)
+	}
+}
+
+func TestClassifyOutcome(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		status int
+		err    error
+		want   string
+	}{
+		{"ok", context.Background(), 200, nil, outcomeOK},
+		{"not found", context.Background(), 404, nil, outcomeOK},
+		{"rate limited", context.Background(), 429, nil, outcomeRateLimited},
+		{"server error", context.Background(), 502, nil, outcomeServerError},
+		{"timeout", context.Background(), 0, context.DeadlineExceeded, outcomeTimeout},
+		{"network error", context.Background(), 0, errors.New("connection refused"), outcomeError},
+		{"canceled", canceled, 0, context.Canceled, outcomeCanceled},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "http://upstream.test", nil).WithContext(test.ctx)
+		var res *http.Response
+		if test.err == nil {
+			res = &http.Response{StatusCode: test.status}
+		}
+
+		if got := classifyOutcome(req, res, test.err); got != test.want {
+			t.Errorf("%s: outcome = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"3", 3 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"Mon, 02 Jan 2006 15:04:05 GMT", 0, true},
+	}
+
+	for _, test := range tests {
+		res := &http.Response{Header: http.Header{"Retry-After": []string{test.value}}}
+		if got, ok := retryAfter(res); got != test.want || ok != test.ok {
+			t.Errorf("retryAfter(%q) = %s, %t, want %s, %t", test.value, got, ok, test.want, test.ok)
+		}
+	}
+
+	future := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	res := &http.Response{Header: http.Header{"Retry-After": []string{future}}}
+	if got, ok := retryAfter(res); !ok || got < 58*time.Second || got > time.Minute {
+		t.Errorf("retryAfter(%q) = %s, %t, want about a minute", future, got, ok)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := retryDelay(attempt)
+		max := retryBaseDelay << uint(attempt)
+		if max > retryMaxDelay {
+			max = retryMaxDelay
+		}
+
+		if delay < max/2 || delay > max {
+			t.Errorf("retryDelay(%d) = %s, want between %s and %s", attempt, delay, max/2, max)
+		}
+	}
+}
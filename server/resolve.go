@@ -0,0 +1,670 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+// resolveOptions control how a resource is resolved
+type resolveOptions struct {
+	formats []string
+	// waveformBars is what the client asked for, see bars
+	waveformBars *int
+	// lang is the language of messages that end up in the response, such as the likes title
+	lang string
+	// onCollection is called with the title of a collection as soon as it is known, before
+	// its tracks are listed
+	onCollection func(title string)
+	// onTrack is called with every track of a collection as soon as it is resolved
+	onTrack func(trackInfo)
+	// manifest is the manifest of a previous response, only changes since then are returned
+	manifest *syncManifest
+	// metadataOnly skips fetching download URLs, the tracks keep their permalink URLs
+	metadataOnly bool
+}
+
+// collectionFound calls onCollection, if set
+func (o resolveOptions) collectionFound(title string) {
+	if o.onCollection != nil {
+		o.onCollection(title)
+	}
+}
+
+// newResolveOptions returns resolve options from the fields of a request body
+func newResolveOptions(formats []string, waveformBars *int, lang string) resolveOptions {
+	return resolveOptions{formats: formats, waveformBars: waveformBars, lang: lang}
+}
+
+// bars returns how many bars waveforms are downsampled to. The tracks of collections only
+// get waveforms if the client asks for them, as every one of them is another request.
+func (o resolveOptions) bars(collection bool) int {
+	if o.waveformBars != nil {
+		return *o.waveformBars
+	}
+	if collection {
+		return 0
+	}
+
+	return defaultWaveformBars
+}
+
+// trackResponse is the resolved form of a single track
+type trackResponse struct {
+	URL          string             `json:"url"`
+	Title        string             `json:"title"`
+	Author       soundcloudapi.User `json:"author"`
+	ImageURL     string             `json:"imageURL"`
+	Format       string             `json:"format"`
+	Transcodings []transcodingInfo  `json:"transcodings"`
+	Original     *originalFile      `json:"original,omitempty"`
+	// Permalink is the URL of the track on SoundCloud, URL changes every time it is resolved
+	Permalink string `json:"permalink"`
+	// Private is set for tracks shared with a secret token, their links shouldn't be shared
+	Private bool `json:"private"`
+	// Unlocked is set if the track could only be resolved with the user's OAuth token
+	Unlocked bool `json:"unlocked"`
+	trackMetadata
+
+	// hls is set if URL is an HLS playlist
+	hls bool
+}
+
+// trackResponseV1 is the v1 form of trackResponse, the shape the frontend was built against
+type trackResponseV1 struct {
+	URL      string             `json:"url"`
+	Title    string             `json:"title"`
+	Author   soundcloudapi.User `json:"author"`
+	ImageURL string             `json:"imageURL"`
+}
+
+// forVersion returns the shape of the track in the given API version
+func (t *trackResponse) forVersion(version apiVersion) interface{} {
+	if version == apiV1 {
+		return &trackResponseV1{URL: t.URL, Title: t.Title, Author: t.Author, ImageURL: t.ImageURL}
+	}
+
+	return t
+}
+
+// collectionResponse is the resolved form of a playlist or a user's likes
+type collectionResponse struct {
+	URL      string             `json:"url"`
+	Title    string             `json:"title"`
+	Tracks   []trackInfo        `json:"tracks"`
+	Author   soundcloudapi.User `json:"author"`
+	ImageURL string             `json:"imageURL"`
+	// Private is set for sets shared with a secret token, their links shouldn't be shared
+	Private bool `json:"private"`
+
+	// titleV1 is the title of v1 responses, which is never localized
+	titleV1  string
+	skipped  []skippedTrack
+	removed  []manifestTrack
+	manifest *syncManifest
+}
+
+// trackInfoV1 is the v1 form of a track of a collection
+type trackInfoV1 struct {
+	Title    string `json:"title"`
+	URL      string `json:"url"`
+	HLS      bool   `json:"hls"`
+	Author   string `json:"author"`
+	ImageURL string `json:"imageURL"`
+}
+
+// collectionResponseV1 is the v1 form of collectionResponse, it lists the titles of the
+// tracks that can't be downloaded because of copyright
+type collectionResponseV1 struct {
+	URL               string             `json:"url"`
+	Title             string             `json:"title"`
+	Tracks            []trackInfoV1      `json:"tracks"`
+	CopyrightedTracks []string           `json:"copyrightedTracks"`
+	Author            soundcloudapi.User `json:"author"`
+	ImageURL          string             `json:"imageURL"`
+}
+
+// collectionResponseV2 is the v2 form of collectionResponse, it says why every skipped
+// track was skipped instead of listing the titles of copyrighted ones
+type collectionResponseV2 struct {
+	URL      string             `json:"url"`
+	Title    string             `json:"title"`
+	Tracks   []trackInfo        `json:"tracks"`
+	Skipped  []skippedTrack     `json:"skipped"`
+	Author   soundcloudapi.User `json:"author"`
+	ImageURL string             `json:"imageURL"`
+	Private  bool               `json:"private"`
+	// Removed are the tracks of the request's manifest that are no longer in the collection
+	Removed  []manifestTrack `json:"removed,omitempty"`
+	Manifest *syncManifest   `json:"manifest"`
+}
+
+// Reasons a track of a collection is skipped
+const (
+	skipReasonCopyrighted = "copyrighted"
+	// skipReasonGeoBlocked is for tracks that can't be played where the server runs
+	skipReasonGeoBlocked = "geo_blocked"
+)
+
+// skippedTrack is a track of a collection that can't be downloaded
+type skippedTrack struct {
+	Title  string `json:"title"`
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+}
+
+func newCollectionResponse(url string, title string, tracks []trackInfo, skipped []skippedTrack, author soundcloudapi.User, imageURL string) *collectionResponse {
+	return &collectionResponse{
+		URL:      url,
+		Title:    title,
+		Tracks:   tracks,
+		Author:   author,
+		ImageURL: imageURL,
+		titleV1:  title,
+		skipped:  skipped,
+	}
+}
+
+// forVersion returns the shape of the collection in the given API version
+func (c *collectionResponse) forVersion(version apiVersion) interface{} {
+	if version == apiV1 {
+		return c.v1()
+	}
+
+	return &collectionResponseV2{
+		URL:      c.URL,
+		Title:    c.Title,
+		Tracks:   c.Tracks,
+		Skipped:  c.skipped,
+		Author:   c.Author,
+		ImageURL: c.ImageURL,
+		Private:  c.Private,
+		Removed:  c.removed,
+		Manifest: c.manifest,
+	}
+}
+
+// v1 returns the v1 shape of the collection. Geo-blocked tracks aren't copyrighted, v1 has
+// nowhere to list them.
+func (c *collectionResponse) v1() *collectionResponseV1 {
+	tracks := make([]trackInfoV1, 0, len(c.Tracks))
+	for _, track := range c.Tracks {
+		tracks = append(tracks, trackInfoV1{
+			Title:    track.Title,
+			URL:      track.URL,
+			HLS:      track.HLS,
+			Author:   track.Author,
+			ImageURL: track.ImageURL,
+		})
+	}
+
+	copyrightedTracks := []string{}
+	for _, track := range c.skipped {
+		if track.Reason == skipReasonCopyrighted {
+			copyrightedTracks = append(copyrightedTracks, track.Title)
+		}
+	}
+
+	return &collectionResponseV1{
+		URL:               c.URL,
+		Title:             c.titleV1,
+		Tracks:            tracks,
+		CopyrightedTracks: copyrightedTracks,
+		Author:            c.Author,
+		ImageURL:          c.ImageURL,
+	}
+}
+
+// expandURL converts Firebase, mobile and search URLs into a regular SoundCloud URL. Links
+// to private tracks and sets keep their secret token.
+func (s *Server) expandURL(rawURL string) (string, error) {
+	if soundcloudapi.IsFirebaseURL(rawURL) {
+		u, err := soundcloudapi.ConvertFirebaseLink(rawURL)
+		if err != nil {
+			return "", newAPIError(codeInvalidURL).wrap(err)
+		}
+
+		return normalizeSecretURL(u), nil
+	}
+
+	if soundcloudapi.IsMobileURL(rawURL) {
+		return normalizeSecretURL(soundcloudapi.StripMobilePrefix(rawURL)), nil
+	}
+
+	if soundcloudapi.IsSearchURL(rawURL) {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return "", newAPIError(codeInvalidURL).wrap(err)
+		}
+
+		query := u.Query().Get("q")
+		response, err := s.scdl.Search(soundcloudapi.SearchOptions{
+			Query: query,
+			Limit: 1,
+			Kind:  soundcloudapi.KindTrack,
+		})
+		if err != nil {
+			return "", upstreamError(err, codeTrackNotFound)
+		}
+
+		data, err := json.Marshal(response)
+		pgQuery := &soundcloudapi.PaginatedQuery{}
+
+		err = json.Unmarshal(data, pgQuery)
+		if err != nil {
+			return "", err
+		}
+
+		track, err := pgQuery.GetTracks()
+		if err != nil {
+			return "", err
+		}
+
+		if len(track) == 0 {
+			return "", newAPIError(codeTrackNotFound).variant("search")
+		}
+
+		return track[0].PermalinkURL, nil
+	}
+
+	return normalizeSecretURL(rawURL), nil
+}
+
+// canonicalURL returns a normalized form of a SoundCloud URL so that links to the same
+// resource compare equal. It does not make any network requests.
+func canonicalURL(rawURL string) string {
+	rawURL = soundcloudapi.StripMobilePrefix(strings.TrimSpace(rawURL))
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return strings.TrimRight(rawURL, "/")
+	}
+
+	u.Scheme = "https"
+	u.Host = strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.Fragment = ""
+	if !soundcloudapi.IsSearchURL(u.String()) {
+		u.RawQuery = ""
+	}
+
+	return u.String()
+}
+
+// detectLinkType guesses what kind of resource a SoundCloud URL points to
+func detectLinkType(u string) linkType {
+	if soundcloudapi.IsPlaylistURL(u) {
+		return linkTypePlaylist
+	}
+
+	if soundcloudapi.IsPersonalizedTrackURL(u) || soundcloudapi.IsSearchURL(u) {
+		return linkTypeTrack
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return linkTypeTrack
+	}
+
+	segments := strings.Split(strings.Trim(parsed.Path, "/"), "/")
+	if len(segments) == 1 || (len(segments) == 2 && segments[1] == "likes") {
+		return linkTypeLikes
+	}
+
+	return linkTypeTrack
+}
+
+// resolveLink resolves any kind of link, detecting what kind of resource it is. The result
+// is a *trackResponse or a *collectionResponse.
+func (s *Server) resolveLink(ctx context.Context, rawURL string, opts resolveOptions) (linkType, interface{}, error) {
+	u, err := s.expandURL(rawURL)
+	if err != nil {
+		return linkTypeTrack, nil, err
+	}
+
+	if !s.scdl.IsURL(u) {
+		return linkTypeTrack, nil, newAPIError(codeInvalidURL).variant("not_soundcloud")
+	}
+
+	link := detectLinkType(u)
+	switch link {
+	case linkTypePlaylist:
+		collection, err := s.resolvePlaylist(ctx, u, opts)
+		return link, collection, err
+	case linkTypeLikes:
+		collection, err := s.resolveLikes(ctx, u, opts)
+		return link, collection, err
+	}
+
+	track, err := s.resolveTrack(ctx, u, opts)
+	return link, track, err
+}
+
+// resolveTrack fetches the info and download URL for a single track
+func (s *Server) resolveTrack(ctx context.Context, trackURL string, opts resolveOptions) (*trackResponse, error) {
+	track, err := s.soundcloud(ctx).GetTrackInfo(soundcloudapi.GetTrackInfoOptions{URL: trackURL})
+	if err != nil {
+		return nil, upstreamError(err, codeTrackNotFound)
+	}
+
+	if len(track) == 0 {
+		return nil, newAPIError(codeTrackNotFound)
+	}
+
+	// Profile links will pass detection
+	if track[0].Kind != "track" {
+		desired := "PLAYLIST"
+		if track[0].Kind == "user" {
+			desired = "LIKES"
+		}
+		return nil, newAPIError(codeWrongLinkType).with("tab", desired).
+			withDetail(track[0].Kind)
+	}
+
+	unlocked := s.unlockedTracks(ctx, track[:1], opts.formats)[track[0].ID]
+
+	transcoding, ok := selectTranscoding(track[0].Media.Transcodings, opts.formats)
+	if !ok {
+		available, reasons := s.classifyUnavailable(ctx, track[:1], opts.formats)
+		regional, found := available[track[0].ID]
+		if !found {
+			if reasons[track[0].ID] == skipReasonGeoBlocked {
+				return nil, newAPIError(codeTrackGeoBlocked).with("title", track[0].Title)
+			}
+			return nil, newAPIError(codeTrackCopyrighted).with("title", track[0].Title)
+		}
+
+		track[0] = regional
+		transcoding, _ = selectTranscoding(regional.Media.Transcodings, opts.formats)
+		ctx = s.regionalContext(ctx)
+	}
+
+	token := track[0].SecretToken
+	if token == "" {
+		token = secretToken(trackURL)
+	}
+
+	mediaURL, err := s.getMediaURL(ctx, transcoding.URL, token)
+	if err != nil {
+		return nil, upstreamError(err, codeTrackNotFound)
+	}
+
+	var original *originalFile
+	if isDownloadable(track[0]) {
+		original, err = s.getOriginalFile(ctx, track[0].ID, token)
+		if err != nil {
+			fmt.Println(err.Error())
+		}
+	}
+
+	metadata := getTrackMetadata(track[0])
+	metadata.Waveform, err = s.getWaveform(ctx, track[0].WaveformURL, opts.bars(false))
+	if err != nil {
+		fmt.Println(err.Error())
+	}
+
+	imageURL := s.getIMGURL(track[0].ArtworkURL)
+	if imageURL == "" {
+		imageURL = s.getIMGURL(track[0].User.AvatarURL)
+	}
+
+	hls := transcoding.Format.Protocol == "hls"
+	if link := s.signedLink(ctx, downloadLink{TrackID: track[0].ID, Format: formatName(transcoding), SecretToken: token}); link != "" {
+		// Signed links serve the whole file
+		mediaURL, hls = link, false
+		if original != nil {
+			original.URL = s.signedLink(ctx, downloadLink{TrackID: track[0].ID, SecretToken: token, Original: true})
+		}
+	}
+
+	return &trackResponse{
+		URL:           mediaURL,
+		Title:         track[0].Title,
+		Author:        track[0].User,
+		ImageURL:      imageURL,
+		Format:        formatName(transcoding),
+		Transcodings:  describeTranscodings(track[0].Media.Transcodings),
+		Original:      original,
+		Permalink:     track[0].PermalinkURL,
+		Private:       token != "",
+		Unlocked:      unlocked,
+		trackMetadata: metadata,
+		hls:           hls,
+	}, nil
+}
+
+// resolvePlaylist fetches the info and download URLs for every track in a playlist
+func (s *Server) resolvePlaylist(ctx context.Context, playlistURL string, opts resolveOptions) (*collectionResponse, error) {
+	// Syncs are after changes, so they skip the cache
+	playlist, err := s.getPlaylist(ctx, playlistURL, opts.manifest != nil)
+	if err != nil {
+		return nil, upstreamError(err, codePlaylistNotFound)
+	}
+
+	if opts.manifest != nil {
+		if err := opts.manifest.validate(playlistURL); err != nil {
+			return nil, err
+		}
+	}
+	opts.collectionFound(playlist.Title)
+
+	tracks, removed, manifest := syncTracks(opts.manifest, playlistURL, playlist.Tracks, nil)
+	urls, skipped, _ := s.classifyTracks(ctx, tracks, opts)
+
+	mediaURLs, err := s.resolveMediaURLs(ctx, urls, skipped, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	imageURL := s.getIMGURL(playlist.ArtworkURL)
+	if imageURL == "" {
+		imageURL = s.getIMGURL(playlist.User.AvatarURL)
+	}
+
+	collection := newCollectionResponse(playlistURL, playlist.Title, mediaURLs, skipped, playlist.User, imageURL)
+	collection.Private = playlist.SecretToken != "" || secretToken(playlistURL) != ""
+	collection.removed, collection.manifest = removed, manifest
+
+	if oauthToken(ctx) == "" && !collection.Private {
+		s.requests.record(playlistURL)
+	}
+	return collection, nil
+}
+
+// resolveLikes fetches the info and download URLs for every track a user has liked
+func (s *Server) resolveLikes(ctx context.Context, profileURL string, opts resolveOptions) (*collectionResponse, error) {
+	userURL := strings.TrimSuffix(strings.TrimRight(profileURL, "/"), "/likes")
+	api := s.soundcloud(ctx)
+	user, err := api.GetUser(soundcloudapi.GetUserOptions{ProfileURL: userURL})
+	if err != nil {
+		return nil, upstreamError(err, codeUserNotFound)
+	}
+
+	if opts.manifest != nil {
+		if err := opts.manifest.validate(profileURL); err != nil {
+			return nil, err
+		}
+	}
+
+	// Users with many likes take a while to page through
+	title := messages.render(opts.lang, "LIKES_TITLE", map[string]string{"user": user.Username})
+	opts.collectionFound(title)
+
+	options := soundcloudapi.GetLikesOptions{
+		ID:    user.ID,
+		Limit: user.Likes,
+		Type:  "track",
+	}
+
+	cfg := s.cfg()
+	likeS := make([]soundcloudapi.Like, user.Likes)
+	if user.Likes <= cfg.LikesBulkThreshold {
+		var likes *soundcloudapi.PaginatedQuery
+		likes, err = api.GetLikes(options)
+		if err == nil {
+			likeS, err = likes.GetLikes()
+		}
+	} else {
+		options.Limit = cfg.LikesPageSize
+		err = s.getLikesBulk(ctx, &likeS, options)
+	}
+
+	if err != nil {
+		return nil, upstreamError(err, codeUserNotFound)
+	}
+
+	tracks := make([]soundcloudapi.Track, 0, len(likeS))
+	likedAt := map[int64]time.Time{}
+	for _, like := range likeS {
+		if like.Track.Kind != "track" {
+			continue
+		}
+		tracks = append(tracks, like.Track)
+		if t, err := time.Parse(time.RFC3339, like.CreatedAt); err == nil {
+			likedAt[like.Track.ID] = t
+		}
+	}
+
+	tracks, removed, manifest := syncTracks(opts.manifest, profileURL, tracks, likedAt)
+	urls, skipped, artworkURL := s.classifyTracks(ctx, tracks, opts)
+
+	mediaURLs, err := s.resolveMediaURLs(ctx, urls, skipped, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	imageURL := s.getIMGURL(user.AvatarURL)
+	if imageURL == "" {
+		imageURL = s.getIMGURL(artworkURL)
+	}
+
+	collection := newCollectionResponse(profileURL, title, mediaURLs, skipped, user, imageURL)
+	collection.titleV1 = fmt.Sprintf("%s's Likes", user.Username)
+	collection.removed, collection.manifest = removed, manifest
+	return collection, nil
+}
+
+// classifyTracks splits tracks into those that can be downloaded and those that can't,
+// because of copyright or because they are geo-blocked. Geo-blocked tracks that can be
+// downloaded through the regional proxy are kept, and tracks only the user's OAuth token
+// gives access to are marked. It also returns the first artwork URL it finds.
+func (s *Server) classifyTracks(ctx context.Context, tracks []soundcloudapi.Track, opts resolveOptions) ([]trackInfo, []skippedTrack, string) {
+	skipped := []skippedTrack{}
+	urls := []trackInfo{}
+	artworkURL := ""
+
+	unavailable := []soundcloudapi.Track{}
+	for _, track := range tracks {
+		if _, ok := selectTranscoding(track.Media.Transcodings, opts.formats); !ok {
+			unavailable = append(unavailable, track)
+		}
+	}
+	available, reasons := s.classifyUnavailable(ctx, unavailable, opts.formats)
+	resolved := []soundcloudapi.Track{}
+
+	for _, track := range tracks {
+		transcoding, ok := selectTranscoding(track.Media.Transcodings, opts.formats)
+		regional := false
+		if !ok {
+			fromRegion, found := available[track.ID]
+			if !found {
+				skipped = append(skipped, skippedTrack{Title: track.Title, URL: track.PermalinkURL, Reason: reasons[track.ID]})
+				continue
+			}
+			track, regional = fromRegion, true
+			transcoding, _ = selectTranscoding(track.Media.Transcodings, opts.formats)
+		}
+
+		// The region, not the token, is what makes geo-blocked tracks available
+		if !regional {
+			resolved = append(resolved, track)
+		}
+
+		imageURL := s.getIMGURL(track.ArtworkURL)
+		if imageURL == "" {
+			imageURL = s.getIMGURL(track.User.AvatarURL)
+		}
+		urls = append(urls, trackInfo{
+			Title:          track.Title,
+			HLS:            transcoding.Format.Protocol != "progressive",
+			URL:            track.PermalinkURL,
+			Permalink:      track.PermalinkURL,
+			Author:         track.User.Username,
+			ImageURL:       imageURL,
+			Format:         formatName(transcoding),
+			Transcodings:   describeTranscodings(track.Media.Transcodings),
+			trackMetadata:  getTrackMetadata(track),
+			id:             track.ID,
+			downloadable:   isDownloadable(track),
+			transcodingURL: transcoding.URL,
+			Private:        track.SecretToken != "",
+			waveformURL:    track.WaveformURL,
+			secretToken:    track.SecretToken,
+			regional:       regional,
+		})
+
+		if track.ArtworkURL != "" && artworkURL == "" {
+			artworkURL = track.ArtworkURL
+		}
+	}
+
+	unlocked := s.unlockedTracks(ctx, resolved, opts.formats)
+	for i := range urls {
+		urls[i].Unlocked = unlocked[urls[i].id]
+	}
+
+	return urls, skipped, artworkURL
+}
+
+// unavailableCollectionError returns the error of a collection none of whose tracks can be
+// downloaded. It is only ALL_TRACKS_GEO_BLOCKED if every skipped track is geo-blocked, empty
+// collections count as copyrighted like they always have.
+func unavailableCollectionError(skipped []skippedTrack) *apiError {
+	if len(skipped) == 0 {
+		return newAPIError(codeAllTracksCopyrighted)
+	}
+
+	for _, track := range skipped {
+		if track.Reason != skipReasonGeoBlocked {
+			return newAPIError(codeAllTracksCopyrighted)
+		}
+	}
+
+	return newAPIError(codeAllTracksGeoBlocked)
+}
+
+// resolveMediaURLs fetches the download URL and waveform of every track, converting
+// upstream errors into user-facing ones
+func (s *Server) resolveMediaURLs(ctx context.Context, urls []trackInfo, skipped []skippedTrack, opts resolveOptions) ([]trackInfo, error) {
+	if opts.metadataOnly {
+		if opts.onTrack != nil {
+			for _, track := range urls {
+				opts.onTrack(track)
+			}
+		}
+		return urls, nil
+	}
+
+	if len(urls) == 0 {
+		// Nothing new since the last sync isn't an error
+		if opts.manifest != nil {
+			return []trackInfo{}, nil
+		}
+
+		return nil, unavailableCollectionError(skipped)
+	}
+
+	mediaURLs, err := s.getMediaURLMany(ctx, urls, opts)
+	if err != nil {
+		if apiErr, ok := upstreamError(err, codeTrackNotFound).(*apiError); ok && apiErr.Code == codeTrackNotFound {
+			return nil, apiErr.variant("in_collection")
+		}
+		return nil, upstreamError(err, codeTrackNotFound)
+	}
+
+	return mediaURLs, nil
+}
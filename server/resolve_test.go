@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"testing"
+)
+
+func TestResolveMediaURLsUnavailableCollection(t *testing.T) {
+	copyrighted := skippedTrack{Title: "a", Reason: skipReasonCopyrighted}
+	geoBlocked := skippedTrack{Title: "b", Reason: skipReasonGeoBlocked}
+
+	tests := []struct {
+		name    string
+		skipped []skippedTrack
+		want    errorCode
+	}{
+		{"empty", nil, codeAllTracksCopyrighted},
+		{"copyrighted", []skippedTrack{copyrighted}, codeAllTracksCopyrighted},
+		{"mixed", []skippedTrack{geoBlocked, copyrighted}, codeAllTracksCopyrighted},
+		{"geo-blocked", []skippedTrack{geoBlocked, geoBlocked}, codeAllTracksGeoBlocked},
+	}
+
+	s := &Server{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := s.resolveMediaURLs(context.Background(), nil, test.skipped, resolveOptions{})
+			apiErr, ok := err.(*apiError)
+			if !ok || apiErr.Code != test.want {
+				t.Errorf("got %v, want %s", err, test.want)
+			}
+		})
+	}
+}
+
+func TestResolveOptionsBars(t *testing.T) {
+	none, some := 0, 50
+	tests := []struct {
+		name         string
+		waveformBars *int
+		collection   bool
+		want         int
+	}{
+		{"track default", nil, false, defaultWaveformBars},
+		{"collection default", nil, true, 0},
+		{"track disabled", &none, false, 0},
+		{"collection requested", &some, true, 50},
+	}
+
+	for _, test := range tests {
+		if got := newResolveOptions(nil, test.waveformBars, defaultLanguage).bars(test.collection); got != test.want {
+			t.Errorf("%s: bars = %d, want %d", test.name, got, test.want)
+		}
+	}
+}
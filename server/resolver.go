@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+// Resolver resolves links with the same code as the HTTP handlers, for programs that talk
+// to SoundCloud directly instead of running the server
+type Resolver struct {
+	s *Server
+}
+
+// Resolution is a resolved track, playlist or likes link
+type Resolution struct {
+	// Type is one of "track", "playlist" or "likes"
+	Type    string          `json:"type"`
+	Title   string          `json:"title"`
+	Tracks  []ResolvedTrack `json:"tracks"`
+	Skipped []SkippedTrack  `json:"skipped"`
+}
+
+// ResolvedTrack is a track that can be downloaded
+type ResolvedTrack struct {
+	Title  string `json:"title"`
+	Author string `json:"author"`
+	// URL is the signed media URL, an HLS playlist if HLS is true
+	URL    string `json:"url"`
+	HLS    bool   `json:"hls"`
+	Format string `json:"format"`
+	// Permalink is the URL of the track on SoundCloud, which identifies it unlike URL
+	Permalink string `json:"permalink"`
+	// Private is set for tracks shared with a secret token
+	Private bool `json:"private"`
+}
+
+// SkippedTrack is a track of a collection that can't be downloaded
+type SkippedTrack = skippedTrack
+
+// Reasons a track is skipped, see SkippedTrack
+const (
+	SkipReasonCopyrighted = skipReasonCopyrighted
+	SkipReasonGeoBlocked  = skipReasonGeoBlocked
+)
+
+// NewResolver returns a Resolver using clientID, or a freshly fetched client ID if it is empty
+func NewResolver(clientID string) (*Resolver, error) {
+	cfg := DefaultConfig()
+	httpClient := &http.Client{}
+	scdl, err := soundcloudapi.New(soundcloudapi.APIOptions{
+		ClientID:   clientID,
+		HTTPClient: httpClient,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		router:      mux.NewRouter(),
+		scdl:        scdl,
+		httpClient:  httpClient,
+		mediaClient: &http.Client{},
+		mediaCache:  newMediaCache(),
+		hosts:       newUpstreamHosts(),
+		outbound:    newOutboundLimiter(cfg.UpstreamRequestsPerSecond, cfg.UpstreamBurst),
+
+		playlistCache: newPlaylistCache(),
+		requests:      newRequestLog(),
+	}
+	s.config.Store(cfg.withParsed())
+	httpClient.Transport = s.upstreamRoundTripper(http.DefaultTransport, true)
+
+	return &Resolver{s: s}, nil
+}
+
+// Resolve resolves a track, playlist or likes link, preferring formats in order (see
+// matchesFormat). Waveforms aren't fetched.
+func (r *Resolver) Resolve(ctx context.Context, rawURL string, formats []string) (*Resolution, error) {
+	noWaveform := 0
+	link, result, err := r.s.resolveLink(ctx, rawURL, newResolveOptions(formats, &noWaveform, defaultLanguage))
+	if err != nil {
+		return nil, err
+	}
+
+	res := &Resolution{Type: link.String(), Skipped: []SkippedTrack{}}
+	switch result := result.(type) {
+	case *trackResponse:
+		res.Title = result.Title
+		res.Tracks = []ResolvedTrack{{
+			Title:     result.Title,
+			Author:    result.Author.Username,
+			URL:       result.URL,
+			HLS:       !strings.HasSuffix(result.Format, "_progressive"),
+			Format:    result.Format,
+			Permalink: result.Permalink,
+			Private:   result.Private,
+		}}
+	case *collectionResponse:
+		res.Title = result.Title
+		res.Skipped = result.skipped
+		for _, track := range result.Tracks {
+			res.Tracks = append(res.Tracks, ResolvedTrack{
+				Title:     track.Title,
+				Author:    track.Author,
+				URL:       track.URL,
+				HLS:       track.HLS,
+				Format:    track.Format,
+				Permalink: track.Permalink,
+				Private:   track.Private,
+			})
+		}
+	}
+
+	return res, nil
+}
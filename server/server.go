@@ -1,10 +1,11 @@
 package server
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -13,44 +14,138 @@ import (
 
 // Server is the REST API server
 type Server struct {
+	// config holds the current Config, it is replaced when the config is reloaded
+	config      atomic.Value
 	router      *mux.Router
-	frontendURL string
 	scdl        *soundcloudapi.API
+	httpClient  *http.Client
+	mediaClient *http.Client
+	mediaCache  *mediaCache
+	limiter     *rateLimiter
+	reports     reportStore
+	webhooks    *webhookDispatcher
+	upstream    *upstreamStats
+	hosts       *upstreamHosts
+	outbound    *outboundLimiter
+	// proxies is nil if upstream requests are made directly
+	proxies *proxyPool
+	// regionalProxy is nil if geo-blocked tracks are skipped
+	regionalProxy *proxyState
+	// playlistCache and requests are used to prewarm popular playlists, see Prewarm
+	playlistCache *playlistCache
+	requests      *requestLog
+
+	// legacyDeprecation is sent with the responses of the unprefixed routes
+	legacyDeprecation *deprecation
+
+	clientIDMu          sync.Mutex
+	clientIDRefreshedAt time.Time
 }
 
-// New returns a new server
-func New() *Server {
-	frontendURL := os.Getenv("FRONTEND_URL")
-	if frontendURL == "" {
-		log.Fatal("frontendURL is required")
+// New returns a new server configured with cfg, which is validated first
+func New(cfg Config) (*Server, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
 
+	// UpstreamTimeout is enforced by the transport, which doesn't count the wait for the
+	// outbound limiter
+	httpClient := &http.Client{}
+
 	scdl, err := soundcloudapi.New(soundcloudapi.APIOptions{
-		HTTPClient: &http.Client{
-			Timeout: time.Second * 15,
-		},
+		ClientID:   cfg.ClientID,
+		HTTPClient: httpClient,
 	})
 	if err != nil {
-		log.Fatal(err.Error())
+		return nil, err
+	}
+
+	var reports reportStore
+	switch cfg.ReportStore {
+	case "memory":
+		reports = newMemoryReportStore()
+	case "sqlite":
+		reports, err = newSQLiteReportStore(cfg.ReportDB)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Validate already checked the date
+	sunset, _ := parseSunset(cfg.LegacyRoutesSunset)
+
+	proxies, err := newProxyPool(cfg.Proxies)
+	if err != nil {
+		return nil, err
+	}
+
+	regionalProxy, err := newRegionalProxy(cfg.RegionalProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	// Media can take a long time to proxy, so only the wait for a response is limited
+	mediaClient := &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 requestProxy,
+			ResponseHeaderTimeout: cfg.MediaHeaderTimeout.Duration,
+		},
 	}
 
 	s := &Server{
 		router:      mux.NewRouter().StrictSlash(true),
-		frontendURL: frontendURL,
 		scdl:        scdl,
+		httpClient:  httpClient,
+		mediaClient: mediaClient,
+		mediaCache:  newMediaCache(),
+		limiter:     newRateLimiter(),
+		reports:     reports,
+		webhooks:    newWebhookDispatcher(cfg.WebhookURLs, cfg.WebhookSecret),
+		upstream:    &upstreamStats{},
+		hosts:       newUpstreamHosts(),
+		outbound:    newOutboundLimiter(cfg.UpstreamRequestsPerSecond, cfg.UpstreamBurst),
+		proxies:     proxies,
+
+		regionalProxy: regionalProxy,
+		playlistCache: newPlaylistCache(),
+		requests:      newRequestLog(),
+
+		legacyDeprecation: &deprecation{successor: "/v1", sunset: sunset},
 	}
 
+	s.config.Store(cfg.withParsed())
+	apiTransport := http.DefaultTransport.(*http.Transport).Clone()
+	apiTransport.Proxy = requestProxy
+
+	httpClient.Transport = &upstreamTransport{next: s.upstreamRoundTripper(apiTransport, true), server: s}
+	mediaClient.Transport = s.upstreamRoundTripper(mediaClient.Transport, false)
+
 	s.setupRoutes()
 
-	return s
+	return s, nil
+}
+
+// upstreamRoundTripper wraps the transport of an upstream client with pacing, retries and the
+// proxy pool, outermost first
+func (s *Server) upstreamRoundTripper(next http.RoundTripper, timeAttempts bool) http.RoundTripper {
+	return &resilientTransport{
+		next:         &proxyTransport{next: next, server: s},
+		server:       s,
+		timeAttempts: timeAttempts,
+	}
+}
+
+// cfg returns the current config
+func (s *Server) cfg() Config {
+	return s.config.Load().(Config)
 }
 
 func (s *Server) setupPreflightRoutes() {
 	s.router.Methods("OPTIONS").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", s.frontendURL)
+		w.Header().Set("Access-Control-Allow-Origin", s.cfg().FrontendURL)
 		w.Header().Set("Access-Control-Allow-Credentials", "true")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS, PUT, DELETE")
-		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Access-Control-Request-Headers, Access-Control-Request-Method, Connection, Host, Origin, User-Agent, Referer, Cache-Control, X-header")
+		w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-SoundCloud-Token, Access-Control-Request-Headers, Access-Control-Request-Method, Connection, Host, Origin, User-Agent, Referer, Cache-Control, X-header")
 		w.WriteHeader(http.StatusNoContent)
 		return
 	})
@@ -59,28 +154,112 @@ func (s *Server) setupPreflightRoutes() {
 func (s *Server) setupRoutes() {
 	s.setupPreflightRoutes()
 
-	s.addRoute(s.router, "POST", "/track", s.validateLink(linkTypeTrack, s.handleTrack()))
-	s.addRoute(s.router, "POST", "/playlist", s.validateLink(linkTypePlaylist, s.handlePlaylist()))
-	s.addRoute(s.router, "POST", "/likes", s.validateLink(linkTypeLikes, s.handleLikes()))
-	s.addRoute(s.router, "POST", "/report", s.handleReport())
+	s.addRoute(s.router, "GET", "/admin/reports", s.requireAdmin(s.handle(s.handleListReports())))
+	s.addRoute(s.router, "GET", "/admin/reports/export", s.requireAdmin(s.handle(s.handleExportReports())))
+	s.addRoute(s.router, "POST", "/admin/reports/{id:[0-9]+}/resolve", s.requireAdmin(s.handle(s.handleResolveReport())))
+	s.addRoute(s.router, "GET", "/admin/webhooks/deliveries", s.requireAdmin(s.handle(s.handleWebhookDeliveries())))
+	s.addRoute(s.router, "POST", "/admin/webhooks/test", s.requireAdmin(s.handle(s.handleTestWebhooks())))
+	s.addRoute(s.router, "GET", "/openapi.json", s.handle(s.handleOpenAPI()))
+	s.addRoute(s.router, "GET", "/healthz", s.handle(s.handleHealth()))
+	s.addRoute(s.router, "GET", "/metrics", s.handle(s.handleMetrics()))
 	// s.addRoute(s.router, "POST", "/clientid", s.handleClientID())
+
+	s.setupAPIRoutes(s.router.PathPrefix("/v1").Subrouter(), apiV1, nil)
+	s.setupAPIRoutes(s.router.PathPrefix("/v2").Subrouter(), apiV2, nil)
+	// The unprefixed routes are what the frontend used before versioning
+	s.setupAPIRoutes(s.router, apiV1, s.legacyDeprecation)
+}
+
+// setupAPIRoutes adds the public routes of an API version to router
+func (s *Server) setupAPIRoutes(router *mux.Router, version apiVersion, dep *deprecation) {
+	route := func(method string, path string, handler http.HandlerFunc) {
+		s.addRoute(router, method, path, s.versioned(version, dep, s.authenticate(s.issueLinks(handler))))
+	}
+
+	route("POST", "/track", s.rateLimit(s.validateLink(linkTypeTrack, s.handle(s.handleTrack()))))
+	route("POST", "/playlist", s.rateLimit(s.validateLink(linkTypePlaylist, s.handle(s.handlePlaylist()))))
+	route("POST", "/likes", s.rateLimit(s.validateLink(linkTypeLikes, s.handle(s.handleLikes()))))
+	route("POST", "/batch", s.requireFeature(batchEnabled, s.handle(s.handleBatch())))
+	route("GET", "/download/{trackID:[0-9]+}", s.handle(s.handleDownload()))
+	route("GET", "/download/link/{token}", s.handle(s.handleSignedDownload()))
+	route("POST", "/export", s.requireFeature(exportEnabled, s.rateLimit(s.validateLink(linkTypeLikes, s.handle(s.handleExport())))))
+	route("POST", "/report", s.requireFeature(reportsEnabled, s.rateLimit(s.handle(s.handleReport()))))
 }
 
 func (s *Server) addRoute(router *mux.Router, method string, path string, handler func(http.ResponseWriter, *http.Request)) {
 	router.HandleFunc(path, handler).Methods(method)
 }
 
-// respondError makes the error response with payload as json format
-func (s *Server) respondError(w http.ResponseWriter, message string, status int) {
-	s.respondJSON(w, &errResponse{Err: message}, status)
+// respondError makes the error response with payload as json format, in the language the
+// client asked for
+func (s *Server) respondError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := tokenError(r.Context(), toAPIError(err))
+	if apiErr.Err != nil {
+		fmt.Println(apiErr.Error())
+	}
+
+	lang := apiErr.Lang
+	if lang == "" {
+		lang = language(r, "")
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", s.cfg().FrontendURL)
+	w.Header().Set("Content-Language", lang)
+	s.respondJSON(w, &errResponse{Err: apiErr.Message(lang), Code: apiErr.Code, Detail: apiErr.Detail}, apiErr.Status())
+}
+
+// handler returns the root handler of the server. Every route except those that stream
+// media or exports and those that resolve collections has a time limit.
+func (s *Server) handler() http.Handler {
+	root := mux.NewRouter()
+	for _, prefix := range []string{"/download/", "/export"} {
+		root.PathPrefix(prefix).Handler(s.router)
+		root.PathPrefix("/{version:v[0-9]+}" + prefix).Handler(s.router)
+	}
+	// Collections resolve a media URL for every track, paced with the other upstream requests,
+	// so large ones can take longer than any fixed limit. They stop once the client is gone.
+	for _, path := range []string{"/playlist", "/likes", "/batch"} {
+		root.Path(path).Handler(s.router)
+		root.Path("/{version:v[0-9]+}" + path).Handler(s.router)
+	}
+	root.PathPrefix("/").Handler(http.TimeoutHandler(s.router, s.cfg().RequestTimeout.Duration, "Request timed out."))
+	return root
 }
 
-// Run runs the server
-func (s *Server) Run(host string) {
-	fmt.Println("Running server on " + host)
+// Run runs the server on the configured address, along with the prewarmer. Once ctx is done
+// it stops accepting requests and waits for those in flight, up to the shutdown timeout.
+func (s *Server) Run(ctx context.Context) error {
+	addr := s.cfg().Addr
+	fmt.Println("Running server on " + addr)
 	srv := &http.Server{
-		Addr:    host,
-		Handler: http.TimeoutHandler(s.router, 20*time.Second, "Request timed out."),
+		Addr:    addr,
+		Handler: s.handler(),
 	}
-	log.Fatal(srv.ListenAndServe())
+
+	prewarmCtx, stopPrewarm := context.WithCancel(ctx)
+	prewarmed := make(chan struct{})
+	go func() {
+		s.Prewarm(prewarmCtx)
+		close(prewarmed)
+	}()
+	defer func() {
+		stopPrewarm()
+		<-prewarmed
+	}()
+
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg().ShutdownTimeout.Duration)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
 }
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server with the default config changed by configure. Reports are
+// kept in memory and no client ID is fetched.
+func newTestServer(t *testing.T, configure func(*Config)) *Server {
+	t.Helper()
+
+	cfg := DefaultConfig()
+	cfg.FrontendURL = "http://frontend.test"
+	cfg.ClientID = "test-client-id"
+	cfg.ReportStore = "memory"
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// fakeUpstream stands in for SoundCloud and its CDN. Requests are answered by the handler of
+// their host and path, e.g. "api-v2.soundcloud.com/resolve", or with a 404.
+type fakeUpstream struct {
+	mu       sync.Mutex
+	handlers map[string]http.HandlerFunc
+	requests []*http.Request
+}
+
+func newFakeUpstream() *fakeUpstream {
+	return &fakeUpstream{handlers: map[string]http.HandlerFunc{}}
+}
+
+func (f *fakeUpstream) handle(route string, handler http.HandlerFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.handlers[route] = handler
+}
+
+// count returns how many requests were made to route
+func (f *fakeUpstream) count(route string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	count := 0
+	for _, req := range f.requests {
+		if req.URL.Host+req.URL.Path == route {
+			count++
+		}
+	}
+
+	return count
+}
+
+func (f *fakeUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	f.requests = append(f.requests, req)
+	handler, ok := f.handlers[req.URL.Host+req.URL.Path]
+	f.mu.Unlock()
+
+	if !ok {
+		handler = http.NotFound
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, req)
+	res := w.Result()
+	res.Request = req
+	return res, nil
+}
+
+// newUpstreamTestServer is newTestServer with every upstream request answered by the
+// returned fakeUpstream, through the same retries, pacing and proxies as real requests
+func newUpstreamTestServer(t *testing.T, configure func(*Config)) (*Server, *fakeUpstream) {
+	t.Helper()
+
+	s := newTestServer(t, configure)
+	upstream := newFakeUpstream()
+	s.httpClient.Transport = &upstreamTransport{next: s.upstreamRoundTripper(upstream, true), server: s}
+	s.mediaClient.Transport = s.upstreamRoundTripper(upstream, false)
+
+	return s, upstream
+}
+
+func TestCollectionsAreNotTimedOut(t *testing.T) {
+	s, upstream := newUpstreamTestServer(t, func(cfg *Config) {
+		cfg.RequestTimeout = Duration{20 * time.Millisecond}
+	})
+	upstream.handle("api-v2.soundcloud.com/resolve", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+		http.NotFound(w, r)
+	})
+	handler := s.handler()
+
+	tests := []struct {
+		path     string
+		url      string
+		timedOut bool
+	}{
+		{"/v1/track", "https://soundcloud.com/user/track", true},
+		{"/v1/playlist", "https://soundcloud.com/user/sets/playlist", false},
+		{"/v2/likes", "https://soundcloud.com/user", false},
+		{"/playlist", "https://soundcloud.com/user/sets/playlist", false},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", test.path, strings.NewReader(`{"url":"`+test.url+`"}`)))
+
+		if timedOut := w.Code == http.StatusServiceUnavailable && w.Body.String() == "Request timed out."; timedOut != test.timedOut {
+			t.Errorf("%s: got %d %s, want timed out to be %t", test.path, w.Code, w.Body.String(), test.timedOut)
+		}
+	}
+}
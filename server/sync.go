@@ -0,0 +1,99 @@
+package server
+
+import (
+	"time"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+// manifestVersion is the version of the manifest format, bumped on incompatible changes
+const manifestVersion = 1
+
+// syncManifest records which tracks of a collection a client already has. Every v2
+// collection response includes the manifest of the collection, sending it back with the
+// next request of the same collection only returns the tracks added since then and lists
+// the ones that were removed.
+//
+// Tracks that were skipped (e.g. because of copyright) are in the manifest too, so they are
+// only reported once.
+//
+// Syncing is only part of the v2 API. v1 responses keep the shape the frontend was built
+// against, which has no room for the manifest or removed tracks, so v1 ignores manifests and
+// always returns whole collections, as do exports and gRPC.
+type syncManifest struct {
+	Version   int             `json:"version"`
+	URL       string          `json:"url"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Tracks    []manifestTrack `json:"tracks"`
+}
+
+// manifestTrack is a track of a syncManifest
+type manifestTrack struct {
+	ID    int64  `json:"id"`
+	Title string `json:"title"`
+	// AddedAt is when the track was liked, or when it was first seen in a playlist
+	AddedAt time.Time `json:"addedAt"`
+}
+
+// validate checks that the manifest can be used to sync the collection at collectionURL
+func (m *syncManifest) validate(collectionURL string) error {
+	if m.Version != manifestVersion {
+		return newAPIError(codeInvalidRequest).variant("manifest_version").with("version", manifestVersion).withDetail("manifest.version")
+	}
+
+	if canonicalURL(m.URL) != canonicalURL(collectionURL) {
+		return newAPIError(codeInvalidRequest).variant("manifest_url").withDetail("manifest.url")
+	}
+
+	return nil
+}
+
+// syncTracks builds the manifest of a collection and, if the client sent a previous one,
+// removes the tracks it already has. It returns the tracks to resolve, the tracks of the
+// previous manifest that are gone and the new manifest. addedAt holds the time each track
+// was liked, it is nil for playlists.
+func syncTracks(previous *syncManifest, collectionURL string, tracks []soundcloudapi.Track, addedAt map[int64]time.Time) ([]soundcloudapi.Track, []manifestTrack, *syncManifest) {
+	now := time.Now().UTC()
+	manifest := &syncManifest{
+		Version:   manifestVersion,
+		URL:       canonicalURL(collectionURL),
+		CreatedAt: now,
+		Tracks:    make([]manifestTrack, 0, len(tracks)),
+	}
+
+	known := map[int64]manifestTrack{}
+	if previous != nil {
+		for _, track := range previous.Tracks {
+			known[track.ID] = track
+		}
+	}
+
+	added := []soundcloudapi.Track{}
+	present := map[int64]bool{}
+	for _, track := range tracks {
+		present[track.ID] = true
+
+		entry := manifestTrack{ID: track.ID, Title: track.Title, AddedAt: now}
+		if t, ok := addedAt[track.ID]; ok {
+			entry.AddedAt = t
+		} else if old, ok := known[track.ID]; ok {
+			entry.AddedAt = old.AddedAt
+		}
+		manifest.Tracks = append(manifest.Tracks, entry)
+
+		if _, ok := known[track.ID]; !ok {
+			added = append(added, track)
+		}
+	}
+
+	removed := []manifestTrack{}
+	if previous != nil {
+		for _, track := range previous.Tracks {
+			if !present[track.ID] {
+				removed = append(removed, track)
+			}
+		}
+	}
+
+	return added, removed, manifest
+}
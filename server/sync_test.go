@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+// trackIDs returns the IDs of tracks, which are soundcloudapi.Tracks or manifestTracks
+func trackIDs(tracks interface{}) []int64 {
+	ids := []int64{}
+	switch tracks := tracks.(type) {
+	case []soundcloudapi.Track:
+		for _, track := range tracks {
+			ids = append(ids, track.ID)
+		}
+	case []manifestTrack:
+		for _, track := range tracks {
+			ids = append(ids, track.ID)
+		}
+	}
+
+	return ids
+}
+
+func TestSyncTracks(t *testing.T) {
+	const collectionURL = "https://soundcloud.com/artist/sets/mix"
+	firstSeen := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	previous := &syncManifest{
+		Version: manifestVersion,
+		URL:     collectionURL,
+		Tracks:  []manifestTrack{{ID: 1, AddedAt: firstSeen}, {ID: 2, AddedAt: firstSeen}, {ID: 3, AddedAt: firstSeen}},
+	}
+	tracks := func(ids ...int64) []soundcloudapi.Track {
+		tracks := []soundcloudapi.Track{}
+		for _, id := range ids {
+			tracks = append(tracks, soundcloudapi.Track{ID: id})
+		}
+		return tracks
+	}
+
+	tests := []struct {
+		name     string
+		previous *syncManifest
+		tracks   []soundcloudapi.Track
+		added    []int64
+		removed  []int64
+		manifest []int64
+	}{
+		{"first sync", nil, tracks(1, 2, 3), []int64{1, 2, 3}, []int64{}, []int64{1, 2, 3}},
+		{"unchanged", previous, tracks(1, 2, 3), []int64{}, []int64{}, []int64{1, 2, 3}},
+		{"added", previous, tracks(1, 2, 3, 4), []int64{4}, []int64{}, []int64{1, 2, 3, 4}},
+		{"removed", previous, tracks(1, 3), []int64{}, []int64{2}, []int64{1, 3}},
+		{"added and removed", previous, tracks(4, 3, 1), []int64{4}, []int64{2}, []int64{4, 3, 1}},
+	}
+
+	for _, test := range tests {
+		added, removed, manifest := syncTracks(test.previous, collectionURL+"/", test.tracks, nil)
+
+		if got := trackIDs(added); !equalIDs(got, test.added) {
+			t.Errorf("%s: added %v, want %v", test.name, got, test.added)
+		}
+		if got := trackIDs(removed); !equalIDs(got, test.removed) {
+			t.Errorf("%s: removed %v, want %v", test.name, got, test.removed)
+		}
+		if got := trackIDs(manifest.Tracks); !equalIDs(got, test.manifest) {
+			t.Errorf("%s: manifest has %v, want %v", test.name, got, test.manifest)
+		}
+		if manifest.Version != manifestVersion || manifest.URL != collectionURL {
+			t.Errorf("%s: manifest = %+v, want version %d of %s", test.name, manifest, manifestVersion, collectionURL)
+		}
+
+		// Tracks keep when they were first seen
+		for _, track := range manifest.Tracks {
+			if known := test.previous != nil && track.ID <= 3; known != track.AddedAt.Equal(firstSeen) {
+				t.Errorf("%s: track %d was added at %s", test.name, track.ID, track.AddedAt)
+			}
+		}
+	}
+}
+
+func equalIDs(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestSyncTracksUsesLikeTimes(t *testing.T) {
+	likedAt := time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	_, _, manifest := syncTracks(nil, standInUserURL, []soundcloudapi.Track{{ID: 1}, {ID: 2}}, map[int64]time.Time{1: likedAt})
+
+	if !manifest.Tracks[0].AddedAt.Equal(likedAt) {
+		t.Errorf("liked track was added at %s, want when it was liked", manifest.Tracks[0].AddedAt)
+	}
+	if time.Since(manifest.Tracks[1].AddedAt) > time.Minute {
+		t.Errorf("track without a like time was added at %s, want now", manifest.Tracks[1].AddedAt)
+	}
+}
+
+func TestSyncManifestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest syncManifest
+		detail   string
+	}{
+		{"valid", syncManifest{Version: manifestVersion, URL: standInPlaylistURL}, ""},
+		{"same collection", syncManifest{Version: manifestVersion, URL: "https://www.soundcloud.com/artist/sets/mix/"}, ""},
+		{"old version", syncManifest{Version: manifestVersion + 1, URL: standInPlaylistURL}, "manifest.version"},
+		{"other collection", syncManifest{Version: manifestVersion, URL: standInUserURL}, "manifest.url"},
+	}
+
+	for _, test := range tests {
+		err := test.manifest.validate(standInPlaylistURL)
+		if test.detail == "" {
+			if err != nil {
+				t.Errorf("%s: err = %v, want nil", test.name, err)
+			}
+			continue
+		}
+
+		if apiErr, ok := err.(*apiError); !ok || apiErr.Code != codeInvalidRequest || apiErr.Detail != test.detail {
+			t.Errorf("%s: err = %v, want %s about %s", test.name, err, codeInvalidRequest, test.detail)
+		}
+	}
+}
+
+func TestSyncPlaylist(t *testing.T) {
+	s, _ := newSoundCloudStandIn(t, nil)
+	handler := s.handler()
+
+	// The client has track 1 and the skipped tracks 3 and 4, and a track since removed
+	manifest := `{"version":1,"url":"` + standInPlaylistURL + `","tracks":[{"id":1},{"id":3},{"id":4},{"id":99,"title":"Removed"}]}`
+	body := `{"url":"` + standInPlaylistURL + `","manifest":` + manifest + `}`
+
+	tests := []struct {
+		path    string
+		tracks  []string
+		removed []int64
+	}{
+		{"/v2/playlist", []string{"Track Two"}, []int64{99}},
+		// v1 has nowhere to list removed tracks, it ignores the manifest
+		{"/v1/playlist", []string{"Track One", "Track Two"}, []int64{}},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("POST", test.path, strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: got %d %s, want 200", test.path, w.Code, w.Body.String())
+		}
+
+		res := struct {
+			Tracks []struct {
+				Title string `json:"title"`
+			} `json:"tracks"`
+			Removed  []manifestTrack `json:"removed"`
+			Manifest *syncManifest   `json:"manifest"`
+		}{}
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+
+		titles := []string{}
+		for _, track := range res.Tracks {
+			titles = append(titles, track.Title)
+		}
+		if strings.Join(titles, ",") != strings.Join(test.tracks, ",") {
+			t.Errorf("%s: got tracks %v, want %v", test.path, titles, test.tracks)
+		}
+		if got := trackIDs(res.Removed); !equalIDs(got, test.removed) {
+			t.Errorf("%s: removed %v, want %v", test.path, got, test.removed)
+		}
+		if test.path == "/v2/playlist" && (res.Manifest == nil || !equalIDs(trackIDs(res.Manifest.Tracks), []int64{1, 2, 3, 4})) {
+			t.Errorf("%s: manifest = %+v, want every track of the playlist", test.path, res.Manifest)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	soundcloudapi "github.com/zackradisic/soundcloud-api"
+)
+
+const (
+	// upstreamWindow is the period over which the upstream error rate is measured
+	upstreamWindow = time.Minute
+	// upstreamMinRequests is how many requests a window needs before its error rate is trusted
+	upstreamMinRequests = 20
+	// upstreamErrorRate is the error rate that triggers an upstream.error_rate event
+	upstreamErrorRate = 0.5
+	// upstreamAlertCooldown is the least time between upstream.error_rate events
+	upstreamAlertCooldown = 10 * time.Minute
+)
+
+// upstreamStats counts the requests to SoundCloud and how many of them failed
+type upstreamStats struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	requests    int
+	errors      int
+	lastAlert   time.Time
+}
+
+// record counts a request, returning the error rate if it has just crossed upstreamErrorRate
+func (u *upstreamStats) record(failed bool) (float64, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(u.windowStart) > upstreamWindow {
+		u.windowStart = now
+		u.requests = 0
+		u.errors = 0
+	}
+
+	u.requests++
+	if failed {
+		u.errors++
+	}
+
+	rate := float64(u.errors) / float64(u.requests)
+	if !failed || u.requests < upstreamMinRequests || rate < upstreamErrorRate || now.Sub(u.lastAlert) < upstreamAlertCooldown {
+		return rate, false
+	}
+
+	u.lastAlert = now
+	return rate, true
+}
+
+// upstreamTransport watches every request made to SoundCloud, refreshing the client ID when
+// it is rejected and raising an alert when too many requests fail. Requests made on behalf
+// of a user are authenticated with their OAuth token.
+type upstreamTransport struct {
+	next   http.RoundTripper
+	server *Server
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = authenticateUpstream(req)
+	res, err := t.next.RoundTrip(req)
+
+	failed := err != nil || res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+	if rate, alert := t.server.upstream.record(failed); alert {
+		t.server.webhooks.dispatch(eventUpstreamErrorRate, map[string]interface{}{
+			"errorRate": rate,
+			"window":    upstreamWindow.String(),
+		})
+	}
+
+	// A rejected OAuth token says nothing about the client ID
+	if err == nil && res.StatusCode == http.StatusUnauthorized && strings.Contains(req.URL.RawQuery, "client_id=") && oauthToken(req.Context()) == "" {
+		go t.server.refreshClientID()
+	}
+
+	return res, err
+}
+
+// contextTransport makes every request with ctx, for the SoundCloud client which makes its
+// requests without a context
+type contextTransport struct {
+	next http.RoundTripper
+	ctx  context.Context
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(req.WithContext(t.ctx))
+}
+
+// soundcloud returns the SoundCloud client to make the requests of ctx with. Requests made
+// on behalf of a user or in the bulk lane get a client of their own that makes them with
+// ctx, the shared one is anonymous and interactive.
+func (s *Server) soundcloud(ctx context.Context) *soundcloudapi.API {
+	if oauthToken(ctx) == "" && requestLane(ctx) == laneInteractive {
+		return s.scdl
+	}
+
+	// A client ID is given, so this makes no requests and can't fail
+	api, err := soundcloudapi.New(soundcloudapi.APIOptions{
+		ClientID: s.scdl.ClientID(),
+		HTTPClient: &http.Client{
+			Transport: &contextTransport{next: s.httpClient.Transport, ctx: ctx},
+		},
+	})
+	if err != nil {
+		return s.scdl
+	}
+
+	return api
+}
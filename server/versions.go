@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// apiVersion is a version of the public API. Response shapes of a version never change once
+// the frontend depends on them, richer shapes go into a new version instead.
+type apiVersion int
+
+const (
+	apiV1 apiVersion = iota + 1
+	apiV2
+)
+
+// deprecation describes a deprecated route group, which keeps working but tells clients
+// where to move to with the Deprecation, Sunset and Link headers
+type deprecation struct {
+	// successor is the path prefix that replaces the deprecated routes, e.g. "/v1"
+	successor string
+	// sunset is when the routes will be removed, it is omitted if zero
+	sunset time.Time
+}
+
+// versioned tags a request with the API version of the route it matched, and adds the
+// deprecation headers if the route is deprecated
+func (s *Server) versioned(version apiVersion, dep *deprecation, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if dep != nil {
+			w.Header().Set("Deprecation", "true")
+			if !dep.sunset.IsZero() {
+				w.Header().Set("Sunset", dep.sunset.UTC().Format(http.TimeFormat))
+			}
+			if dep.successor != "" {
+				w.Header().Set("Link", "<"+dep.successor+r.URL.Path+">; rel=\"successor-version\"")
+			}
+			w.Header().Set("Access-Control-Expose-Headers", "Deprecation, Sunset, Link")
+		}
+
+		ctx := context.WithValue(r.Context(), ContextVersion, version)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+}
+
+// requestVersion returns the API version of the route a request matched
+func requestVersion(r *http.Request) apiVersion {
+	if version, ok := r.Context().Value(ContextVersion).(apiVersion); ok {
+		return version
+	}
+
+	return apiV1
+}
+
+// parseSunset parses the sunset date of the legacy routes, given as YYYY-MM-DD
+func parseSunset(value string) (time.Time, error) {
+	if strings.TrimSpace(value) == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse("2006-01-02", strings.TrimSpace(value))
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Events that are sent to webhooks
+const (
+	eventPing                  = "ping"
+	eventReportThreshold       = "report.threshold"
+	eventClientIDRefreshFailed = "clientid.refresh_failed"
+	eventUpstreamErrorRate     = "upstream.error_rate"
+)
+
+const (
+	// webhookAttempts is how many times a delivery is tried before giving up
+	webhookAttempts = 5
+	// webhookBackoff is how long to wait before the first retry, it doubles every retry
+	webhookBackoff = time.Second
+	// webhookLogSize is how many deliveries are kept in the delivery log
+	webhookLogSize = 100
+)
+
+// webhookEvent is the JSON payload POSTed to webhooks
+type webhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// webhookDelivery records the outcome of sending an event to a webhook
+type webhookDelivery struct {
+	EventID   string    `json:"eventID"`
+	EventType string    `json:"eventType"`
+	URL       string    `json:"url"`
+	Attempts  int       `json:"attempts"`
+	Status    int       `json:"status,omitempty"`
+	Err       string    `json:"err,omitempty"`
+	Success   bool      `json:"success"`
+	Time      time.Time `json:"time"`
+}
+
+// webhookDispatcher signs events and POSTs them to every configured URL, retrying
+// failed deliveries with exponential backoff
+type webhookDispatcher struct {
+	client  *http.Client
+	backoff time.Duration
+
+	mu sync.Mutex
+	// urls and secret can be changed by a config reload, they are read with targets
+	urls   []string
+	secret []byte
+	log    []webhookDelivery
+}
+
+func newWebhookDispatcher(urls []string, secret string) *webhookDispatcher {
+	d := &webhookDispatcher{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: webhookBackoff,
+	}
+	d.configure(urls, secret)
+
+	return d
+}
+
+// configure replaces the webhook URLs and secret, deliveries in progress keep the old ones
+func (d *webhookDispatcher) configure(urls []string, secret string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.urls = urls
+	d.secret = []byte(secret)
+}
+
+// targets returns the current webhook URLs and secret
+func (d *webhookDispatcher) targets() ([]string, []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.urls, d.secret
+}
+
+// sign returns the signature of a payload sent in the X-Webhook-Signature header
+func sign(secret []byte, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newEventID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// dispatch sends an event to every webhook in the background
+func (d *webhookDispatcher) dispatch(eventType string, data interface{}) {
+	if urls, _ := d.targets(); len(urls) == 0 {
+		return
+	}
+
+	go d.send(context.Background(), eventType, data, webhookAttempts)
+}
+
+// send sends an event to every webhook, returning once every delivery has succeeded, run out
+// of attempts or ctx is done
+func (d *webhookDispatcher) send(ctx context.Context, eventType string, data interface{}, attempts int) []webhookDelivery {
+	event := webhookEvent{
+		ID:        newEventID(),
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		fmt.Println(err.Error())
+		return nil
+	}
+
+	urls, secret := d.targets()
+	signature := sign(secret, payload)
+
+	deliveries := make([]webhookDelivery, len(urls))
+	wg := &sync.WaitGroup{}
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			deliveries[i] = d.deliver(ctx, event, u, payload, signature, attempts)
+			d.record(deliveries[i])
+		}(i, u)
+	}
+	wg.Wait()
+
+	return deliveries
+}
+
+// deliver POSTs the payload to a single webhook until it responds with a 2xx status
+func (d *webhookDispatcher) deliver(ctx context.Context, event webhookEvent, u string, payload []byte, signature string, attempts int) webhookDelivery {
+	// The delivery log is served by the admin API, the URL may contain a token
+	delivery := webhookDelivery{EventID: event.ID, EventType: event.Type, URL: redactWebhookURL(u)}
+	backoff := d.backoff
+
+	for delivery.Attempts < attempts {
+		if delivery.Attempts > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			if ctx.Err() != nil {
+				delivery.Err = ctx.Err().Error()
+				break
+			}
+			backoff *= 2
+		}
+		delivery.Attempts++
+		delivery.Time = time.Now().UTC()
+
+		req, err := http.NewRequestWithContext(ctx, "POST", u, bytes.NewReader(payload))
+		if err != nil {
+			delivery.Err = err.Error()
+			break
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Webhook-Event", event.Type)
+		req.Header.Set("X-Webhook-ID", event.ID)
+		req.Header.Set("X-Webhook-Signature", signature)
+
+		res, err := d.client.Do(req)
+		if err != nil {
+			// The error would repeat the URL, which may contain a token
+			if urlErr, ok := err.(*url.Error); ok {
+				err = urlErr.Err
+			}
+			delivery.Err = err.Error()
+			continue
+		}
+		res.Body.Close()
+
+		delivery.Status = res.StatusCode
+		if res.StatusCode >= 200 && res.StatusCode <= 299 {
+			delivery.Err = ""
+			delivery.Success = true
+			break
+		}
+		delivery.Err = fmt.Sprintf("Webhook returned non 2xx status: %d", res.StatusCode)
+	}
+
+	if !delivery.Success {
+		fmt.Println(Entry{
+			Severity:  "WARNING",
+			Message:   fmt.Sprintf("Failed to deliver %s event to %s: %s", event.Type, delivery.URL, delivery.Err),
+			Component: "webhook",
+		})
+	}
+
+	return delivery
+}
+
+// record adds a delivery to the delivery log, dropping the oldest one if it is full
+func (d *webhookDispatcher) record(delivery webhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.log = append(d.log, delivery)
+	if len(d.log) > webhookLogSize {
+		d.log = d.log[len(d.log)-webhookLogSize:]
+	}
+}
+
+// deliveries returns the delivery log, most recent first
+func (d *webhookDispatcher) deliveries() []webhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deliveries := make([]webhookDelivery, len(d.log))
+	for i, delivery := range d.log {
+		deliveries[len(d.log)-1-i] = delivery
+	}
+
+	return deliveries
+}
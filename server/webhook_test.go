@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newWebhookReceiver returns a webhook that fails the first failures requests with a 500,
+// and counts every request in received
+func newWebhookReceiver(t *testing.T, failures int32, received *int32) *httptest.Server {
+	t.Helper()
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(received, 1) <= failures {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(receiver.Close)
+
+	return receiver
+}
+
+func TestWebhookSignature(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body}
+	}))
+	defer receiver.Close()
+
+	d := newWebhookDispatcher([]string{receiver.URL}, "webhook-secret")
+	deliveries := d.send(context.Background(), eventPing, map[string]string{"message": "Test event"}, 1)
+	if len(deliveries) != 1 || !deliveries[0].Success {
+		t.Fatalf("deliveries = %+v, want one successful delivery", deliveries)
+	}
+
+	req := <-requests
+	mac := hmac.New(sha256.New, []byte("webhook-secret"))
+	mac.Write(req.body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.header.Get("X-Webhook-Signature") != want {
+		t.Errorf("X-Webhook-Signature = %q, want %q", req.header.Get("X-Webhook-Signature"), want)
+	}
+
+	event := webhookEvent{}
+	if err := json.Unmarshal(req.body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != eventPing || req.header.Get("X-Webhook-Event") != eventPing {
+		t.Errorf("event type = %q, header = %q, want %q", event.Type, req.header.Get("X-Webhook-Event"), eventPing)
+	}
+	if event.ID == "" || req.header.Get("X-Webhook-ID") != event.ID {
+		t.Errorf("X-Webhook-ID = %q, want the event ID %q", req.header.Get("X-Webhook-ID"), event.ID)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	var received int32
+	receiver := newWebhookReceiver(t, 2, &received)
+
+	d := newWebhookDispatcher([]string{receiver.URL}, "webhook-secret")
+	d.backoff = time.Millisecond
+	deliveries := d.send(context.Background(), eventPing, nil, webhookAttempts)
+
+	if len(deliveries) != 1 || !deliveries[0].Success || deliveries[0].Attempts != 3 || deliveries[0].Err != "" {
+		t.Errorf("deliveries = %+v, want a success on the third attempt", deliveries)
+	}
+}
+
+func TestWebhookRetriesGiveUp(t *testing.T) {
+	var received int32
+	receiver := newWebhookReceiver(t, webhookAttempts, &received)
+
+	d := newWebhookDispatcher([]string{receiver.URL}, "webhook-secret")
+	d.backoff = time.Millisecond
+	start := time.Now()
+	deliveries := d.send(context.Background(), eventPing, nil, webhookAttempts)
+
+	if len(deliveries) != 1 || deliveries[0].Success || deliveries[0].Attempts != webhookAttempts || deliveries[0].Status != 500 {
+		t.Errorf("deliveries = %+v, want %d failed attempts", deliveries, webhookAttempts)
+	}
+	// The backoff doubles every retry, 1+2+4+8ms
+	if elapsed := time.Since(start); elapsed < 15*time.Millisecond {
+		t.Errorf("retries took %s, want at least 15ms of backoff", elapsed)
+	}
+	if received := atomic.LoadInt32(&received); received != webhookAttempts {
+		t.Errorf("webhook got %d requests, want %d", received, webhookAttempts)
+	}
+}
+
+func TestWebhookRetriesStopWithContext(t *testing.T) {
+	var received int32
+	receiver := newWebhookReceiver(t, webhookAttempts, &received)
+
+	d := newWebhookDispatcher([]string{receiver.URL}, "webhook-secret")
+	d.backoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	deliveries := d.send(ctx, eventPing, nil, webhookAttempts)
+
+	if len(deliveries) != 1 || deliveries[0].Success || deliveries[0].Attempts != 1 || deliveries[0].Err != context.DeadlineExceeded.Error() {
+		t.Errorf("deliveries = %+v, want one attempt cut short by the context", deliveries)
+	}
+}
+
+func TestWebhookDeliveriesAreRedacted(t *testing.T) {
+	var received int32
+	receiver := newWebhookReceiver(t, 0, &received)
+
+	d := newWebhookDispatcher([]string{receiver.URL + "/hooks/webhook-token?key=webhook-key"}, "webhook-secret")
+	d.send(context.Background(), eventPing, nil, 1)
+
+	deliveries := d.deliveries()
+	if len(deliveries) != 1 || !deliveries[0].Success {
+		t.Fatalf("deliveries = %+v, want one successful delivery", deliveries)
+	}
+	if want := receiver.URL + "/REDACTED"; deliveries[0].URL != want {
+		t.Errorf("delivery URL = %q, want %q", deliveries[0].URL, want)
+	}
+}
+
+func TestWebhookLogCap(t *testing.T) {
+	d := newWebhookDispatcher(nil, "")
+	for i := 0; i < webhookLogSize+10; i++ {
+		d.record(webhookDelivery{EventID: fmt.Sprint(i)})
+	}
+
+	deliveries := d.deliveries()
+	if len(deliveries) != webhookLogSize {
+		t.Fatalf("log has %d deliveries, want %d", len(deliveries), webhookLogSize)
+	}
+	if first, last := deliveries[0].EventID, deliveries[webhookLogSize-1].EventID; first != fmt.Sprint(webhookLogSize+9) || last != "10" {
+		t.Errorf("log goes from %s to %s, want the most recent deliveries first", first, last)
+	}
+}
+
+func TestTestWebhooksTriesOnce(t *testing.T) {
+	var received int32
+	receiver := newWebhookReceiver(t, webhookAttempts, &received)
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.WebhookURLs = []string{receiver.URL}
+	})
+	s.webhooks.backoff = time.Hour
+
+	w := httptest.NewRecorder()
+	if err := s.handleTestWebhooks()(w, httptest.NewRequest("POST", "/admin/webhooks/test", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	body := struct {
+		Deliveries []webhookDelivery `json:"deliveries"`
+	}{}
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Deliveries) != 1 || body.Deliveries[0].Attempts != 1 || body.Deliveries[0].Status != 500 {
+		t.Errorf("deliveries = %+v, want a single failed attempt", body.Deliveries)
+	}
+}